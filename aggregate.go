@@ -0,0 +1,232 @@
+package gotelem
+
+// this file implements reducing values for plotting, either by time buckets
+// or by visual downsampling.
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// Aggregate is the summary of a value over one time bucket.
+type Aggregate struct {
+	Timestamp time.Time `json:"ts"` // start of the bucket.
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Mean      float64   `json:"mean"`
+	First     float64   `json:"first"`
+	Last      float64   `json:"last"`
+	Count     int       `json:"count"`
+}
+
+// datumFloat gets the numeric value of a datum. Values that aren't numbers
+// (i.e bitfields) can't be aggregated.
+func datumFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// GetAggregates gets the min, max, mean, first, last and count of a value for
+// every bucket of the given size. Buckets are aligned to the unix epoch, and
+// empty buckets are skipped.
+func (tdb *TelemDb) GetAggregates(ctx context.Context, filter BusEventFilter,
+	field string, bucket time.Duration) ([]Aggregate, error) {
+	bucketMs := bucket.Milliseconds()
+	if bucketMs <= 0 {
+		return nil, errors.New("bucket must be at least 1ms")
+	}
+	res := make([]Aggregate, 0)
+	var cur *Aggregate
+	var sum float64
+	var curStart int64
+	err := tdb.StreamValues(ctx, filter, field, KeysetModifier{Ascending: true}, func(d Datum, c Cursor) error {
+		v, ok := datumFloat(d.Value)
+		if !ok {
+			return nil
+		}
+		start := c.Timestamp - c.Timestamp%bucketMs
+		if cur == nil || start != curStart {
+			if cur != nil {
+				cur.Mean = sum / float64(cur.Count)
+			}
+			res = append(res, Aggregate{
+				Timestamp: time.UnixMilli(start),
+				Min:       v,
+				Max:       v,
+				First:     v,
+			})
+			cur = &res[len(res)-1]
+			curStart = start
+			sum = 0
+		}
+		cur.Min = min(cur.Min, v)
+		cur.Max = max(cur.Max, v)
+		cur.Last = v
+		cur.Count++
+		sum += v
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cur != nil {
+		cur.Mean = sum / float64(cur.Count)
+	}
+	return res, nil
+}
+
+// GetMinMax reduces a value to the smallest and largest points of every
+// bucket, in time order, so plots keep their peaks. Buckets are aligned like
+// GetAggregates. A bucket with one point (or where the min is the max) gives a
+// single point, and values that aren't numbers are skipped.
+func (tdb *TelemDb) GetMinMax(ctx context.Context, filter BusEventFilter,
+	field string, bucket time.Duration) ([]Datum, error) {
+	bucketMs := bucket.Milliseconds()
+	if bucketMs <= 0 {
+		return nil, errors.New("bucket must be at least 1ms")
+	}
+	res := make([]Datum, 0)
+	var lo, hi Datum
+	var loV, hiV float64
+	var curStart int64
+	started := false
+	flush := func() {
+		if !started {
+			return
+		}
+		if lo.Timestamp.Equal(hi.Timestamp) {
+			res = append(res, lo)
+		} else if lo.Timestamp.Before(hi.Timestamp) {
+			res = append(res, lo, hi)
+		} else {
+			res = append(res, hi, lo)
+		}
+	}
+	err := tdb.StreamValues(ctx, filter, field, KeysetModifier{Ascending: true}, func(d Datum, c Cursor) error {
+		v, ok := datumFloat(d.Value)
+		if !ok {
+			return nil
+		}
+		start := c.Timestamp - c.Timestamp%bucketMs
+		if !started || start != curStart {
+			flush()
+			lo, hi, loV, hiV = d, d, v, v
+			curStart = start
+			started = true
+			return nil
+		}
+		if v < loV {
+			lo, loV = d, v
+		}
+		if v > hiV {
+			hi, hiV = d, v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	flush()
+	return res, nil
+}
+
+// maxDownsampleRows is the most values that GetDownsampled will load when it
+// can't bucket them first.
+var maxDownsampleRows = 200000
+
+// ErrTooManyRows is returned by GetDownsampled when the values would have to
+// be loaded all at once and there are too many of them.
+var ErrTooManyRows = errors.New("too many rows, give a start and end time")
+
+// GetDownsampled reduces a value to about the given number of points for
+// plotting. With a start and end time, it's reduced with GetMinMax first, so
+// the whole series is never in memory. Without them, at most
+// maxDownsampleRows values are loaded. The result is in time order.
+func (tdb *TelemDb) GetDownsampled(ctx context.Context, filter BusEventFilter,
+	field string, points int) ([]Datum, error) {
+	if !filter.StartTime.IsZero() && !filter.EndTime.IsZero() && points >= 2 {
+		// min and max are two points for each bucket.
+		bucket := filter.EndTime.Sub(filter.StartTime) / time.Duration(points/2)
+		if bucket >= time.Millisecond {
+			res, err := tdb.GetMinMax(ctx, filter, field, bucket)
+			if err != nil {
+				return nil, err
+			}
+			return DownsampleLTTB(res, points), nil
+		}
+	}
+	res := make([]Datum, 0)
+	err := tdb.StreamValues(ctx, filter, field, KeysetModifier{Ascending: true}, func(d Datum, c Cursor) error {
+		if len(res) >= maxDownsampleRows {
+			return ErrTooManyRows
+		}
+		res = append(res, d)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return DownsampleLTTB(res, points), nil
+}
+
+// DownsampleLTTB reduces the data to the given number of points with the
+// Largest-Triangle-Three-Buckets algorithm, which keeps the shape of the plot.
+// The data must be in time order. Data with non-numeric values is returned as-is.
+func DownsampleLTTB(data []Datum, points int) []Datum {
+	if points >= len(data) || points < 3 {
+		return data
+	}
+	ys := make([]float64, len(data))
+	for i, d := range data {
+		v, ok := datumFloat(d.Value)
+		if !ok {
+			return data
+		}
+		ys[i] = v
+	}
+	x := func(i int) float64 {
+		return float64(data[i].Timestamp.UnixMilli())
+	}
+
+	res := make([]Datum, 0, points)
+	res = append(res, data[0])
+	// the first and last points are always kept, the rest are split in buckets.
+	every := float64(len(data)-2) / float64(points-2)
+	a := 0
+	for i := 0; i < points-2; i++ {
+		// average of the next bucket, the third point of the triangle.
+		nextStart := int(float64(i+1)*every) + 1
+		nextEnd := min(int(float64(i+2)*every)+1, len(data))
+		var avgX, avgY float64
+		for j := nextStart; j < nextEnd; j++ {
+			avgX += x(j)
+			avgY += ys[j]
+		}
+		n := float64(nextEnd - nextStart)
+		avgX /= n
+		avgY /= n
+
+		// pick the point in this bucket that makes the largest triangle.
+		start := int(float64(i)*every) + 1
+		end := int(float64(i+1)*every) + 1
+		maxArea := -1.0
+		next := start
+		for j := start; j < end; j++ {
+			area := math.Abs((x(a)-avgX)*(ys[j]-ys[a]) - (x(a)-x(j))*(avgY-ys[a]))
+			if area > maxArea {
+				maxArea = area
+				next = j
+			}
+		}
+		res = append(res, data[next])
+		a = next
+	}
+	return append(res, data[len(data)-1])
+}
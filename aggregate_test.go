@@ -0,0 +1,239 @@
+package gotelem
+
+import (
+	"context"
+	"errors"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+func TestGetAggregates(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	SeedMockDatabase(tdb)
+	evs := GetSeedEvents()
+	ctx := context.Background()
+	f := BusEventFilter{Names: []string{"bms_module"}}
+
+	var voltages []float64
+	for _, ev := range evs {
+		if m, ok := ev.Data.(*skylab.BmsModule); ok {
+			voltages = append(voltages, float64(m.Voltage))
+		}
+	}
+
+	t.Run("single bucket", func(t *testing.T) {
+		aggs, err := tdb.GetAggregates(ctx, f, "voltage", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the seed data all falls in one hour.
+		if len(aggs) != 1 {
+			t.Fatalf("expected one bucket, got %d", len(aggs))
+		}
+		a := aggs[0]
+		if a.Count != len(voltages) {
+			t.Fatalf("expected count %d, got %d", len(voltages), a.Count)
+		}
+		var sum float64
+		for _, v := range voltages {
+			sum += v
+		}
+		const eps = 1e-4
+		if math.Abs(a.First-voltages[0]) > eps || math.Abs(a.Last-voltages[len(voltages)-1]) > eps {
+			t.Errorf("first/last wrong, got %f %f", a.First, a.Last)
+		}
+		if math.Abs(a.Mean-sum/float64(len(voltages))) > eps {
+			t.Errorf("mean wrong, got %f", a.Mean)
+		}
+		if a.Min > a.Mean || a.Mean > a.Max {
+			t.Errorf("expected min <= mean <= max, got %f %f %f", a.Min, a.Mean, a.Max)
+		}
+	})
+
+	t.Run("small buckets", func(t *testing.T) {
+		aggs, err := tdb.GetAggregates(ctx, f, "voltage", 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total := 0
+		for i, a := range aggs {
+			total += a.Count
+			if a.Timestamp.UnixMilli()%10 != 0 {
+				t.Errorf("bucket %d not aligned: %v", i, a.Timestamp)
+			}
+			if i > 0 && !a.Timestamp.After(aggs[i-1].Timestamp) {
+				t.Errorf("buckets out of order at %d", i)
+			}
+		}
+		if total != len(voltages) {
+			t.Fatalf("expected total count %d, got %d", len(voltages), total)
+		}
+	})
+
+	t.Run("bad bucket", func(t *testing.T) {
+		if _, err := tdb.GetAggregates(ctx, f, "voltage", 0); err == nil {
+			t.Fatal("expected error for zero bucket")
+		}
+	})
+}
+
+func TestGetMinMax(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	ctx := context.Background()
+	start := time.UnixMilli(1700000000000)
+	voltages := []float32{3, 1, 5, 2, 4, 4}
+	for i, v := range voltages {
+		_, err := tdb.AddEventsCtx(ctx, skylab.BusEvent{
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Name:      "bms_module",
+			Data:      &skylab.BmsModule{Voltage: v},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := BusEventFilter{Names: []string{"bms_module"}}
+
+	tests := []struct {
+		name   string
+		bucket time.Duration
+		want   []float64
+	}{
+		// buckets are aligned to the epoch, and start is on a 10s boundary.
+		{name: "one bucket", bucket: 10 * time.Second, want: []float64{1, 5}},
+		{name: "pairs", bucket: 2 * time.Second, want: []float64{3, 1, 5, 2, 4}},
+		{name: "every point", bucket: time.Second, want: []float64{3, 1, 5, 2, 4, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := tdb.GetMinMax(ctx, f, "voltage", tt.bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]float64, len(res))
+			for i, d := range res {
+				got[i], _ = datumFloat(d.Value)
+				if i > 0 && d.Timestamp.Before(res[i-1].Timestamp) {
+					t.Errorf("points out of order at %d", i)
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDownsampled(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	ctx := context.Background()
+	start := time.UnixMilli(1700000000000)
+	evs := make([]skylab.BusEvent, 0)
+	for i := 0; i < 100; i++ {
+		v := float32(1)
+		if i == 42 {
+			v = 10
+		}
+		evs = append(evs, skylab.BusEvent{
+			Timestamp: start.Add(time.Duration(i) * time.Second),
+			Name:      "bms_module",
+			Data:      &skylab.BmsModule{Voltage: v},
+		})
+	}
+	if _, err := tdb.AddEventsCtx(ctx, evs...); err != nil {
+		t.Fatal(err)
+	}
+	f := BusEventFilter{Names: []string{"bms_module"}}
+
+	check := func(t *testing.T, res []Datum, points int) {
+		if len(res) > points {
+			t.Fatalf("expected at most %d points, got %d", points, len(res))
+		}
+		found := false
+		for i, d := range res {
+			v, _ := datumFloat(d.Value)
+			found = found || v == 10
+			if i > 0 && d.Timestamp.Before(res[i-1].Timestamp) {
+				t.Errorf("points out of order at %d", i)
+			}
+		}
+		if !found {
+			t.Errorf("the peak was lost")
+		}
+	}
+
+	t.Run("with range", func(t *testing.T) {
+		f := f
+		f.StartTime = start
+		f.EndTime = start.Add(100 * time.Second)
+		res, err := tdb.GetDownsampled(ctx, f, "voltage", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, res, 10)
+	})
+
+	t.Run("without range", func(t *testing.T) {
+		res, err := tdb.GetDownsampled(ctx, f, "voltage", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t, res, 10)
+	})
+
+	t.Run("too many rows", func(t *testing.T) {
+		old := maxDownsampleRows
+		maxDownsampleRows = 50
+		defer func() { maxDownsampleRows = old }()
+		if _, err := tdb.GetDownsampled(ctx, f, "voltage", 10); !errors.Is(err, ErrTooManyRows) {
+			t.Fatalf("expected ErrTooManyRows, got %v", err)
+		}
+	})
+}
+
+func TestDownsampleLTTB(t *testing.T) {
+	start := time.UnixMilli(0)
+	data := make([]Datum, 1000)
+	for i := range data {
+		data[i] = Datum{Timestamp: start.Add(time.Duration(i) * time.Millisecond), Value: math.Sin(float64(i) / 50)}
+	}
+	// add a spike, which should always be kept.
+	data[500].Value = 10.0
+
+	tests := []struct {
+		name   string
+		points int
+		want   int
+	}{
+		{name: "downsample", points: 100, want: 100},
+		{name: "more points than data", points: 2000, want: 1000},
+		{name: "too few points", points: 2, want: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := DownsampleLTTB(data, tt.points)
+			if len(got) != tt.want {
+				t.Fatalf("expected %d points, got %d", tt.want, len(got))
+			}
+			if got[0] != data[0] || got[len(got)-1] != data[len(data)-1] {
+				t.Error("first and last points must be kept")
+			}
+			spike := false
+			for i, d := range got {
+				if i > 0 && !d.Timestamp.After(got[i-1].Timestamp) {
+					t.Fatalf("points out of order at %d", i)
+				}
+				if d.Value == 10.0 {
+					spike = true
+				}
+			}
+			if !spike {
+				t.Error("spike was dropped")
+			}
+		})
+	}
+}
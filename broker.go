@@ -2,34 +2,388 @@ package gotelem
 
 import (
 	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"log/slog"
 
 	"github.com/kschamplin/gotelem/skylab"
 )
 
+// EventPredicate decides if a bus event should be delivered to a subscriber.
+// It is called from inside Publish, so it should be quick and must be safe
+// to call from multiple goroutines.
+type EventPredicate func(skylab.BusEvent) bool
+
+// OverflowPolicy decides what the broker does when a subscriber's buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest discards the event being published. This is the default.
+	DropNewest OverflowPolicy = iota
+	// DropOldest discards the oldest buffered event to make room for the new one.
+	DropOldest
+	// Block waits for room in the buffer, up to the block timeout.
+	// Note that this holds up delivery to every other subscriber too.
+	Block
+	// Coalesce delivers events like DropNewest while there's room, but
+	// once the buffer is full it keeps only the latest pending event for each
+	// packet name and index. Good for viewers, who only care about the
+	// current value.
+	Coalesce
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop-newest"
+	case DropOldest:
+		return "drop-oldest"
+	case Block:
+		return "block"
+	case Coalesce:
+		return "coalesce"
+	}
+	return "unknown"
+}
+
+// defaultBlockTimeout is used if a blocking subscriber doesn't give a timeout.
+// We never block forever since Publish holds the broker lock.
+const defaultBlockTimeout = 1 * time.Second
+
+// subscriber is a single recipient of broker events.
+type subscriber struct {
+	ch      chan skylab.BusEvent
+	filters []EventPredicate // all of these must match to deliver an event.
+
+	policy       OverflowPolicy
+	blockTimeout time.Duration
+	snapshot     bool // send the latest values when joining.
+
+	delivered atomic.Uint64
+	dropped   atomic.Uint64
+
+	// coalesce state. pending holds the newest event for each packet,
+	// order holds the packets in the order they first became pending.
+	// inflight is set while pump is sending an event it took out of pending,
+	// so send doesn't get ahead of it.
+	mu       sync.Mutex
+	pending  map[latestKey]skylab.BusEvent
+	order    []latestKey
+	inflight bool
+	notify   chan struct{}
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// matches checks an event against every filter of the subscriber.
+func (s *subscriber) matches(ev skylab.BusEvent) bool {
+	for _, f := range s.filters {
+		if !f(ev) {
+			return false
+		}
+	}
+	return true
+}
+
+// send delivers the event according to the overflow policy. It returns
+// false if an event was dropped.
+func (s *subscriber) send(ev skylab.BusEvent) bool {
+	switch s.policy {
+	case DropOldest:
+		// hold the lock so deliveredCount sees the channel and the counter
+		// agree with each other.
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		evicted := false
+		for {
+			select {
+			case s.ch <- ev:
+				s.delivered.Add(1)
+				return !evicted
+			default:
+			}
+			// make room by throwing away the oldest event. The reader may have
+			// emptied the buffer in the meantime, which is fine.
+			select {
+			case <-s.ch:
+				// the reader never saw it, so it's only dropped. delivered
+				// counts what went in here, deliveredCount takes off the rest.
+				s.delivered.Add(^uint64(0))
+				s.dropped.Add(1)
+				evicted = true
+			default:
+				// unbuffered, there's nothing we can evict.
+				if cap(s.ch) == 0 {
+					s.dropped.Add(1)
+					return false
+				}
+			}
+		}
+	case Block:
+		timer := time.NewTimer(s.blockTimeout)
+		defer timer.Stop()
+		select {
+		case s.ch <- ev:
+			s.delivered.Add(1)
+			return true
+		case <-timer.C:
+			s.dropped.Add(1)
+			return false
+		}
+	case Coalesce:
+		key := latestKeyOf(ev)
+		s.mu.Lock()
+		// only coalesce when there's no room. If events are already
+		// pending, this one has to wait behind them to keep the order.
+		if len(s.order) == 0 && !s.inflight {
+			select {
+			case s.ch <- ev:
+				s.delivered.Add(1)
+				s.mu.Unlock()
+				return true
+			default:
+			}
+		}
+		_, replaced := s.pending[key]
+		if replaced {
+			s.dropped.Add(1)
+		} else {
+			s.order = append(s.order, key)
+		}
+		s.pending[key] = ev
+		s.mu.Unlock()
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+		return !replaced
+	default:
+		select {
+		case s.ch <- ev:
+			s.delivered.Add(1)
+			return true
+		default:
+			s.dropped.Add(1)
+			return false
+		}
+	}
+}
+
+// pump moves coalesced events into the subscriber channel.
+func (s *subscriber) pump() {
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.notify:
+		}
+		for {
+			s.mu.Lock()
+			if len(s.order) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			key := s.order[0]
+			s.order = s.order[1:]
+			ev := s.pending[key]
+			delete(s.pending, key)
+			s.inflight = true
+			s.mu.Unlock()
+
+			select {
+			case s.ch <- ev:
+				s.delivered.Add(1)
+			case <-s.done:
+				return
+			}
+			s.mu.Lock()
+			s.inflight = false
+			s.mu.Unlock()
+		}
+	}
+}
+
+// deliveredCount is the number of events the reader has taken. Drop-oldest
+// events sitting in the channel can still be evicted, so those aren't
+// delivered yet.
+func (s *subscriber) deliveredCount() uint64 {
+	if s.policy != DropOldest {
+		return s.delivered.Load()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.delivered.Load() - uint64(len(s.ch))
+}
+
+// queued is the number of events waiting to be read.
+func (s *subscriber) queued() int {
+	n := len(s.ch)
+	if s.policy == Coalesce {
+		s.mu.Lock()
+		n += len(s.order)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// close stops the subscriber and closes its channel.
+func (s *subscriber) close() {
+	if s.policy == Coalesce {
+		close(s.done)
+		<-s.stopped
+	}
+	close(s.ch)
+}
+
+// SubscribeOption changes how a subscriber receives events.
+type SubscribeOption func(*subscriber)
+
+// WithFilter only delivers events that match the given BusEventFilter.
+// Events are checked before they are sent, so they don't use up buffer space.
+func WithFilter(bef BusEventFilter) SubscribeOption {
+	return func(s *subscriber) {
+		s.filters = append(s.filters, bef.Match)
+	}
+}
+
+// WithPredicate only delivers events for which the predicate returns true.
+// It can be combined with WithFilter, in which case both must match.
+func WithPredicate(p EventPredicate) SubscribeOption {
+	return func(s *subscriber) {
+		s.filters = append(s.filters, p)
+	}
+}
+
+// WithOverflowPolicy sets what happens when the subscriber falls behind.
+func WithOverflowPolicy(p OverflowPolicy) SubscribeOption {
+	return func(s *subscriber) {
+		s.policy = p
+	}
+}
+
+// WithBlocking makes Publish wait up to timeout for room in the buffer
+// before dropping the event. Use this for consumers that must not lose data.
+func WithBlocking(timeout time.Duration) SubscribeOption {
+	return func(s *subscriber) {
+		s.policy = Block
+		s.blockTimeout = timeout
+	}
+}
+
+// WithSnapshot sends the latest value of every matching packet as soon as
+// the subscriber joins, so it doesn't have to wait for slow packets.
+func WithSnapshot() SubscribeOption {
+	return func(s *subscriber) {
+		s.snapshot = true
+	}
+}
+
+// SubscriberStats are the delivery counters for a single subscriber.
+type SubscriberStats struct {
+	Name      string `json:"name"`
+	Policy    string `json:"policy"`
+	Delivered uint64 `json:"delivered"`
+	Dropped   uint64 `json:"dropped"`
+	Queued    int    `json:"queued"`
+}
+
+// PacketStats is how often the broker sees a packet name.
+type PacketStats struct {
+	Name  string    `json:"name"`
+	Count uint64    `json:"count"`
+	Rate  float64   `json:"rate"` // packets per second, over the last rateWindow seconds.
+	Last  time.Time `json:"last"`
+}
+
+// rateWindow is how many seconds packet rates are averaged over.
+const rateWindow = 10
+
+// rateCounter counts events in one second buckets, so the recent rate can be
+// found without keeping every timestamp.
+type rateCounter struct {
+	total   uint64
+	last    time.Time
+	buckets [rateWindow]struct {
+		sec int64
+		n   uint64
+	}
+}
+
+func (c *rateCounter) add(now time.Time) {
+	sec := now.Unix()
+	b := &c.buckets[sec%rateWindow]
+	if b.sec != sec {
+		b.sec = sec
+		b.n = 0
+	}
+	b.n++
+	c.total++
+	c.last = now
+}
+
+func (c *rateCounter) rate(now time.Time) float64 {
+	sec := now.Unix()
+	var n uint64
+	for _, b := range c.buckets {
+		if b.sec > sec-rateWindow && b.sec <= sec {
+			n += b.n
+		}
+	}
+	return float64(n) / rateWindow
+}
+
+// latestKey identifies a packet in the last-value cache. Repeated packets
+// (i.e bms_module) are stored separately for each index.
+type latestKey struct {
+	Name string
+	Idx  int // -1 if the packet has no index.
+}
+
+func latestKeyOf(ev skylab.BusEvent) latestKey {
+	key := latestKey{Name: ev.Name, Idx: -1}
+	if idx, ok := packetIndex(ev.Data); ok {
+		key.Idx = idx
+	}
+	return key
+}
+
 // Broker is a Bus Event broadcast system. You can subscribe to events,
-// and send events.
+// and send events. It also remembers the latest event for each packet.
 type Broker struct {
-	subs map[string]chan skylab.BusEvent // contains the channel for each subsciber
+	subs map[string]*subscriber // contains the channel for each subsciber
+
+	latest     map[latestKey]skylab.BusEvent
+	rates      map[string]*rateCounter // also guarded by latestLock.
+	latestLock sync.RWMutex
 
 	logger  *slog.Logger
 	lock    sync.RWMutex
 	bufsize int // size of chan buffer in elements.
+
+	// counters of subscribers that left, so Totals doesn't go backwards.
+	// guarded by lock.
+	pastDelivered, pastDropped uint64
 }
 
 // NewBroker creates a new broker with a given logger.
 func NewBroker(bufsize int, logger *slog.Logger) *Broker {
 	return &Broker{
-		subs:    make(map[string]chan skylab.BusEvent),
+		subs:    make(map[string]*subscriber),
+		latest:  make(map[latestKey]skylab.BusEvent),
+		rates:   make(map[string]*rateCounter),
 		logger:  logger,
 		bufsize: bufsize,
 	}
 }
 
 // Subscribe joins the broker with the given name. The name must be unique.
-func (b *Broker) Subscribe(name string) (ch chan skylab.BusEvent, err error) {
+// Options can be provided to filter the events that are delivered and to
+// choose what happens when the subscriber can't keep up.
+func (b *Broker) Subscribe(name string, opts ...SubscribeOption) (ch chan skylab.BusEvent, err error) {
 	// get rw lock.
 	b.lock.Lock()
 	defer b.lock.Unlock()
@@ -37,14 +391,39 @@ func (b *Broker) Subscribe(name string) (ch chan skylab.BusEvent, err error) {
 	if ok {
 		return nil, errors.New("name already in use")
 	}
-	b.logger.Info("subscribe", "name", name)
-	ch = make(chan skylab.BusEvent, b.bufsize)
+	sub := &subscriber{}
+	for _, opt := range opts {
+		opt(sub)
+	}
+
+	// the snapshot gets its own room in the buffer, so it doesn't cause
+	// the first few live events to be dropped.
+	var snap []skylab.BusEvent
+	if sub.snapshot {
+		snap = b.latestMatching(sub.matches)
+	}
+	ch = make(chan skylab.BusEvent, b.bufsize+len(snap))
+	sub.ch = ch
+	for _, ev := range snap {
+		ch <- ev
+		sub.delivered.Add(1)
+	}
+	if sub.policy == Block && sub.blockTimeout <= 0 {
+		sub.blockTimeout = defaultBlockTimeout
+	}
+	if sub.policy == Coalesce {
+		sub.pending = make(map[latestKey]skylab.BusEvent)
+		sub.notify = make(chan struct{}, 1)
+		sub.done = make(chan struct{})
+		sub.stopped = make(chan struct{})
+		go sub.pump()
+	}
+	b.logger.Info("subscribe", "name", name, "policy", sub.policy)
 
-	b.subs[name] = ch
+	b.subs[name] = sub
 	return
 }
 
-
 // Unsubscribe removes a subscriber matching the name. It doesn't do anything
 // if there's nobody subscribed with that name
 func (b *Broker) Unsubscribe(name string) {
@@ -52,8 +431,10 @@ func (b *Broker) Unsubscribe(name string) {
 	b.lock.Lock()
 	defer b.lock.Unlock()
 	b.logger.Debug("unsubscribe", "name", name)
-	if _, ok := b.subs[name]; ok {
-		close(b.subs[name])
+	if sub, ok := b.subs[name]; ok {
+		sub.close()
+		b.pastDelivered += sub.deliveredCount()
+		b.pastDropped += sub.dropped.Load()
 		delete(b.subs, name)
 	}
 }
@@ -64,16 +445,112 @@ func (b *Broker) Publish(sender string, message skylab.BusEvent) {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 	b.logger.Debug("publish", "sender", sender, "message", message)
-	for name, ch := range b.subs {
+
+	key := latestKeyOf(message)
+	b.latestLock.Lock()
+	b.latest[key] = message
+	rc, ok := b.rates[message.Name]
+	if !ok {
+		rc = &rateCounter{}
+		b.rates[message.Name] = rc
+	}
+	rc.add(time.Now())
+	b.latestLock.Unlock()
+
+	for name, sub := range b.subs {
 		if name == sender {
 			continue
 		}
-		// non blocking send.
-		select {
-		case ch <- message:
-		default:
-			b.logger.Warn("recipient buffer full", "dest", name)
+		if !sub.matches(message) {
+			continue
+		}
+		// coalesced subscribers replace old events all the time, don't spam.
+		if !sub.send(message) && sub.policy != Coalesce {
+			b.logger.Warn("recipient buffer full", "dest", name,
+				"policy", sub.policy, "dropped", sub.dropped.Load())
 		}
 	}
 
 }
+
+// Stats returns the delivery counters for every subscriber, sorted by name.
+func (b *Broker) Stats() []SubscriberStats {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	stats := make([]SubscriberStats, 0, len(b.subs))
+	for name, sub := range b.subs {
+		stats = append(stats, SubscriberStats{
+			Name:      name,
+			Policy:    sub.policy.String(),
+			Delivered: sub.deliveredCount(),
+			Dropped:   sub.dropped.Load(),
+			Queued:    sub.queued(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// Totals returns how many events were delivered and dropped over every
+// subscriber, including ones that have unsubscribed.
+func (b *Broker) Totals() (delivered, dropped uint64) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	delivered, dropped = b.pastDelivered, b.pastDropped
+	for _, sub := range b.subs {
+		delivered += sub.deliveredCount()
+		dropped += sub.dropped.Load()
+	}
+	return
+}
+
+// PacketStats returns how often each packet name was published, sorted by
+// name. The rate uses the time the broker got the packet, not its timestamp.
+func (b *Broker) PacketStats() []PacketStats {
+	now := time.Now()
+	b.latestLock.RLock()
+	defer b.latestLock.RUnlock()
+	stats := make([]PacketStats, 0, len(b.rates))
+	for name, rc := range b.rates {
+		stats = append(stats, PacketStats{
+			Name:  name,
+			Count: rc.total,
+			Rate:  rc.rate(now),
+			Last:  rc.last,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Name < stats[j].Name
+	})
+	return stats
+}
+
+// Latest returns the most recent event for each packet name and index that
+// matches the filter, sorted by name and index.
+func (b *Broker) Latest(bef BusEventFilter) []skylab.BusEvent {
+	return b.latestMatching(bef.Match)
+}
+
+func (b *Broker) latestMatching(match EventPredicate) []skylab.BusEvent {
+	b.latestLock.RLock()
+	keys := make([]latestKey, 0, len(b.latest))
+	for k, ev := range b.latest {
+		if match(ev) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name != keys[j].Name {
+			return keys[i].Name < keys[j].Name
+		}
+		return keys[i].Idx < keys[j].Idx
+	})
+	events := make([]skylab.BusEvent, len(keys))
+	for i, k := range keys {
+		events[i] = b.latest[k]
+	}
+	b.latestLock.RUnlock()
+	return events
+}
@@ -106,6 +106,54 @@ func TestBroker(t *testing.T) {
 
 	})
 
+	t.Run("filtered subscribe", func(t *testing.T) {
+		flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		broker := NewBroker(1, flog)
+		sub, err := broker.Subscribe("filtered", WithFilter(BusEventFilter{
+			Names: []string{"wsl_velocity"},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the buffer only holds one event, so if the filter wasn't applied
+		// the bms packets would fill it and the velocity would be dropped.
+		for i := 0; i < 5; i++ {
+			broker.Publish("other", makeEvent())
+		}
+		want := skylab.BusEvent{
+			Timestamp: time.Now(),
+			Name:      "wsl_velocity",
+			Data:      &skylab.WslVelocity{VehicleVelocity: 10},
+		}
+		broker.Publish("other", want)
+
+		select {
+		case got := <-sub:
+			if got.Name != want.Name {
+				t.Fatalf("got wrong packet, want %s got %s", want.Name, got.Name)
+			}
+		case <-time.After(1 * time.Second):
+			t.Fatal("timeout waiting for packet")
+		}
+	})
+
+	t.Run("predicate subscribe", func(t *testing.T) {
+		flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		broker := NewBroker(10, flog)
+		sub, err := broker.Subscribe("pred", WithPredicate(func(ev skylab.BusEvent) bool {
+			return false
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		broker.Publish("other", makeEvent())
+		select {
+		case ev := <-sub:
+			t.Fatalf("expected no events, got %v", ev)
+		case <-time.After(10 * time.Millisecond):
+		}
+	})
+
 	t.Run("unsubscribe", func(t *testing.T) {
 		flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
 		broker := NewBroker(10, flog)
@@ -119,4 +167,250 @@ func TestBroker(t *testing.T) {
 			t.Fatal("expected dead channel, but channel returned result")
 		}
 	})
+
+	t.Run("overflow policies", func(t *testing.T) {
+		flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		// makeNamed creates an event with a unique timestamp so we can
+		// tell which ones were kept.
+		makeNamed := func(name string, ms int64) skylab.BusEvent {
+			ev := makeEvent()
+			ev.Name = name
+			ev.Timestamp = time.UnixMilli(ms)
+			return ev
+		}
+
+		t.Run("drop newest", func(t *testing.T) {
+			broker := NewBroker(2, flog)
+			sub, _ := broker.Subscribe("sub")
+			for i := int64(0); i < 5; i++ {
+				broker.Publish("other", makeNamed("a", i))
+			}
+			if ev := <-sub; ev.Timestamp.UnixMilli() != 0 {
+				t.Fatalf("expected first event to be kept, got %v", ev.Timestamp.UnixMilli())
+			}
+			stats := broker.Stats()[0]
+			if stats.Delivered != 2 || stats.Dropped != 3 {
+				t.Fatalf("bad stats, got %+v", stats)
+			}
+		})
+
+		t.Run("drop oldest", func(t *testing.T) {
+			broker := NewBroker(2, flog)
+			sub, _ := broker.Subscribe("sub", WithOverflowPolicy(DropOldest))
+			for i := int64(0); i < 5; i++ {
+				broker.Publish("other", makeNamed("a", i))
+			}
+			if ev := <-sub; ev.Timestamp.UnixMilli() != 3 {
+				t.Fatalf("expected oldest events to be dropped, got %v", ev.Timestamp.UnixMilli())
+			}
+			// evicted events only count as dropped, and the one still in the
+			// buffer isn't delivered yet.
+			stats := broker.Stats()[0]
+			if stats.Delivered != 1 || stats.Dropped != 3 || stats.Queued != 1 {
+				t.Fatalf("bad stats, got %+v", stats)
+			}
+		})
+
+		t.Run("block", func(t *testing.T) {
+			broker := NewBroker(1, flog)
+			sub, _ := broker.Subscribe("sub", WithBlocking(time.Second))
+			broker.Publish("other", makeNamed("a", 0))
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				<-sub
+			}()
+			// this should wait for the reader instead of dropping.
+			broker.Publish("other", makeNamed("a", 1))
+			stats := broker.Stats()[0]
+			if stats.Delivered != 2 || stats.Dropped != 0 {
+				t.Fatalf("bad stats, got %+v", stats)
+			}
+		})
+
+		t.Run("block timeout", func(t *testing.T) {
+			broker := NewBroker(1, flog)
+			broker.Subscribe("sub", WithBlocking(time.Millisecond))
+			broker.Publish("other", makeNamed("a", 0))
+			broker.Publish("other", makeNamed("a", 1))
+			stats := broker.Stats()[0]
+			if stats.Delivered != 1 || stats.Dropped != 1 {
+				t.Fatalf("bad stats, got %+v", stats)
+			}
+		})
+
+		t.Run("coalesce", func(t *testing.T) {
+			broker := NewBroker(0, flog)
+			sub, _ := broker.Subscribe("sub", WithOverflowPolicy(Coalesce))
+			// nobody is reading, so these pile up and get coalesced.
+			for i := int64(0); i < 5; i++ {
+				broker.Publish("other", makeNamed("a", i))
+				broker.Publish("other", makeNamed("b", i))
+			}
+			// the first event may already be in flight, but after that
+			// we should only see the latest one for each name.
+			got := make(map[string]int64)
+			n := 0
+			for got["a"] != 4 || got["b"] != 4 {
+				select {
+				case ev := <-sub:
+					got[ev.Name] = ev.Timestamp.UnixMilli()
+					n++
+				case <-time.After(time.Second):
+					t.Fatalf("timeout waiting for coalesced events, got %v", got)
+				}
+			}
+			if n > 3 {
+				t.Fatalf("expected at most 3 events, got %d", n)
+			}
+			broker.Unsubscribe("sub")
+			if _, ok := <-sub; ok {
+				t.Fatal("expected closed channel")
+			}
+		})
+
+		t.Run("coalesce with room", func(t *testing.T) {
+			broker := NewBroker(100, flog)
+			sub, _ := broker.Subscribe("sub", WithOverflowPolicy(Coalesce))
+			for i := uint32(0); i < 10; i++ {
+				broker.Publish("other", skylab.BusEvent{Timestamp: time.UnixMilli(int64(i)), Name: "bms_module",
+					Data: &skylab.BmsModule{Idx: i}})
+			}
+			stats := broker.Stats()[0]
+			if stats.Delivered != 10 || stats.Dropped != 0 {
+				t.Fatalf("nothing should be coalesced while there's room, got %+v", stats)
+			}
+			for i := 0; i < 10; i++ {
+				if ev := <-sub; ev.Timestamp.UnixMilli() != int64(i) {
+					t.Fatalf("events out of order, expected %d got %d", i, ev.Timestamp.UnixMilli())
+				}
+			}
+			broker.Unsubscribe("sub")
+		})
+
+		t.Run("coalesce by index", func(t *testing.T) {
+			broker := NewBroker(1, flog)
+			sub, _ := broker.Subscribe("sub", WithOverflowPolicy(Coalesce))
+			// the first one fills the buffer, then each index is coalesced.
+			for round := int64(0); round < 3; round++ {
+				for i := uint32(0); i < 3; i++ {
+					broker.Publish("other", skylab.BusEvent{Timestamp: time.UnixMilli(round*10 + int64(i)), Name: "bms_module",
+						Data: &skylab.BmsModule{Idx: i}})
+				}
+			}
+			got := make(map[uint32]int64)
+			for len(got) < 3 || got[0] != 20 || got[1] != 21 || got[2] != 22 {
+				select {
+				case ev := <-sub:
+					got[ev.Data.(*skylab.BmsModule).Idx] = ev.Timestamp.UnixMilli()
+				case <-time.After(time.Second):
+					t.Fatalf("timeout waiting for the latest of every index, got %v", got)
+				}
+			}
+			broker.Unsubscribe("sub")
+		})
+	})
+
+	t.Run("latest values", func(t *testing.T) {
+		flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		broker := NewBroker(10, flog)
+		for i := uint32(0); i < 3; i++ {
+			broker.Publish("other", skylab.BusEvent{
+				Timestamp: time.UnixMilli(int64(i)),
+				Name:      "bms_module",
+				Data:      &skylab.BmsModule{Idx: i % 2},
+			})
+		}
+		broker.Publish("other", makeEvent())
+
+		latest := broker.Latest(BusEventFilter{})
+		if len(latest) != 3 {
+			t.Fatalf("expected 3 latest values, got %d", len(latest))
+		}
+		// sorted by name, then index.
+		if latest[0].Name != "bms_measurement" {
+			t.Fatalf("expected bms_measurement first, got %s", latest[0].Name)
+		}
+		if latest[1].Timestamp.UnixMilli() != 2 || latest[2].Timestamp.UnixMilli() != 1 {
+			t.Fatalf("got stale values: %v", latest[1:])
+		}
+
+		filtered := broker.Latest(BusEventFilter{Indexes: []int{1}})
+		if len(filtered) != 1 {
+			t.Fatalf("expected 1 filtered value, got %d", len(filtered))
+		}
+	})
+
+	t.Run("snapshot on subscribe", func(t *testing.T) {
+		flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		broker := NewBroker(1, flog)
+		broker.Publish("other", makeEvent())
+		broker.Publish("other", skylab.BusEvent{
+			Timestamp: time.Now(),
+			Name:      "wsl_velocity",
+			Data:      &skylab.WslVelocity{},
+		})
+
+		sub, err := broker.Subscribe("snap", WithSnapshot(), WithFilter(BusEventFilter{
+			Names: []string{"bms_measurement"},
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case ev := <-sub:
+			if ev.Name != "bms_measurement" {
+				t.Fatalf("expected bms_measurement snapshot, got %s", ev.Name)
+			}
+		default:
+			t.Fatal("expected snapshot to be ready immediately")
+		}
+		// the snapshot shouldn't take up room for live events.
+		broker.Publish("other", makeEvent())
+		if stats := broker.Stats()[0]; stats.Dropped != 0 {
+			t.Fatalf("expected no drops, got %+v", stats)
+		}
+	})
+
+	t.Run("packet stats", func(t *testing.T) {
+		flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		broker := NewBroker(1, flog)
+		for i := 0; i < 3; i++ {
+			broker.Publish("other", makeEvent())
+		}
+		broker.Publish("other", skylab.BusEvent{
+			Timestamp: time.Now(),
+			Name:      "wsl_velocity",
+			Data:      &skylab.WslVelocity{},
+		})
+		stats := broker.PacketStats()
+		if len(stats) != 2 {
+			t.Fatalf("expected 2 packet names, got %+v", stats)
+		}
+		if stats[0].Name != "bms_measurement" || stats[0].Count != 3 || stats[1].Count != 1 {
+			t.Fatalf("wrong counts: %+v", stats)
+		}
+		if want := 3.0 / rateWindow; stats[0].Rate != want {
+			t.Fatalf("expected rate %v, got %v", want, stats[0].Rate)
+		}
+	})
+
+	t.Run("rate counter", func(t *testing.T) {
+		start := time.Unix(1700000000, 0)
+		var rc rateCounter
+		for i := 0; i < rateWindow*2; i++ {
+			// two per second.
+			rc.add(start.Add(time.Duration(i) * time.Second / 2))
+		}
+		now := start.Add(rateWindow * time.Second)
+		if r := rc.rate(now); r != 2*float64(rateWindow-1)/rateWindow {
+			// the first second is out of the window.
+			t.Fatalf("wrong rate %v", r)
+		}
+		if r := rc.rate(now.Add(time.Hour)); r != 0 {
+			t.Fatalf("expected old counts to be ignored, got %v", r)
+		}
+		if rc.total != rateWindow*2 {
+			t.Fatalf("wrong total %d", rc.total)
+		}
+	})
 }
@@ -2,14 +2,22 @@ package cli
 
 import (
 	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/kschamplin/gotelem"
+	"github.com/kschamplin/gotelem/internal/can"
 	"github.com/kschamplin/gotelem/internal/logparsers"
 	"github.com/kschamplin/gotelem/skylab"
 	"github.com/urfave/cli/v2"
@@ -56,13 +64,33 @@ var importCmd = &cli.Command{
 			Usage: "the maximum size of each SQL transaction",
 			Value: 800,
 		},
+		&cli.BoolFlag{
+			Name:  "dedupe",
+			Usage: "skip packets that are already in the database",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Usage: "import the file even if it was imported before, replacing the old import",
+		},
 	},
 	Action: importAction,
 }
 
+// hashFile gets the sha256 of the file, and rewinds it for reading.
+func hashFile(f *os.File) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 // importAction peforms a file import to the database. It can use any of the parsers provided
 // by logparsers. Adding new parsers there will work.
-func importAction(ctx *cli.Context) error {
+func importAction(ctx *cli.Context) (err error) {
 	path := ctx.Args().Get(0)
 	if path == "" {
 		fmt.Println("missing log file!")
@@ -72,20 +100,47 @@ func importAction(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	defer fstream.Close()
+	hash, err := hashFile(fstream)
+	if err != nil {
+		return err
+	}
 	fReader := bufio.NewReader(fstream)
 
 	pfun, ok := logparsers.ParsersMap[ctx.String("format")]
+	// formats with can frames keep the raw frames too, even if they can't be decoded.
+	frameFun, hasFrames := logparsers.FrameParsersMap[ctx.String("format")]
 	if !ok {
 		fmt.Println("invalid format provided: must be one of " + parsersString)
 		cli.ShowAppHelpAndExit(ctx, -1)
 	}
 
 	dbPath := ctx.Path("database")
-	db, err := gotelem.OpenTelemDb(dbPath)
+	db, err := gotelem.OpenTelemDb(dbPath, gotelem.WithDedupe(ctx.Bool("dedupe")))
 	if err != nil {
 		return fmt.Errorf("error opening database: %w", err)
 	}
 
+	// check if we've seen this file before.
+	prev, err := db.FindImport(ctx.Context, hash)
+	if err == nil {
+		if !ctx.Bool("force") {
+			return fmt.Errorf("%s was already imported as import %d on %s, use --force to import it again",
+				path, prev.Id, prev.Date.Format(time.RFC3339))
+		}
+		n, err := db.DeleteImport(ctx.Context, prev.Id)
+		if err != nil {
+			return fmt.Errorf("error removing previous import: %w", err)
+		}
+		fmt.Printf("removed previous import %d (%d packets)\n", prev.Id, n)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+	importId, err := db.BeginImport(ctx.Context, filepath.Base(path), hash)
+	if err != nil {
+		return err
+	}
+
 	// we should batch data, avoiding individual transactions to the database.
 	bSize := ctx.Uint("batch-size")
 	eventsBatch := make([]skylab.BusEvent, bSize)
@@ -95,13 +150,18 @@ func importAction(ctx *cli.Context) error {
 	// stats for imports
 	var n_pkt atomic.Int64
 
-	delegateInsert := func(events []skylab.BusEvent) {
-		n, err := db.AddEventsCtx(ctx.Context, events...)
+	delegateInsert := func(events []skylab.BusEvent) error {
+		n, err := db.AddImportEventsCtx(ctx.Context, importId, events...)
 		if err != nil {
-			fmt.Printf("%v", err)
-			return
+			return err
 		}
 		n_pkt.Add(n)
+		return nil
+	}
+	rawBatch := make([]gotelem.RawFrame, 0, bSize)
+	delegateRawInsert := func(frames []gotelem.RawFrame) error {
+		_, err := db.AddImportRawFramesCtx(ctx.Context, importId, frames...)
+		return err
 	}
 
 	// we use this errorgroup to limit the number of
@@ -109,9 +169,23 @@ func importAction(ctx *cli.Context) error {
 	// we don't thrash the system,
 	eg := new(errgroup.Group)
 	eg.SetLimit(5)
+
+	// if the import fails, remove everything that was added, so it doesn't
+	// look complete and it can be run again.
+	defer func() {
+		if err == nil {
+			return
+		}
+		eg.Wait()
+		// the context could be cancelled already.
+		if _, derr := db.DeleteImport(context.Background(), importId); derr != nil {
+			fmt.Printf("error removing failed import %d: %v\n", importId, derr)
+		}
+	}()
 	var linenum int64 = 0
 	n_unknown := 0
 	n_error := 0
+	var start, end time.Time
 	for {
 		line, err := fReader.ReadString('\n')
 		if err != nil {
@@ -120,7 +194,25 @@ func importAction(ctx *cli.Context) error {
 			}
 			return err
 		}
-		f, err := pfun(line)
+		var f skylab.BusEvent
+		if hasFrames {
+			var frame can.Frame
+			var ts time.Time
+			frame, ts, err = frameFun(line)
+			if err == nil {
+				rawBatch = append(rawBatch, gotelem.NewRawFrame(ts, frame, ""))
+				if len(rawBatch) >= int(bSize) {
+					r := rawBatch
+					eg.Go(func() error {
+						return delegateRawInsert(r)
+					})
+					rawBatch = make([]gotelem.RawFrame, 0, bSize)
+				}
+				f, err = logparsers.FrameToBusEvent(frame, ts)
+			}
+		} else {
+			f, err = pfun(line)
+		}
 		var idErr *skylab.UnknownIdError
 		if errors.As(err, &idErr) {
 			fmt.Printf("unknown id %v\n", idErr.Error())
@@ -131,6 +223,12 @@ func importAction(ctx *cli.Context) error {
 			n_error++
 			continue
 		}
+		if start.IsZero() || f.Timestamp.Before(start) {
+			start = f.Timestamp
+		}
+		if f.Timestamp.After(end) {
+			end = f.Timestamp
+		}
 		eventsBatch[batchIdx] = f
 		linenum++
 		batchIdx++
@@ -138,8 +236,7 @@ func importAction(ctx *cli.Context) error {
 			e := make([]skylab.BusEvent, bSize)
 			copy(e, eventsBatch)
 			eg.Go(func() error {
-				delegateInsert(e)
-				return nil
+				return delegateInsert(e)
 			})
 			batchIdx = 0 // reset the batch
 		}
@@ -150,21 +247,85 @@ func importAction(ctx *cli.Context) error {
 		eg.Go(func() error {
 			// since we don't do any modification
 			// we can avoid the copy
-			delegateInsert(eventsBatch[:batchIdx])
-			return nil
+			return delegateInsert(eventsBatch[:batchIdx])
+		})
+	}
+	if len(rawBatch) > 0 {
+		eg.Go(func() error {
+			return delegateRawInsert(rawBatch)
 		})
 	}
 	// wait for any goroutines.
-	eg.Wait()
-	fmt.Printf("import status: %d successful, %d unknown, %d errors\n", n_pkt.Load(), n_unknown, n_error)
+	if err := eg.Wait(); err != nil {
+		return fmt.Errorf("error inserting packets: %w", err)
+	}
+	if err := db.FinishImport(ctx.Context, importId, n_pkt.Load(), start, end); err != nil {
+		return err
+	}
+	fmt.Printf("import %d status: %d successful, %d unknown, %d errors\n", importId, n_pkt.Load(), n_unknown, n_error)
+
+	return nil
+}
+
+var importsCmd = &cli.Command{
+	Name:  "imports",
+	Usage: "list or delete past imports",
+	Flags: []cli.Flag{
+		&cli.PathFlag{
+			Name:    "database",
+			Aliases: []string{"d", "db"},
+			Usage:   "the path of the database",
+			Value:   "gotelem.db",
+		},
+	},
+	Action: importsList,
+	Subcommands: []*cli.Command{
+		{
+			Name:      "delete",
+			Usage:     "delete an import and all of its packets",
+			ArgsUsage: "<id>",
+			Action:    importsDelete,
+		},
+	},
+}
 
+func importsList(ctx *cli.Context) error {
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	imports, err := db.GetImports(ctx.Context)
+	if err != nil {
+		return err
+	}
+	for _, imp := range imports {
+		fmt.Printf("%d\t%s\t%s\t%d packets\t%s - %s\n", imp.Id, imp.Date.Format(time.RFC3339), imp.Filename,
+			imp.Count, imp.Start.Format(time.RFC3339), imp.End.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func importsDelete(ctx *cli.Context) error {
+	id, err := strconv.ParseInt(ctx.Args().First(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad import id: %w", err)
+	}
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	n, err := db.DeleteImport(ctx.Context, id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted import %d (%d packets)\n", id, n)
 	return nil
 }
 
 var clientCmd = &cli.Command{
 	Name:        "client",
 	Aliases:     []string{"c"},
-	Subcommands: []*cli.Command{importCmd},
+	Subcommands: []*cli.Command{importCmd, importsCmd},
 	Usage:       "Client utilities and tools",
 	Flags: []cli.Flag{
 		&cli.BoolFlag{
@@ -0,0 +1,238 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/kschamplin/gotelem"
+	"github.com/kschamplin/gotelem/skylab"
+	"github.com/urfave/cli/v2"
+)
+
+// this file adds the db command, for database maintenance.
+
+func init() {
+	subCmds = append(subCmds, dbCmd)
+}
+
+var dbPathFlag = &cli.PathFlag{
+	Name:    "database",
+	Aliases: []string{"d", "db"},
+	Usage:   "the path of the database",
+	Value:   "gotelem.db",
+}
+
+var dbCmd = &cli.Command{
+	Name:  "db",
+	Usage: "Database maintenance",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "dedupe",
+			Usage:  "remove duplicate packets, and prepare the database for --dedupe",
+			Flags:  []cli.Flag{dbPathFlag},
+			Action: dbDedupe,
+		},
+		{
+			Name:  "migrate",
+			Usage: "migrate the database up or down to a version, the latest by default",
+			Flags: []cli.Flag{
+				dbPathFlag,
+				&cli.IntFlag{
+					Name:  "to",
+					Usage: "the version to migrate to, 0 removes everything",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the migrations that would be applied without applying them",
+				},
+			},
+			Action: dbMigrate,
+		},
+		{
+			Name:  "history",
+			Usage: "list the applied migrations, and whether they've changed since",
+			Flags: []cli.Flag{
+				dbPathFlag,
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "don't create the history table if the database doesn't have one",
+				},
+			},
+			Action: dbHistory,
+		},
+		{
+			Name:  "redecode",
+			Usage: "decode stored raw frames again and replace the packets that came from them",
+			Flags: []cli.Flag{
+				dbPathFlag,
+				&cli.StringFlag{
+					Name:  "start",
+					Usage: "only redecode frames from this time on (RFC3339)",
+				},
+				&cli.StringFlag{
+					Name:  "end",
+					Usage: "only redecode frames up to this time (RFC3339)",
+				},
+				&cli.PathFlag{
+					Name:  "definitions",
+					Usage: "skylab YAML file or directory to decode with, instead of the built in definitions",
+				},
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print what would change without changing anything",
+				},
+			},
+			Action: dbRedecode,
+		},
+	},
+}
+
+func dbDedupe(ctx *cli.Context) error {
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	n, err := db.Dedupe(ctx.Context)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("removed %d duplicate packets\n", n)
+	return nil
+}
+
+func dbMigrate(ctx *cli.Context) error {
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"), gotelem.WithAutoMigrate(false))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	target := ctx.Int("to")
+	if !ctx.IsSet("to") {
+		target, err = gotelem.LatestMigration()
+		if err != nil {
+			return err
+		}
+	}
+	current, err := db.GetVersion()
+	if err != nil {
+		return err
+	}
+	steps, err := gotelem.PlanMigrations(db, target)
+	if err != nil {
+		return err
+	}
+	_, drift, err := migrationHistory(db, ctx.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+	for _, d := range drift {
+		fmt.Printf("warning: migration %d (%s) changed since it was applied\n", d.Version, d.Name)
+	}
+	fmt.Printf("database is at version %d, target is %d\n", current, target)
+	for _, s := range steps {
+		fmt.Printf("%s\t%d\t%s\n", s.Direction, s.Version, s.Name)
+	}
+	if ctx.Bool("dry-run") {
+		return nil
+	}
+	ver, err := gotelem.MigrateTo(db, target)
+	fmt.Printf("database is now at version %d\n", ver)
+	return err
+}
+
+func dbHistory(ctx *cli.Context) error {
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"), gotelem.WithAutoMigrate(false))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	history, drift, err := migrationHistory(db, ctx.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+	changed := make(map[int]bool)
+	for _, d := range drift {
+		changed[d.Version] = true
+	}
+	for _, m := range history {
+		applied := "unknown"
+		if m.AppliedAt != nil {
+			applied = m.AppliedAt.Format(time.RFC3339)
+		}
+		status := "ok"
+		if changed[m.Version] {
+			status = "CHANGED"
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\n", m.Version, m.Name, applied, m.Checksum[:12], status)
+	}
+	return nil
+}
+
+// migrationHistory gets the migration history and the migrations that changed
+// since. Getting the history creates the table and fills it in for databases
+// from before it, so a dry run only reads it, and skips the check if there's
+// no table yet.
+func migrationHistory(db *gotelem.TelemDb, dryRun bool) ([]gotelem.AppliedMigration, []gotelem.MigrationDrift, error) {
+	var history []gotelem.AppliedMigration
+	var err error
+	if dryRun {
+		history, err = gotelem.ReadMigrationHistory(db)
+	} else {
+		history, err = gotelem.GetMigrationHistory(db)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if dryRun && len(history) == 0 {
+		fmt.Println("database has no migration history, not checking for changed migrations")
+	}
+	drift, err := gotelem.CheckMigrationHistory(history)
+	if err != nil {
+		return nil, nil, err
+	}
+	return history, drift, nil
+}
+
+func dbRedecode(ctx *cli.Context) error {
+	var filter gotelem.RawFrameFilter
+	var err error
+	if ctx.IsSet("start") {
+		filter.StartTime, err = time.Parse(time.RFC3339, ctx.String("start"))
+		if err != nil {
+			return fmt.Errorf("bad start time: %w", err)
+		}
+	}
+	if ctx.IsSet("end") {
+		filter.EndTime, err = time.Parse(time.RFC3339, ctx.String("end"))
+		if err != nil {
+			return fmt.Errorf("bad end time: %w", err)
+		}
+	}
+
+	decode := gotelem.FrameDecoder(skylab.FromCanFrame)
+	if ctx.IsSet("definitions") {
+		defs, err := skylab.LoadDefinitions(ctx.Path("definitions"))
+		if err != nil {
+			return fmt.Errorf("error loading definitions: %w", err)
+		}
+		dec, err := skylab.NewDecoder(defs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("loaded %d packet definitions\n", len(defs.Packets))
+		decode = dec.FromCanFrame
+	}
+
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	stats, err := db.Redecode(ctx.Context, filter, decode, ctx.Bool("dry-run"))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d frames: %d decoded, %d unknown, %d errors. replaced %d packets\n",
+		stats.Frames, stats.Decoded, stats.Unknown, stats.Errors, stats.Removed)
+	if ctx.Bool("dry-run") {
+		fmt.Println("dry run, nothing was changed")
+	}
+	return nil
+}
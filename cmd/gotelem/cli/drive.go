@@ -0,0 +1,137 @@
+package cli
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kschamplin/gotelem"
+	"github.com/urfave/cli/v2"
+)
+
+// this file adds the drive command, for managing drive records.
+
+func init() {
+	subCmds = append(subCmds, driveCmd)
+}
+
+var driveCmd = &cli.Command{
+	Name:  "drive",
+	Usage: "Start, stop, annotate and list drives",
+	Subcommands: []*cli.Command{
+		{
+			Name:   "list",
+			Usage:  "list all drives",
+			Flags:  []cli.Flag{dbPathFlag},
+			Action: driveList,
+		},
+		{
+			Name:      "start",
+			Usage:     "start a new drive now",
+			ArgsUsage: "[note]",
+			Flags:     []cli.Flag{dbPathFlag},
+			Action:    driveStart,
+		},
+		{
+			Name:      "stop",
+			Usage:     "stop a drive now, defaults to the running drive",
+			ArgsUsage: "[id]",
+			Flags:     []cli.Flag{dbPathFlag},
+			Action:    driveStop,
+		},
+		{
+			Name:      "note",
+			Usage:     "set the note of a drive",
+			ArgsUsage: "<id> <note>",
+			Flags:     []cli.Flag{dbPathFlag},
+			Action:    driveNote,
+		},
+	},
+	Description: `
+Drives split the data up by run. Packet queries take drive=<id> as a shorthand
+for the time range of a drive.
+	`,
+}
+
+func printDrive(d gotelem.Drive) {
+	end := "running"
+	if d.End != nil {
+		end = d.End.Format(time.RFC3339)
+	}
+	fmt.Printf("%d\t%s\t%s\t%s\n", d.Id, d.Start.Format(time.RFC3339), end, d.Note)
+}
+
+func driveList(ctx *cli.Context) error {
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	drives, err := db.GetDrives(ctx.Context)
+	if err != nil {
+		return err
+	}
+	for _, d := range drives {
+		printDrive(d)
+	}
+	return nil
+}
+
+func driveStart(ctx *cli.Context) error {
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	d, err := db.StartDrive(ctx.Context, strings.Join(ctx.Args().Slice(), " "))
+	if err != nil {
+		return err
+	}
+	printDrive(d)
+	return nil
+}
+
+func driveStop(ctx *cli.Context) error {
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	var id int
+	if ctx.Args().Present() {
+		id, err = strconv.Atoi(ctx.Args().First())
+		if err != nil {
+			return fmt.Errorf("bad drive id: %w", err)
+		}
+	} else {
+		d, err := db.GetRunningDrive(ctx.Context)
+		if err != nil {
+			return fmt.Errorf("no running drive: %w", err)
+		}
+		id = d.Id
+	}
+	d, err := db.StopDrive(ctx.Context, id)
+	if err != nil {
+		return err
+	}
+	printDrive(d)
+	return nil
+}
+
+func driveNote(ctx *cli.Context) error {
+	if ctx.NArg() < 2 {
+		return fmt.Errorf("usage: drive note <id> <note>")
+	}
+	id, err := strconv.Atoi(ctx.Args().First())
+	if err != nil {
+		return fmt.Errorf("bad drive id: %w", err)
+	}
+	db, err := gotelem.OpenTelemDb(ctx.Path("database"))
+	if err != nil {
+		return fmt.Errorf("error opening database: %w", err)
+	}
+	d, err := db.AnnotateDrive(ctx.Context, id, strings.Join(ctx.Args().Tail(), " "))
+	if err != nil {
+		return err
+	}
+	printDrive(d)
+	return nil
+}
@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/kschamplin/gotelem"
+	"github.com/urfave/cli/v2"
+)
+
+// this file adds the Grafana JSON datasource API, so Grafana can plot the
+// stored telemetry.
+
+func init() {
+	serveCmd.Flags = append(serveCmd.Flags, &cli.BoolFlag{
+		Name:  "grafana",
+		Usage: "serve the Grafana JSON datasource API at /api/grafana",
+	})
+	serveThings = append(serveThings, &grafanaService{})
+}
+
+type grafanaService struct {
+}
+
+func (g *grafanaService) String() string {
+	return "grafana"
+}
+
+// Init adds the datasource to the http router.
+func (g *grafanaService) Init(cCtx *cli.Context, deps svcDeps) (err error) {
+	if !cCtx.Bool("grafana") {
+		return
+	}
+	router := gotelem.GrafanaRouter(deps.Db)
+	gotelem.RouterMods = append(gotelem.RouterMods, func(cr chi.Router) {
+		cr.Mount("/api/grafana", router)
+	})
+	return
+}
+
+// Start doesn't do anything, the datasource is served by the http service.
+func (g *grafanaService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
+	return
+}
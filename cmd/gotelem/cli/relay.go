@@ -0,0 +1,126 @@
+package cli
+
+import (
+	"net"
+	"os"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/kschamplin/gotelem"
+	"github.com/urfave/cli/v2"
+)
+
+// this file adds the relay service, which links the broker to other
+// gotelem instances (i.e car laptop <-> pit laptop).
+
+func init() {
+	serveCmd.Flags = append(serveCmd.Flags, relayFlags...)
+	serveThings = append(serveThings, &relayService{})
+}
+
+var relayFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "relay",
+		Usage: "accept relay links over websockets at /api/relay",
+	},
+	&cli.StringFlag{
+		Name:  "relay-listen",
+		Usage: "accept relay links over TCP on the given address, i.e :8082",
+	},
+	&cli.StringSliceFlag{
+		Name:  "relay-connect",
+		Usage: "relay to another instance, i.e tcp://pit:8082 or ws://pit:8080/api/relay",
+	},
+	&cli.StringFlag{
+		Name:  "relay-id",
+		Usage: "unique node ID for this instance, defaults to the hostname",
+	},
+	&cli.StringSliceFlag{
+		Name:  "relay-send",
+		Usage: "packet names to send over relay links, default is all",
+	},
+	&cli.StringSliceFlag{
+		Name:  "relay-recv",
+		Usage: "packet names to accept from relay links, default is all",
+	},
+}
+
+type relayService struct {
+	relay *gotelem.Relay
+}
+
+func (r *relayService) String() string {
+	return "relay"
+}
+
+func (r *relayService) enabled(cCtx *cli.Context) bool {
+	return cCtx.Bool("relay") || cCtx.IsSet("relay-listen") || cCtx.IsSet("relay-connect")
+}
+
+func (r *relayService) linkConfig(cCtx *cli.Context, name string) gotelem.RelayLinkConfig {
+	return gotelem.RelayLinkConfig{
+		Name:    name,
+		Send:    cCtx.StringSlice("relay-send"),
+		Receive: cCtx.StringSlice("relay-recv"),
+	}
+}
+
+// Init creates the relay and adds the websocket endpoint to the http router.
+func (r *relayService) Init(cCtx *cli.Context, deps svcDeps) (err error) {
+	if !r.enabled(cCtx) {
+		return
+	}
+	nodeID := cCtx.String("relay-id")
+	if nodeID == "" {
+		nodeID, err = os.Hostname()
+		if err != nil {
+			nodeID = uuid.NewString()
+		}
+	}
+	r.relay = gotelem.NewRelay(nodeID, deps.Broker, deps.Logger)
+
+	if cCtx.Bool("relay") {
+		handler := r.relay.ServeWS(r.linkConfig(cCtx, "websocket"))
+		gotelem.RouterMods = append(gotelem.RouterMods, func(router chi.Router) {
+			router.Get("/api/relay", handler)
+		})
+	}
+	return
+}
+
+func (r *relayService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
+	logger := deps.Logger
+	if r.relay == nil {
+		logger.Debug("relay not enabled, skip")
+		return
+	}
+	logger.Info("starting relay", "node", r.relay.NodeID)
+
+	wg := sync.WaitGroup{}
+	if addr := cCtx.String("relay-listen"); addr != "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.relay.ServeTCP(cCtx.Context, ln, r.linkConfig(cCtx, "tcp-listen"))
+			if err != nil {
+				logger.Error("relay listener stopped", "err", err)
+			}
+		}()
+	}
+	for _, addr := range cCtx.StringSlice("relay-connect") {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			r.relay.Dial(cCtx.Context, addr, r.linkConfig(cCtx, addr))
+		}(addr)
+	}
+
+	err = r.relay.Run(cCtx.Context)
+	wg.Wait()
+	return
+}
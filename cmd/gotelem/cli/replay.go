@@ -0,0 +1,107 @@
+package cli
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kschamplin/gotelem"
+	"github.com/urfave/cli/v2"
+)
+
+// this file adds the replay service, which plays a stored drive back
+// into the broker as if it was live.
+
+func init() {
+	serveCmd.Flags = append(serveCmd.Flags, replayFlags...)
+	serveThings = append(serveThings, &replayService{})
+}
+
+var replayFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "replay",
+		Usage: "replay stored packets from the database, controlled at /api/replay",
+	},
+	&cli.StringFlag{
+		Name:  "replay-start",
+		Usage: "start of the replay as an RFC3339 time, defaults to the first packet",
+	},
+	&cli.StringFlag{
+		Name:  "replay-end",
+		Usage: "end of the replay as an RFC3339 time, defaults to the last packet",
+	},
+	&cli.IntFlag{
+		Name:  "replay-drive",
+		Usage: "replay a drive by ID, instead of a start and end time",
+	},
+	&cli.StringSliceFlag{
+		Name:  "replay-name",
+		Usage: "only replay packets with these names",
+	},
+	&cli.Float64Flag{
+		Name:  "replay-speed",
+		Usage: "playback speed multiplier",
+		Value: 1.0,
+	},
+	&cli.BoolFlag{
+		Name:  "replay-loop",
+		Usage: "start over when the replay ends",
+	},
+	&cli.BoolFlag{
+		Name:  "replay-restamp",
+		Usage: "set packet timestamps to the current time so realtime views show them",
+		Value: true,
+	},
+}
+
+type replayService struct {
+	replayer *gotelem.Replayer
+}
+
+func (r *replayService) String() string {
+	return "replay"
+}
+
+// Init creates the replayer and adds the controls to the http router.
+func (r *replayService) Init(cCtx *cli.Context, deps svcDeps) (err error) {
+	if !cCtx.Bool("replay") {
+		return
+	}
+	filter := gotelem.BusEventFilter{
+		Names:   cCtx.StringSlice("replay-name"),
+		DriveID: cCtx.Int("replay-drive"),
+	}
+	if s := cCtx.String("replay-start"); s != "" {
+		filter.StartTime, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return fmt.Errorf("bad replay start: %w", err)
+		}
+	}
+	if s := cCtx.String("replay-end"); s != "" {
+		filter.EndTime, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return fmt.Errorf("bad replay end: %w", err)
+		}
+	}
+
+	r.replayer = gotelem.NewReplayer(deps.Db, deps.Broker, filter, deps.Logger)
+	r.replayer.Restamp = cCtx.Bool("replay-restamp")
+	r.replayer.SetLoop(cCtx.Bool("replay-loop"))
+	if err = r.replayer.SetSpeed(cCtx.Float64("replay-speed")); err != nil {
+		return
+	}
+
+	router := r.replayer.Router()
+	gotelem.RouterMods = append(gotelem.RouterMods, func(cr chi.Router) {
+		cr.Mount("/api/replay", router)
+	})
+	return
+}
+
+func (r *replayService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
+	if r.replayer == nil {
+		deps.Logger.Debug("replay not enabled, skip")
+		return
+	}
+	return r.replayer.Run(cCtx.Context)
+}
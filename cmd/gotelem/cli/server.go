@@ -5,10 +5,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"math"
-	"time"
 	"os"
 	"sync"
+	"time"
 
 	"log/slog"
 
@@ -41,6 +40,23 @@ var serveFlags = []cli.Flag{
 		Name: "demo",
 		Usage: "enable the demo packet stream",
 	},
+	&cli.BoolFlag{
+		Name:  "dedupe",
+		Usage: "skip packets that are already in the database, i.e when several sources see the same packet",
+	},
+	&cli.BoolFlag{
+		Name:  "strict-migrations",
+		Usage: "refuse to open the database if an applied migration has changed",
+	},
+	&cli.PathFlag{
+		Name:  "demo-profile",
+		Usage: "YAML profile for the demo simulator, if not specified uses the default",
+	},
+	&cli.StringSliceFlag{
+		Name:    "metrics-field",
+		Usage:   "skylab value to export in /metrics, i.e bms_measurement.current or a whole packet. Can be repeated",
+		EnvVars: []string{"METRICS_FIELDS"},
+	},
 }
 
 var serveCmd = &cli.Command{
@@ -60,9 +76,24 @@ type service interface {
 	Start(cCtx *cli.Context, deps svcDeps) (err error)
 }
 
+// serviceIniter is implemented by services that need to set things up
+// before any service is started, i.e adding HTTP routes with RouterMods.
+// Init is called in order, so there are no races with the http service.
+type serviceIniter interface {
+	Init(cCtx *cli.Context, deps svcDeps) (err error)
+}
+
+// statusReporter is implemented by services that have a status in
+// /api/v1/stats. Status is called from the http handler, so it must be safe
+// to call while the service is running.
+type statusReporter interface {
+	Status() any
+}
+
 type svcDeps struct {
 	Broker *gotelem.Broker
 	Db     *gotelem.TelemDb
+	Stats  *gotelem.StatsTracker
 	Logger *slog.Logger
 }
 
@@ -101,17 +132,40 @@ func serve(cCtx *cli.Context) error {
 		dbPath = cCtx.Path("db")
 	}
 	logger.Info("opening database", "path", dbPath)
-	db, err := gotelem.OpenTelemDb(dbPath)
+	db, err := gotelem.OpenTelemDb(dbPath, gotelem.WithDedupe(cCtx.Bool("dedupe")),
+		gotelem.WithStrictMigrations(cCtx.Bool("strict-migrations")),
+		gotelem.WithLogger(logger.WithGroup("db")))
 	if err != nil {
 		return err
 	}
 
+	if err := gotelem.SetMetricsFields(cCtx.StringSlice("metrics-field")); err != nil {
+		return err
+	}
+
 	wg := sync.WaitGroup{}
 
 	deps := svcDeps{
 		Logger: logger,
 		Broker: broker,
 		Db:     db,
+		Stats:  gotelem.NewStatsTracker(),
+	}
+
+	for _, svc := range serveThings {
+		if initer, ok := svc.(serviceIniter); ok {
+			s := deps
+			s.Logger = logger.With("service", svc.String())
+			if err := initer.Init(cCtx, s); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, svc := range serveThings {
+		if sr, ok := svc.(statusReporter); ok {
+			deps.Stats.RegisterStatus(svc.String(), sr.Status)
+		}
 	}
 
 	for _, svc := range serveThings {
@@ -138,13 +192,86 @@ func serve(cCtx *cli.Context) error {
 // xBeeService provides data over an Xbee device, either by serial or TCP
 // based on the url provided in the xbee flag. see the description for details.
 type xBeeService struct {
+	mu      sync.Mutex
+	state   string // disabled, connecting, connected, closed or error.
+	err     error
+	device  string
 	session *xbee.Session
+	rssi    *int // from the last poll, asking the xbee is too slow for Status.
 }
 
+// xbeeRSSIInterval is how often the signal strength is polled.
+const xbeeRSSIInterval = 5 * time.Second
+
 func (x *xBeeService) String() string {
-	return "hello"
+	return "xbee"
+}
+
+func (x *xBeeService) setState(state string, err error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.state = state
+	x.err = err
+}
+
+type xBeeStatus struct {
+	State  string             `json:"state"`
+	Error  string             `json:"error,omitempty"`
+	Device string             `json:"device,omitempty"`
+	Addr   string             `json:"addr,omitempty"`
+	RSSI   *int               `json:"rssi,omitempty"` // dBm of the last packet.
+	Link   *xbee.SessionStats `json:"link,omitempty"`
+}
+
+func (x *xBeeService) Status() any {
+	x.mu.Lock()
+	st := xBeeStatus{State: x.state, Device: x.device}
+	if x.err != nil {
+		st.Error = x.err.Error()
+	}
+	sess := x.session
+	x.mu.Unlock()
+	if st.State == "" {
+		st.State = "starting"
+	}
+	if sess == nil || st.State != "connected" {
+		return st
+	}
+	st.Addr = sess.LocalAddr().String()
+	link := sess.Stats()
+	st.Link = &link
+	x.mu.Lock()
+	st.RSSI = x.rssi
+	x.mu.Unlock()
+	return st
 }
-func (x *xBeeService) Status() {
+
+// pollRSSI asks the xbee for the signal strength after packets are received,
+// so Status doesn't have to wait for it.
+func (x *xBeeService) pollRSSI(cCtx *cli.Context, sess *xbee.Session) {
+	ticker := time.NewTicker(xbeeRSSIInterval)
+	defer ticker.Stop()
+	var lastRx uint64
+	for {
+		select {
+		case <-cCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		// it's the strength of the last packet, so there's nothing new.
+		rx := sess.Stats().RxPackets
+		if rx == lastRx {
+			continue
+		}
+		lastRx = rx
+		rssi, err := sess.RSSI()
+		if err != nil {
+			continue
+		}
+		x.mu.Lock()
+		x.rssi = &rssi
+		x.mu.Unlock()
+	}
 }
 
 func (x *xBeeService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
@@ -153,11 +280,17 @@ func (x *xBeeService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 	tdb := deps.Db
 	if cCtx.String("xbee") == "" {
 		logger.Info("not using xbee")
+		x.setState("disabled", nil)
 		return
 	}
+	x.mu.Lock()
+	x.device = cCtx.String("xbee")
+	x.mu.Unlock()
+	x.setState("connecting", nil)
 	transport, err := xbee.ParseDeviceString(cCtx.String("xbee"))
 	if err != nil {
 		logger.Error("failed to open xbee string", "err", err)
+		x.setState("error", err)
 		return
 	}
 	logger.Info("using xbee device", "transport", transport)
@@ -166,11 +299,16 @@ func (x *xBeeService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 		logger.Error("failed to subscribe to broker", "err", err)
 	}
 
-	x.session, err = xbee.NewSession(transport, logger.With("device", transport.Type()))
+	sess, err := xbee.NewSession(transport, logger.With("device", transport.Type()))
 	if err != nil {
 		logger.Error("failed to start xbee session", "err", err)
+		x.setState("error", err)
 		return
 	}
+	x.mu.Lock()
+	x.session = sess
+	x.mu.Unlock()
+	x.setState("connected", nil)
 	logger.Info("connected to local xbee", "addr", x.session.LocalAddr())
 
 	// these are the ways we send/recieve data. we could swap for binary format
@@ -178,6 +316,8 @@ func (x *xBeeService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 	xbeeTxer := json.NewEncoder(x.session)
 	xbeeRxer := json.NewDecoder(x.session)
 
+	go x.pollRSSI(cCtx, sess)
+
 	go func() {
 		for {
 			var p skylab.BusEvent
@@ -193,6 +333,7 @@ func (x *xBeeService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 		select {
 		case <-cCtx.Done():
 			x.session.Close()
+			x.setState("closed", nil)
 			return
 		case msg := <-rxCh:
 			logger.Info("got msg", "msg", msg)
@@ -208,12 +349,17 @@ func (x *xBeeService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 type httpService struct {
 }
 
+const httpAddr = ":8080"
+
 func (h *httpService) String() string {
 	return "HttpService"
 }
 
-func (h *httpService) Status() {
-
+func (h *httpService) Status() any {
+	// the http stats are in the rest of the response.
+	return struct {
+		Addr string `json:"addr"`
+	}{httpAddr}
 }
 
 func (h *httpService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
@@ -222,13 +368,13 @@ func (h *httpService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 	broker := deps.Broker
 	db := deps.Db
 
-	r := gotelem.TelemRouter(logger, broker, db)
+	r := gotelem.TelemRouter(logger, broker, db, deps.Stats)
 
 	//
 
 	/// TODO: use custom port if specified
 	server := &http.Server{
-		Addr:    ":8080",
+		Addr:    httpAddr,
 		Handler: r,
 	}
 	go func() {
@@ -243,6 +389,7 @@ func (h *httpService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 }
 
 
+// DemoService runs the vehicle simulator, so the UI can be used without the car.
 type DemoService struct {
 }
 
@@ -252,48 +399,19 @@ func (d *DemoService) String() string {
 
 func (d *DemoService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 	if !cCtx.Bool("demo") {
-		return 
-	}
-
-	broker := deps.Broker
-	bmsPkt := &skylab.BmsMeasurement{
-		Current: 1.23,
-		BatteryVoltage: 11111,
-		AuxVoltage: 22222,
-	}
-	wslPkt := &skylab.WslVelocity{
-		MotorVelocity: 0,
-		VehicleVelocity: 100.0,
+		return
 	}
-	var next skylab.Packet = bmsPkt
-	for {
-		select {
-		case <-cCtx.Done():
-			return
-		case <-time.After(100 * time.Millisecond):
-			// send the next packet.
-			if next == bmsPkt {
-				bmsPkt.Current = float32(math.Sin(float64(time.Now().UnixMilli()) / 2000.0))
-				ev := skylab.BusEvent{
-					Timestamp: time.Now(),
-					Name: next.String(),
-					Data: next,
-				}
-				broker.Publish("livestream", ev)
-				next = wslPkt
-			} else {
-				// send the wsl
-				ev := skylab.BusEvent{
-					Timestamp: time.Now(),
-					Name: next.String(),
-					Data: next,
-				}
-				broker.Publish("livestream", ev)
-				next = bmsPkt
-			}
-
-
 
+	profile := gotelem.DefaultSimProfile()
+	if cCtx.IsSet("demo-profile") {
+		profile, err = gotelem.LoadSimProfile(cCtx.Path("demo-profile"))
+		if err != nil {
+			return err
 		}
 	}
+	sim, err := gotelem.NewSimulator(profile)
+	if err != nil {
+		return err
+	}
+	return sim.Run(cCtx.Context, deps.Broker)
 }
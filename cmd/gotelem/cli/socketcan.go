@@ -3,10 +3,15 @@
 package cli
 
 import (
+	"context"
 	"errors"
 	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/kschamplin/gotelem"
 	"github.com/kschamplin/gotelem/internal/can"
 	"github.com/kschamplin/gotelem/skylab"
 	"github.com/kschamplin/gotelem/socketcan"
@@ -37,15 +42,67 @@ func init() {
 	subCmds = append(subCmds, socketCANCmd)
 }
 
+const (
+	// canBatchSize is how many frames or events are written at once.
+	canBatchSize = 256
+	// canFlushInterval is the longest a received frame waits to be written.
+	canFlushInterval = time.Second
+)
+
 type socketCANService struct {
+	mu   sync.Mutex
 	name string
+	err  error
 	sock *socketcan.CanSocket
+
+	rxFrames, txFrames, rxErrors, txErrors atomic.Uint64
 }
 
-func (s *socketCANService) Status() {
+type socketCANStatus struct {
+	Interface string `json:"interface,omitempty"`
+	State     string `json:"state"` // disabled, up, down or error.
+	Running   bool   `json:"running"`
+	Error     string `json:"error,omitempty"`
+	RxFrames  uint64 `json:"rx_frames"`
+	TxFrames  uint64 `json:"tx_frames"`
+	RxErrors  uint64 `json:"rx_errors"`
+	TxErrors  uint64 `json:"tx_errors"`
+}
+
+func (s *socketCANService) Status() any {
+	s.mu.Lock()
+	st := socketCANStatus{Interface: s.name, State: "disabled"}
+	if s.err != nil {
+		st.State = "error"
+		st.Error = s.err.Error()
+	}
+	s.mu.Unlock()
+	st.RxFrames = s.rxFrames.Load()
+	st.TxFrames = s.txFrames.Load()
+	st.RxErrors = s.rxErrors.Load()
+	st.TxErrors = s.txErrors.Load()
+	if st.Interface == "" || st.Error != "" {
+		return st
+	}
+	// the link state comes from the interface, so it's right even if the
+	// bus went down after we opened it.
+	iface, err := net.InterfaceByName(st.Interface)
+	if err != nil {
+		st.State = "error"
+		st.Error = err.Error()
+		return st
+	}
+	st.State = "down"
+	if iface.Flags&net.FlagUp != 0 {
+		st.State = "up"
+	}
+	st.Running = iface.Flags&net.FlagRunning != 0
+	return st
 }
 
 func (s *socketCANService) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if s.name == "" {
 		return "socketCAN"
 	}
@@ -67,10 +124,16 @@ func (s *socketCANService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 	s.sock, err = socketcan.NewCanSocket(cCtx.String("can"))
 	if err != nil {
 		logger.Error("error opening socket", "err", err)
+		s.mu.Lock()
+		s.name = cCtx.String("can")
+		s.err = err
+		s.mu.Unlock()
 		return
 	}
 	defer s.sock.Close()
+	s.mu.Lock()
 	s.name = s.sock.Name()
+	s.mu.Unlock()
 
 	// connect to the broker
 	rxCh, err := broker.Subscribe("socketCAN")
@@ -89,12 +152,39 @@ func (s *socketCANService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 				return
 			}
 			if err != nil {
+				if cCtx.Err() != nil {
+					return
+				}
 				logger.Warn("error receiving CAN packet", "err", err)
+				s.rxErrors.Add(1)
+				continue
 			}
+			s.rxFrames.Add(1)
 			rxCan <- *pkt
 		}
 	}()
 
+	// frames and events are written in batches, since a transaction for
+	// each one can't keep up with a busy bus.
+	rawBatch := make([]gotelem.RawFrame, 0, canBatchSize)
+	eventBatch := make([]skylab.BusEvent, 0, canBatchSize)
+	flush := func(ctx context.Context) {
+		if len(rawBatch) > 0 {
+			if _, err := tdb.AddRawFramesCtx(ctx, rawBatch...); err != nil {
+				logger.Warn("error storing raw frames", "count", len(rawBatch), "err", err)
+			}
+			rawBatch = rawBatch[:0]
+		}
+		if len(eventBatch) > 0 {
+			if _, err := tdb.AddEventsCtx(ctx, eventBatch...); err != nil {
+				logger.Warn("error storing events", "count", len(eventBatch), "err", err)
+			}
+			eventBatch = eventBatch[:0]
+		}
+	}
+	ticker := time.NewTicker(canFlushInterval)
+	defer ticker.Stop()
+
 	var frame can.Frame
 	for {
 		select {
@@ -106,24 +196,46 @@ func (s *socketCANService) Start(cCtx *cli.Context, deps svcDeps) (err error) {
 				continue
 			}
 
-			s.sock.Send(&frame)
+			if err := s.sock.Send(&frame); err != nil {
+				logger.Warn("error sending can frame", "name", msg.Name, "err", err)
+				s.txErrors.Add(1)
+				continue
+			}
+			s.txFrames.Add(1)
 
 		case msg := <-rxCan:
+			now := time.Now()
+			// keep the raw frame even if we can't decode it.
+			rawBatch = append(rawBatch, gotelem.NewRawFrame(now, msg, s.name))
+			if len(rawBatch) >= canBatchSize {
+				flush(cCtx.Context)
+			}
 			p, err := skylab.FromCanFrame(msg)
-			if err != nil {
+			var idErr *skylab.UnknownIdError
+			if errors.As(err, &idErr) {
+				logger.Debug("unknown can id", "id", msg.Id)
+				continue
+			} else if err != nil {
 				logger.Warn("error parsing can packet", "id", msg.Id, "err", err)
 				continue
 			}
 			event := skylab.BusEvent{
-				Timestamp: time.Now(),
+				Timestamp: now,
 				Name:      p.String(),
 				Data:      p,
 			}
 			broker.Publish("socketCAN", event)
-			tdb.AddEventsCtx(cCtx.Context, event)
+			eventBatch = append(eventBatch, event)
+			if len(eventBatch) >= canBatchSize {
+				flush(cCtx.Context)
+			}
+		case <-ticker.C:
+			flush(cCtx.Context)
 		case <-cCtx.Done():
-			// close the socket.
+			// close the socket, and write what's left since the context
+			// can't be used anymore.
 			s.sock.Close()
+			flush(context.Background())
 			return
 		}
 	}
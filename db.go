@@ -4,41 +4,120 @@ package gotelem
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/kschamplin/gotelem/skylab"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 
 type TelemDb struct {
 	db *sqlx.DB
+
+	// skip events that are already in the database.
+	dedupe bool
+
+	// don't migrate to the latest version on open.
+	noMigrate bool
+
+	// fail to open if applied migrations don't match the embedded ones.
+	strictMigrations bool
+
+	// timings of inserts, for the stats.
+	eventWrites writeStats
+	frameWrites writeStats
+	rowCounts   rowCounts
+
+	logger *slog.Logger
+}
+
+// DbOption changes how the database is used, see OpenTelemDb.
+type DbOption func(*TelemDb)
+
+// WithDedupe makes inserts skip events with the same timestamp, name and
+// data as one that's already stored. This is useful when several sources
+// (i.e xbee and socketCAN) see the same packets.
+func WithDedupe(enabled bool) DbOption {
+	return func(tdb *TelemDb) {
+		tdb.dedupe = enabled
+	}
+}
+
+// WithAutoMigrate sets whether the database is migrated to the latest version
+// when it's opened. It's on by default, and turned off by `db migrate` so it
+// can pick the version itself.
+func WithAutoMigrate(enabled bool) DbOption {
+	return func(tdb *TelemDb) {
+		tdb.noMigrate = !enabled
+	}
 }
 
+// WithStrictMigrations makes opening the database fail if a migration was
+// changed since it was applied. Otherwise it's only logged as a warning.
+func WithStrictMigrations(enabled bool) DbOption {
+	return func(tdb *TelemDb) {
+		tdb.strictMigrations = enabled
+	}
+}
+
+// WithLogger sets the logger used for database messages, the default logger
+// is used otherwise.
+func WithLogger(logger *slog.Logger) DbOption {
+	return func(tdb *TelemDb) {
+		tdb.logger = logger
+	}
+}
 
 // this function is internal use. It actually opens the database, but uses
 // a raw path string instead of formatting one like the exported functions.
-func OpenRawDb(rawpath string) (tdb *TelemDb, err error) {
-	tdb = &TelemDb{}
+func OpenRawDb(rawpath string, opts ...DbOption) (tdb *TelemDb, err error) {
+	tdb = &TelemDb{logger: slog.Default()}
+	for _, opt := range opts {
+		opt(tdb)
+	}
 	tdb.db, err = sqlx.Connect("sqlite3", rawpath)
 	if err != nil {
 		return
 	}
 
+	if tdb.noMigrate {
+		return
+	}
+
 	// perform any database migrations
 	version, err := tdb.GetVersion()
 	if err != nil {
 		return
 	}
-	// TODO: use logging instead of printf
-	fmt.Printf("starting version %d\n", version)
 
-	version, err = RunMigrations(tdb)
-	fmt.Printf("ending version %d\n", version)
+	// check for changed migrations before touching anything.
+	drift, err := CheckMigrations(tdb)
+	if err != nil {
+		return
+	}
+	for _, d := range drift {
+		tdb.logger.Warn("migration changed since it was applied", "version", d.Version, "name", d.Name,
+			"applied", d.Applied, "embedded", d.Embedded)
+	}
+	if len(drift) > 0 && tdb.strictMigrations {
+		return tdb, &MigrationDriftError{Drift: drift}
+	}
+
+	newVersion, err := RunMigrations(tdb)
+	if newVersion != version {
+		tdb.logger.Info("migrated database", "from", version, "to", newVersion)
+	}
 
 	return tdb, err
 }
@@ -48,9 +127,9 @@ func OpenRawDb(rawpath string) (tdb *TelemDb, err error) {
 const ProductionDbURI = "file:%s?_journal_mode=wal&mode=rwc&_txlock=immediate&_timeout=10000"
 
 // OpenTelemDb opens a new telemetry database at the given path.
-func OpenTelemDb(path string) (*TelemDb, error) {
+func OpenTelemDb(path string, opts ...DbOption) (*TelemDb, error) {
 	dbStr := fmt.Sprintf(ProductionDbURI, path)
-	return OpenRawDb(dbStr)
+	return OpenRawDb(dbStr, opts...)
 }
 
 func (tdb *TelemDb) GetVersion() (int, error) {
@@ -66,23 +145,60 @@ func (tdb *TelemDb) SetVersion(version int) error {
 }
 
 // sql expression to insert a bus event into the packets database.1
-const sqlInsertEvent = `INSERT INTO "bus_events" (ts, name, data) VALUES `
+const sqlInsertEvent = `INSERT INTO "bus_events" (ts, name, data, import_id, content_hash) VALUES `
+
+// in dedupe mode, the unique index on the hash makes duplicates get skipped.
+const sqlInsertEventDedupe = `INSERT OR IGNORE INTO "bus_events" (ts, name, data, import_id, content_hash) VALUES `
+
+// contentHash is the hash of the name and JSON data of an event. Together
+// with the timestamp it identifies duplicate events.
+func contentHash(name string, data []byte) int64 {
+	h := sha256.New()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(data)
+	return int64(binary.BigEndian.Uint64(h.Sum(nil)))
+}
 
 // AddEvent adds the bus event to the database.
 func (tdb *TelemDb) AddEventsCtx(ctx context.Context, events ...skylab.BusEvent) (n int64, err error) {
+	return tdb.addEvents(ctx, nil, events)
+}
+
+// AddImportEventsCtx adds bus events that came from an import, so they can be
+// removed later with DeleteImport.
+func (tdb *TelemDb) AddImportEventsCtx(ctx context.Context, importId int64, events ...skylab.BusEvent) (n int64, err error) {
+	return tdb.addEvents(ctx, importId, events)
+}
+
+func (tdb *TelemDb) addEvents(ctx context.Context, importId any, events []skylab.BusEvent) (n int64, err error) {
 	// edge case - zero events.
 	if len(events) == 0 {
 		return 0, nil
 	}
-	n = 0
+	start := time.Now()
+	defer func() { tdb.eventWrites.record(start, n, err) }()
 	tx, err := tdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
 	defer tx.Rollback()
+
+	n, err = tdb.insertEvents(ctx, tx, importId, events)
 	if err != nil {
 		return
 	}
+	err = tx.Commit()
+	return
+}
 
+// insertEvents inserts the events as part of a transaction.
+func (tdb *TelemDb) insertEvents(ctx context.Context, tx *sql.Tx, importId any, events []skylab.BusEvent) (n int64, err error) {
 	sqlStmt := sqlInsertEvent
-	const rowSql = "(?, ?, json(?))"
+	if tdb.dedupe {
+		sqlStmt = sqlInsertEventDedupe
+	}
+	const rowSql = "(?, ?, json(?), ?, ?)"
 	inserts := make([]string, len(events))
 	vals := []interface{}{}
 	idx := 0 // we have to manually increment, because sometimes we don't insert.
@@ -96,25 +212,30 @@ func (tdb *TelemDb) AddEventsCtx(ctx context.Context, events ...skylab.BusEvent)
 			continue // we silently skip.
 		}
 
-		vals = append(vals, b.Timestamp.UnixMilli(), b.Data.String(), j)
+		var hash any
+		if tdb.dedupe {
+			hash = contentHash(b.Data.String(), j)
+		}
+		vals = append(vals, b.Timestamp.UnixMilli(), b.Data.String(), j, importId, hash)
 		idx++
 	}
+	err = nil
+	if idx == 0 {
+		return 0, nil
+	}
 
 	// construct the full statement now
 	sqlStmt = sqlStmt + strings.Join(inserts[:idx], ",")
 	stmt, err := tx.PrepareContext(ctx, sqlStmt)
-	// defer stmt.Close()
 	if err != nil {
 		return
 	}
+	defer stmt.Close()
 	res, err := stmt.ExecContext(ctx, vals...)
 	if err != nil {
 		return
 	}
-	n, err = res.RowsAffected()
-
-	tx.Commit()
-	return
+	return res.RowsAffected()
 }
 
 func (tdb *TelemDb) AddEvents(events ...skylab.BusEvent) (int64, error) {
@@ -122,6 +243,71 @@ func (tdb *TelemDb) AddEvents(events ...skylab.BusEvent) (int64, error) {
 	return tdb.AddEventsCtx(context.Background(), events...)
 }
 
+// Dedupe removes duplicate events, keeping the first one, and fills in the
+// content hash of events that were stored without one, so later inserts in
+// dedupe mode skip them. It returns the number of events removed.
+func (tdb *TelemDb) Dedupe(ctx context.Context) (int64, error) {
+	tx, err := tdb.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM bus_events WHERE rowid NOT IN
+		(SELECT min(rowid) FROM bus_events GROUP BY ts, name, data)`)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `UPDATE OR IGNORE bus_events SET content_hash = ? WHERE rowid = ?`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	// hash the rows in batches, so we don't have to hold them all in memory.
+	const batchSize = 10000
+	type rowHash struct {
+		rowid int64
+		hash  int64
+	}
+	var lastRow int64 = -1
+	for {
+		rows, err := tx.QueryxContext(ctx, `SELECT rowid, name, data FROM bus_events
+			WHERE content_hash IS NULL AND rowid > ? ORDER BY rowid LIMIT ?`, lastRow, batchSize)
+		if err != nil {
+			return 0, err
+		}
+		hashes := make([]rowHash, 0, batchSize)
+		for rows.Next() {
+			var name string
+			var data []byte
+			if err := rows.Scan(&lastRow, &name, &data); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			hashes = append(hashes, rowHash{lastRow, contentHash(name, data)})
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		for _, rh := range hashes {
+			if _, err := stmt.ExecContext(ctx, rh.hash, rh.rowid); err != nil {
+				return 0, err
+			}
+		}
+		if len(hashes) < batchSize {
+			break
+		}
+	}
+	return removed, tx.Commit()
+}
+
 // LimitOffsetModifier is a modifier to support pagniation.
 type LimitOffsetModifier struct {
 	Limit  int
@@ -134,49 +320,111 @@ func (l *LimitOffsetModifier) ModifyStatement(sb *strings.Builder) error {
 	return nil
 }
 
+// sqlDriveRange limits ts to the time range of a drive. It takes the drive
+// ID twice. A drive that is still going has no end yet.
+const sqlDriveRange = `ts BETWEEN (SELECT start_time FROM drive_records WHERE id = ?)
+	AND (SELECT coalesce(end_time, 9223372036854775807) FROM drive_records WHERE id = ?)`
+
 // BusEventFilter is a filter for bus events.
 type BusEventFilter struct {
 	Names     []string  // The name(s) of packets to filter for
 	StartTime time.Time // Starting time range. All packets >= StartTime
 	EndTime   time.Time // Ending time range. All packets <= EndTime
 	Indexes   []int     // The specific index of the packets to index.
+	// DriveID limits the time range to a drive. It's looked up in the
+	// database, so Match ignores it.
+	DriveID int
 }
 
-// now we can optionally add a limit.
+// Match returns true if the bus event satisfies the filter. This lets the
+// same filter be used for live events as well as database queries.
+func (f BusEventFilter) Match(ev skylab.BusEvent) bool {
+	if len(f.Names) > 0 && !slices.Contains(f.Names, ev.Name) {
+		return false
+	}
+	if !f.StartTime.IsZero() && ev.Timestamp.Before(f.StartTime) {
+		return false
+	}
+	if !f.EndTime.IsZero() && ev.Timestamp.After(f.EndTime) {
+		return false
+	}
+	if len(f.Indexes) > 0 {
+		// packets without an index never match, same as the SQL query.
+		idx, ok := packetIndex(ev.Data)
+		if !ok || !slices.Contains(f.Indexes, idx) {
+			return false
+		}
+	}
+	return true
+}
 
-func (tdb *TelemDb) GetPackets(ctx context.Context, filter BusEventFilter, lim *LimitOffsetModifier) ([]skylab.BusEvent, error) {
-	// construct a simple
+// packetIndex gets the index of a repeated packet (i.e bms_module).
+// skylab generates an Idx field for these, so we look it up with reflection.
+func packetIndex(p skylab.Packet) (int, bool) {
+	if p == nil {
+		return 0, false
+	}
+	v := reflect.ValueOf(p)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return 0, false
+	}
+	f := v.FieldByName("Idx")
+	if !f.IsValid() || !f.CanUint() {
+		return 0, false
+	}
+	return int(f.Uint()), true
+}
+
+// sqlWhere builds the WHERE clause for the filter. It returns the clause
+// fragments, which should be joined with AND, and the query arguments.
+func (f *BusEventFilter) sqlWhere() ([]string, []any) {
 	var whereFrags = make([]string, 0)
+	var args = make([]any, 0)
 
 	// if we're filtering by names, add a where clause for it.
-	if len(filter.Names) > 0 {
-		// we have to quote our individual names
-		names := strings.Join(filter.Names, `", "`)
-		qString := fmt.Sprintf(`name IN ("%s")`, names)
-		whereFrags = append(whereFrags, qString)
+	if len(f.Names) > 0 {
+		marks := strings.Repeat("?, ", len(f.Names)-1) + "?"
+		whereFrags = append(whereFrags, fmt.Sprintf("name IN (%s)", marks))
+		for _, name := range f.Names {
+			args = append(args, name)
+		}
 	}
 	// TODO: identify if we need a special case for both time ranges
 	// using BETWEEN since apparenlty that can be better?
 
 	// next, check if we have a start/end time, add constraints
-	if !filter.EndTime.IsZero() {
-		qString := fmt.Sprintf("ts <= %d", filter.EndTime.UnixMilli())
+	if !f.EndTime.IsZero() {
+		qString := fmt.Sprintf("ts <= %d", f.EndTime.UnixMilli())
 		whereFrags = append(whereFrags, qString)
 	}
-	if !filter.StartTime.IsZero() {
+	if !f.StartTime.IsZero() {
 		// we have an end range
-		qString := fmt.Sprintf("ts >= %d", filter.StartTime.UnixMilli())
+		qString := fmt.Sprintf("ts >= %d", f.StartTime.UnixMilli())
 		whereFrags = append(whereFrags, qString)
 	}
-	if len(filter.Indexes) > 0 {
+	if len(f.Indexes) > 0 {
 		s := make([]string, 0)
-		for _, idx := range filter.Indexes {
+		for _, idx := range f.Indexes {
 			s = append(s, fmt.Sprint(idx))
 		}
 		idxs := strings.Join(s, ", ")
 		qString := fmt.Sprintf(`idx in (%s)`, idxs)
 		whereFrags = append(whereFrags, qString)
 	}
+	if f.DriveID != 0 {
+		whereFrags = append(whereFrags, sqlDriveRange)
+		args = append(args, f.DriveID, f.DriveID)
+	}
+	return whereFrags, args
+}
+
+// now we can optionally add a limit.
+
+func (tdb *TelemDb) GetPackets(ctx context.Context, filter BusEventFilter, lim *LimitOffsetModifier) ([]skylab.BusEvent, error) {
+	whereFrags, args := filter.sqlWhere()
 
 	sb := strings.Builder{}
 	sb.WriteString(`SELECT ts, name, data from "bus_events"`)
@@ -194,7 +442,7 @@ func (tdb *TelemDb) GetPackets(ctx context.Context, filter BusEventFilter, lim *
 	if lim != nil {
 		lim.ModifyStatement(&sb)
 	}
-	rows, err := tdb.db.QueryxContext(ctx, sb.String())
+	rows, err := tdb.db.QueryxContext(ctx, sb.String(), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -225,6 +473,22 @@ func (tdb *TelemDb) GetPackets(ctx context.Context, filter BusEventFilter, lim *
 	return events, err
 }
 
+// GetTimeRange returns the timestamps of the first and last events matching
+// the filter. Both are zero if there are no matching events.
+func (tdb *TelemDb) GetTimeRange(ctx context.Context, filter BusEventFilter) (start, end time.Time, err error) {
+	whereFrags, args := filter.sqlWhere()
+	q := `SELECT min(ts), max(ts) FROM "bus_events"`
+	if len(whereFrags) > 0 {
+		q += " WHERE " + strings.Join(whereFrags, " AND ")
+	}
+	var minTs, maxTs *int64
+	err = tdb.db.QueryRowxContext(ctx, q, args...).Scan(&minTs, &maxTs)
+	if err != nil || minTs == nil || maxTs == nil {
+		return
+	}
+	return time.UnixMilli(*minTs), time.UnixMilli(*maxTs), nil
+}
+
 // We now need a different use-case: we would like to extract a value from
 // a specific packet.
 
@@ -235,39 +499,30 @@ type Datum struct {
 	Value     any       `db:"val" json:"val"`
 }
 
+// valuesQuery builds the query for a single field of a packet. The filter
+// must have exactly one name.
+func valuesQuery(filter BusEventFilter, field string) ([]string, []any, error) {
+	if len(filter.Names) != 1 {
+		return nil, nil, errors.New("invalid number of names")
+	}
+	whereFrags, args := filter.sqlWhere()
+	// the field is the first parameter, it's used in the select.
+	return whereFrags, append([]any{field}, args...), nil
+}
+
 // GetValues queries the database for values in a given time range.
 // A value is a specific data point. For example, bms_measurement.current
 // would be a value.
 func (tdb *TelemDb) GetValues(ctx context.Context, filter BusEventFilter,
 	field string, lim *LimitOffsetModifier) ([]Datum, error) {
+	whereFrags, args, err := valuesQuery(filter, field)
+	if err != nil {
+		return nil, err
+	}
 	// this fragment uses json_extract from sqlite to get a single
 	// nested value.
 	sb := strings.Builder{}
 	sb.WriteString(`SELECT ts as timestamp, json_extract(data, '$.' || ?) as val FROM bus_events WHERE `)
-	if len(filter.Names) != 1 {
-		return nil, errors.New("invalid number of names")
-	}
-	whereFrags := []string{"name is ?"}
-
-	if !filter.StartTime.IsZero() {
-		qString := fmt.Sprintf("ts >= %d", filter.StartTime.UnixMilli())
-		whereFrags = append(whereFrags, qString)
-	}
-
-	if !filter.EndTime.IsZero() {
-		qString := fmt.Sprintf("ts <= %d", filter.EndTime.UnixMilli())
-		whereFrags = append(whereFrags, qString)
-	}
-	if len(filter.Indexes) > 0 {
-		s := make([]string, 0)
-		for _, idx := range filter.Indexes {
-			s = append(s, fmt.Sprint(idx))
-		}
-		idxs := strings.Join(s, ", ")
-		qString := fmt.Sprintf(`idx in (%s)`, idxs)
-		whereFrags = append(whereFrags, qString)
-	}
-	// join qstrings with AND
 	sb.WriteString(strings.Join(whereFrags, " AND "))
 
 	sb.WriteString(" ORDER BY ts DESC")
@@ -276,7 +531,7 @@ func (tdb *TelemDb) GetValues(ctx context.Context, filter BusEventFilter,
 		lim.ModifyStatement(&sb)
 	}
 
-	rows, err := tdb.db.QueryxContext(ctx, sb.String(), field, filter.Names[0])
+	rows, err := tdb.db.QueryxContext(ctx, sb.String(), args...)
 	if err != nil {
 		return nil, err
 	}
@@ -289,20 +544,261 @@ func (tdb *TelemDb) GetValues(ctx context.Context, filter BusEventFilter,
 		d.Timestamp = time.UnixMilli(ts)
 
 		if err != nil {
-			fmt.Print(err)
 			return data, err
 		}
 		data = append(data, d)
 	}
-	fmt.Print(rows.Err())
 
-	return data, nil
+	return data, rows.Err()
+}
+
+// Cursor is the position of a row in bus_events, used for keyset pagination.
+// Clients get it as an opaque token from String, and give it back to get the
+// next page.
+type Cursor struct {
+	Timestamp int64 // unix milliseconds
+	RowID     int64
+}
+
+func (c Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d.%d", c.Timestamp, c.RowID)))
+}
+
+// ParseCursor decodes a cursor token created by Cursor.String.
+func ParseCursor(token string) (Cursor, error) {
+	var c Cursor
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	if _, err := fmt.Sscanf(string(b), "%d.%d", &c.Timestamp, &c.RowID); err != nil {
+		return c, errors.New("invalid cursor")
+	}
+	return c, nil
+}
+
+// KeysetModifier is pagination based on the last row of the previous page,
+// instead of an offset. It stays fast no matter how deep you page.
+type KeysetModifier struct {
+	After     *Cursor // continue after this row. nil starts from the beginning.
+	Limit     int     // rows per page, zero means no limit.
+	Ascending bool    // oldest first. The default is newest first.
+}
+
+// sqlWhere returns the clause that skips rows up to the cursor, if any.
+func (k *KeysetModifier) sqlWhere() ([]string, []any) {
+	if k.After == nil {
+		return nil, nil
+	}
+	op := "<"
+	if k.Ascending {
+		op = ">"
+	}
+	return []string{fmt.Sprintf("(ts, rowid) %s (?, ?)", op)}, []any{k.After.Timestamp, k.After.RowID}
+}
+
+// ModifyStatement adds the ordering and limit.
+func (k *KeysetModifier) ModifyStatement(sb *strings.Builder) error {
+	if k.Ascending {
+		sb.WriteString(" ORDER BY ts ASC, rowid ASC")
+	} else {
+		sb.WriteString(" ORDER BY ts DESC, rowid DESC")
+	}
+	if k.Limit > 0 {
+		fmt.Fprintf(sb, " LIMIT %d", k.Limit)
+	}
+	return nil
+}
+
+// probe returns the modifier with one extra row, so we know if there is
+// a next page.
+func (k KeysetModifier) probe() KeysetModifier {
+	if k.Limit > 0 {
+		k.Limit++
+	}
+	return k
+}
+
+// pageQuery builds a keyset paginated query on bus_events.
+func pageQuery(sel string, whereFrags []string, args []any, page KeysetModifier) (string, []any) {
+	pageFrags, pageArgs := page.sqlWhere()
+	whereFrags = append(whereFrags, pageFrags...)
+	args = append(args, pageArgs...)
+
+	sb := strings.Builder{}
+	sb.WriteString(sel)
+	if len(whereFrags) > 0 {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(strings.Join(whereFrags, " AND "))
+	}
+	page.ModifyStatement(&sb)
+	return sb.String(), args
+}
+
+// ErrStopStream can be returned from a stream callback to stop early
+// without an error.
+var ErrStopStream = errors.New("stop stream")
+
+// StreamPackets calls fn with each packet matching the filter as it is read,
+// along with the cursor of its row. Nothing is kept in memory, so it works
+// for queries of any size. Rows that can't be decoded are logged and
+// skipped. It stops when fn returns an error, which is
+// returned (unless it's ErrStopStream), or when the context is cancelled.
+func (tdb *TelemDb) StreamPackets(ctx context.Context, filter BusEventFilter, page KeysetModifier,
+	fn func(skylab.BusEvent, Cursor) error) error {
+	whereFrags, args := filter.sqlWhere()
+	q, args := pageQuery(`SELECT rowid, ts, name, data FROM "bus_events"`, whereFrags, args, page)
+	rows, err := tdb.db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Cursor
+		var ev skylab.RawJsonEvent
+		err := rows.Scan(&c.RowID, &c.Timestamp, &ev.Name, (*[]byte)(&ev.Data))
+		if err != nil {
+			return err
+		}
+		busEv := skylab.BusEvent{
+			Timestamp: time.UnixMilli(c.Timestamp),
+			Name:      ev.Name,
+		}
+		busEv.Data, err = skylab.FromJson(ev.Name, ev.Data)
+		if err != nil {
+			// one bad row (like a packet we don't have a definition for
+			// anymore) shouldn't end the whole stream.
+			tdb.logger.Warn("skipping packet that couldn't be decoded", "rowid", c.RowID, "name", ev.Name, "err", err)
+			continue
+		}
+		if err := fn(busEv, c); err != nil {
+			if errors.Is(err, ErrStopStream) {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// StreamValues is StreamPackets for a single field, see GetValues.
+func (tdb *TelemDb) StreamValues(ctx context.Context, filter BusEventFilter, field string,
+	page KeysetModifier, fn func(Datum, Cursor) error) error {
+	whereFrags, args, err := valuesQuery(filter, field)
+	if err != nil {
+		return err
+	}
+	q, args := pageQuery(`SELECT rowid, ts, json_extract(data, '$.' || ?) FROM bus_events`, whereFrags, args, page)
+	rows, err := tdb.db.QueryxContext(ctx, q, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Cursor
+		var d Datum
+		if err := rows.Scan(&c.RowID, &c.Timestamp, &d.Value); err != nil {
+			return err
+		}
+		d.Timestamp = time.UnixMilli(c.Timestamp)
+		if err := fn(d, c); err != nil {
+			if errors.Is(err, ErrStopStream) {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// collectPage gathers a page from a stream. It reads one row more than the
+// limit to find out if there's a next page.
+func collectPage[T any](page KeysetModifier, stream func(KeysetModifier, func(T, Cursor) error) error) ([]T, *Cursor, error) {
+	res := make([]T, 0, 10)
+	var last, next *Cursor
+	err := stream(page.probe(), func(v T, c Cursor) error {
+		if page.Limit > 0 && len(res) == page.Limit {
+			next = last
+			return ErrStopStream
+		}
+		res = append(res, v)
+		last = &c
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return res, next, nil
+}
+
+// GetPacketsPage gets a page of packets. The returned cursor is for the next
+// page, and is nil if this is the last page.
+func (tdb *TelemDb) GetPacketsPage(ctx context.Context, filter BusEventFilter, page KeysetModifier) ([]skylab.BusEvent, *Cursor, error) {
+	return collectPage(page, func(p KeysetModifier, fn func(skylab.BusEvent, Cursor) error) error {
+		return tdb.StreamPackets(ctx, filter, p, fn)
+	})
+}
+
+// GetValuesPage is GetValues with keyset pagination, see GetPacketsPage.
+func (tdb *TelemDb) GetValuesPage(ctx context.Context, filter BusEventFilter,
+	field string, page KeysetModifier) ([]Datum, *Cursor, error) {
+	return collectPage(page, func(p KeysetModifier, fn func(Datum, Cursor) error) error {
+		return tdb.StreamValues(ctx, filter, field, p, fn)
+	})
 }
 
 // AddDocument inserts a new document to the store if it is unique and valid.
+// A document with the same key already existing is a DocumentConflictError.
 func (tdb *TelemDb) AddDocument(ctx context.Context, obj json.RawMessage) error {
-	const insertStmt = `INSERT INTO openmct_objects (data) VALUES (json(?))`
-	_, err := tdb.db.ExecContext(ctx, insertStmt, obj)
+	_, err := tdb.AddDocumentRevision(ctx, obj)
+	return err
+}
+
+// AddDocumentRevision is AddDocument, but returns the revision of the new
+// document. It's 1 unless a document with the same key was deleted, then it
+// continues from the old revisions.
+func (tdb *TelemDb) AddDocumentRevision(ctx context.Context, obj json.RawMessage) (int64, error) {
+	tx, err := tdb.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rev, err := addDocument(ctx, tx, obj)
+	if err != nil {
+		return 0, err
+	}
+	return rev, tx.Commit()
+}
+
+func addDocument(ctx context.Context, tx *sqlx.Tx, obj json.RawMessage) (int64, error) {
+	const insertStmt = `INSERT INTO openmct_objects (data, revision) VALUES (json(?),
+		coalesce((SELECT max(revision) FROM openmct_revisions WHERE key IS json_extract(?, '$.identifier.key')), 0) + 1)
+		RETURNING key, revision`
+	var key string
+	var rev int64
+	err := tx.QueryRowxContext(ctx, insertStmt, obj, obj).Scan(&key, &rev)
+	var sqlErr sqlite3.Error
+	if errors.As(err, &sqlErr) && sqlErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+		return 0, &DocumentConflictError{Key: documentKey(obj)}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rev, saveDocumentRevision(ctx, tx, key, rev, obj)
+}
+
+// saveDocumentRevision adds a revision to the history of a document.
+func saveDocumentRevision(ctx context.Context, tx *sqlx.Tx, key string, rev int64, obj json.RawMessage) error {
+	const ins = `INSERT INTO openmct_revisions (key, revision, data, saved_at) VALUES (?, ?, json(?), ?)`
+	_, err := tx.ExecContext(ctx, ins, key, rev, obj, time.Now().UnixMilli())
 	return err
 }
 
@@ -313,42 +809,95 @@ func (e DocumentNotFoundError) Error() string {
 	return fmt.Sprintf("document could not find key: %s", string(e))
 }
 
+// DocumentConflictError is when a document already exists, or was changed
+// since the revision the client had.
+type DocumentConflictError struct {
+	Key      string
+	Revision int64 // the current revision, zero when adding a duplicate.
+}
+
+func (e *DocumentConflictError) Error() string {
+	if e.Revision == 0 {
+		return fmt.Sprintf("document %s already exists", e.Key)
+	}
+	return fmt.Sprintf("document %s has changed, current revision is %d", e.Key, e.Revision)
+}
+
 // UpdateDocument replaces the entire contents of a document matching
 // the given key. Note that the key is derived from the document,
 // and no checks are done to ensure that the new key is the same.
 func (tdb *TelemDb) UpdateDocument(ctx context.Context, key string,
 	obj json.RawMessage) error {
+	_, err := tdb.UpdateDocumentRevision(ctx, key, obj, 0)
+	return err
+}
 
-	const upd = `UPDATE openmct_objects SET data = json(?) WHERE key IS ?`
-	r, err := tdb.db.ExecContext(ctx, upd, obj, key)
+// UpdateDocumentRevision is UpdateDocument, but only updates the document
+// if it's still at the given revision. It returns the new revision. A
+// revision of zero always updates.
+func (tdb *TelemDb) UpdateDocumentRevision(ctx context.Context, key string,
+	obj json.RawMessage, revision int64) (int64, error) {
+	tx, err := tdb.db.BeginTxx(ctx, nil)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	n, err := r.RowsAffected()
+	defer tx.Rollback()
+	rev, err := updateDocument(ctx, tx, key, obj, revision)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	if n != 1 {
-		return DocumentNotFoundError(key)
+	return rev, tx.Commit()
+}
+
+func updateDocument(ctx context.Context, tx *sqlx.Tx, key string,
+	obj json.RawMessage, revision int64) (int64, error) {
+	const upd = `UPDATE openmct_objects SET data = json(?), revision = revision + 1
+		WHERE key IS ? AND (? = 0 OR revision = ?) RETURNING revision`
+	var newRev int64
+	err := tx.GetContext(ctx, &newRev, upd, obj, key, revision, revision)
+	if errors.Is(err, sql.ErrNoRows) {
+		// either it doesn't exist or it was changed.
+		var cur int64
+		err := tx.GetContext(ctx, &cur, `SELECT revision FROM openmct_objects WHERE key IS ?`, key)
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, DocumentNotFoundError(key)
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 0, &DocumentConflictError{Key: key, Revision: cur}
 	}
-	return err
+	if err != nil {
+		return 0, err
+	}
+	// the key could have changed, so use the one from the new document.
+	return newRev, saveDocumentRevision(ctx, tx, documentKey(obj), newRev, obj)
 }
 
 // GetDocument gets the document matching the corresponding key.
 func (tdb *TelemDb) GetDocument(ctx context.Context, key string) (json.RawMessage, error) {
-	const get = `SELECT data FROM openmct_objects WHERE key IS ?`
+	doc, _, err := tdb.GetDocumentRevision(ctx, key)
+	return doc, err
+}
+
+// GetDocumentRevision gets the document and its current revision.
+func (tdb *TelemDb) GetDocumentRevision(ctx context.Context, key string) (json.RawMessage, int64, error) {
+	const get = `SELECT data, revision FROM openmct_objects WHERE key IS ?`
 
 	row := tdb.db.QueryRowxContext(ctx, get, key)
 
 	var res []byte // VERY important, json.RawMessage won't work here
 	// since the scan function does not look at underlying types.
-	row.Scan(&res)
-
-	if len(res) == 0 {
-		return nil, DocumentNotFoundError(key)
+	var rev int64
+	err := row.Scan(&res, &rev)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && len(res) == 0) {
+		return nil, 0, DocumentNotFoundError(key)
+	}
+	if err != nil {
+		return nil, 0, err
 	}
 
-	return res, nil
+	return res, rev, nil
 }
 
 // GetAllDocuments returns all documents in the database.
@@ -362,11 +911,13 @@ func (tdb *TelemDb) GetAllDocuments(ctx context.Context) ([]json.RawMessage, err
 	defer rows.Close()
 	docs := make([]json.RawMessage, 0)
 	for rows.Next() {
-		var j json.RawMessage
-		rows.Scan(&j)
+		var j []byte // same as GetDocument, json.RawMessage doesn't scan.
+		if err := rows.Scan(&j); err != nil {
+			return nil, err
+		}
 		docs = append(docs, j)
 	}
-	return docs, nil
+	return docs, rows.Err()
 }
 
 // DeleteDocument removes a document from the store, or errors
@@ -386,3 +937,364 @@ func (tdb *TelemDb) DeleteDocument(ctx context.Context, key string) error {
 	}
 	return err
 }
+
+// DocumentRevision is a saved revision of a document.
+type DocumentRevision struct {
+	Key      string          `json:"key"`
+	Revision int64           `json:"revision"`
+	SavedAt  *time.Time      `json:"saved_at"` // nil if it was saved before history was kept.
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// GetDocumentRevisions lists the revisions of a document, newest first,
+// without the data. Revisions are kept after a document is deleted.
+func (tdb *TelemDb) GetDocumentRevisions(ctx context.Context, key string) ([]DocumentRevision, error) {
+	const q = `SELECT revision, saved_at FROM openmct_revisions WHERE key IS ? ORDER BY revision DESC`
+	rows, err := tdb.db.QueryContext(ctx, q, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]DocumentRevision, 0)
+	for rows.Next() {
+		r := DocumentRevision{Key: key}
+		var savedAt sql.NullInt64
+		if err := rows.Scan(&r.Revision, &savedAt); err != nil {
+			return nil, err
+		}
+		if savedAt.Valid {
+			t := time.UnixMilli(savedAt.Int64)
+			r.SavedAt = &t
+		}
+		res = append(res, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, DocumentNotFoundError(key)
+	}
+	return res, nil
+}
+
+// GetDocumentAtRevision gets an old revision of a document.
+func (tdb *TelemDb) GetDocumentAtRevision(ctx context.Context, key string, revision int64) (DocumentRevision, error) {
+	return getDocumentAtRevision(ctx, tdb.db, key, revision)
+}
+
+func getDocumentAtRevision(ctx context.Context, q sqlx.QueryerContext, key string, revision int64) (DocumentRevision, error) {
+	const get = `SELECT data, saved_at FROM openmct_revisions WHERE key IS ? AND revision = ?`
+	r := DocumentRevision{Key: key, Revision: revision}
+	var data []byte
+	var savedAt sql.NullInt64
+	err := q.QueryRowxContext(ctx, get, key, revision).Scan(&data, &savedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, DocumentNotFoundError(fmt.Sprintf("%s@%d", key, revision))
+	}
+	if err != nil {
+		return r, err
+	}
+	r.Data = data
+	if savedAt.Valid {
+		t := time.UnixMilli(savedAt.Int64)
+		r.SavedAt = &t
+	}
+	return r, nil
+}
+
+// putDocument adds the document, or updates it if it exists.
+func putDocument(ctx context.Context, tx *sqlx.Tx, key string, obj json.RawMessage) (DocumentChange, error) {
+	change := DocumentChange{Type: "update", Key: key, Data: obj}
+	rev, err := updateDocument(ctx, tx, key, obj, 0)
+	var notFound DocumentNotFoundError
+	if errors.As(err, &notFound) {
+		change.Type = "create"
+		rev, err = addDocument(ctx, tx, obj)
+	}
+	change.Revision = rev
+	return change, err
+}
+
+// RestoreDocument makes an old revision the current one, by saving it as a
+// new revision. Deleted documents are created again.
+func (tdb *TelemDb) RestoreDocument(ctx context.Context, key string, revision int64) (DocumentChange, error) {
+	tx, err := tdb.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return DocumentChange{}, err
+	}
+	defer tx.Rollback()
+	old, err := getDocumentAtRevision(ctx, tx, key, revision)
+	if err != nil {
+		return DocumentChange{}, err
+	}
+	change, err := putDocument(ctx, tx, key, old.Data)
+	if err != nil {
+		return change, err
+	}
+	return change, tx.Commit()
+}
+
+// ImportDocuments adds documents in one transaction, i.e from an export of
+// another server. Documents that already exist are skipped, unless overwrite
+// is set, then they're updated (keeping the old revision). Documents that are
+// identical to the current one are always skipped. It returns the changes
+// that were made.
+func (tdb *TelemDb) ImportDocuments(ctx context.Context, docs []json.RawMessage, overwrite bool) ([]DocumentChange, error) {
+	tx, err := tdb.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	changes := make([]DocumentChange, 0)
+	for _, doc := range docs {
+		key := documentKey(doc)
+		if key == "" {
+			return nil, errors.New("document is missing identifier.key")
+		}
+		var same bool
+		err := tx.GetContext(ctx, &same, `SELECT data = json(?) FROM openmct_objects WHERE key IS ?`, doc, key)
+		if err == nil && (same || !overwrite) {
+			continue
+		} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		change, err := putDocument(ctx, tx, key, doc)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, tx.Commit()
+}
+
+// Drive is a driving session, i.e a test run or a race day. Drives are used
+// to split up the data by run.
+type Drive struct {
+	Id    int        `json:"id"`
+	Start time.Time  `json:"start"`
+	End   *time.Time `json:"end,omitempty"` // nil if the drive is still going.
+	Note  string     `json:"note"`
+}
+
+// DriveNotFoundError is when there is no drive with the ID.
+type DriveNotFoundError int
+
+func (e DriveNotFoundError) Error() string {
+	return fmt.Sprintf("drive %d not found", int(e))
+}
+
+// ErrDriveRunning is returned when starting a drive while another one is
+// still going.
+var ErrDriveRunning = errors.New("a drive is already running")
+
+// ErrDriveStopped is returned when stopping a drive that already ended.
+var ErrDriveStopped = errors.New("drive already stopped")
+
+const sqlSelectDrive = `SELECT id, start_time, end_time, coalesce(note, '') FROM drive_records`
+
+func scanDrive(row interface{ Scan(...any) error }) (Drive, error) {
+	var d Drive
+	var start int64
+	var end *int64
+	if err := row.Scan(&d.Id, &start, &end, &d.Note); err != nil {
+		return d, err
+	}
+	d.Start = time.UnixMilli(start)
+	if end != nil {
+		t := time.UnixMilli(*end)
+		d.End = &t
+	}
+	return d, nil
+}
+
+// StartDrive starts a new drive now. Only one drive can run at a time.
+func (tdb *TelemDb) StartDrive(ctx context.Context, note string) (Drive, error) {
+	// the check and the insert are one statement, so it's a single
+	// transaction and two requests can't both start a drive.
+	res, err := tdb.db.ExecContext(ctx, `INSERT INTO drive_records (start_time, note)
+		SELECT ?, ? WHERE NOT EXISTS (SELECT 1 FROM drive_records WHERE end_time IS NULL)`,
+		time.Now().UnixMilli(), note)
+	if err != nil {
+		return Drive{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Drive{}, err
+	} else if n == 0 {
+		return Drive{}, ErrDriveRunning
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Drive{}, err
+	}
+	return tdb.GetDrive(ctx, int(id))
+}
+
+// StopDrive sets the end of a running drive to now.
+func (tdb *TelemDb) StopDrive(ctx context.Context, id int) (Drive, error) {
+	d, err := tdb.GetDrive(ctx, id)
+	if err != nil {
+		return d, err
+	}
+	if d.End != nil {
+		return d, fmt.Errorf("drive %d: %w", id, ErrDriveStopped)
+	}
+	// the table requires the end to be after the start.
+	end := max(time.Now().UnixMilli(), d.Start.UnixMilli()+1)
+	_, err = tdb.db.ExecContext(ctx, `UPDATE drive_records SET end_time = ? WHERE id = ?`, end, id)
+	if err != nil {
+		return d, err
+	}
+	return tdb.GetDrive(ctx, id)
+}
+
+// AnnotateDrive replaces the note of a drive.
+func (tdb *TelemDb) AnnotateDrive(ctx context.Context, id int, note string) (Drive, error) {
+	res, err := tdb.db.ExecContext(ctx, `UPDATE drive_records SET note = ? WHERE id = ?`, note, id)
+	if err != nil {
+		return Drive{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Drive{}, err
+	} else if n != 1 {
+		return Drive{}, DriveNotFoundError(id)
+	}
+	return tdb.GetDrive(ctx, id)
+}
+
+// GetDrive gets a drive by ID.
+func (tdb *TelemDb) GetDrive(ctx context.Context, id int) (Drive, error) {
+	d, err := scanDrive(tdb.db.QueryRowxContext(ctx, sqlSelectDrive+` WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return d, DriveNotFoundError(id)
+	}
+	return d, err
+}
+
+// GetRunningDrive gets the drive that hasn't been stopped yet. It returns
+// sql.ErrNoRows if there isn't one.
+func (tdb *TelemDb) GetRunningDrive(ctx context.Context) (Drive, error) {
+	return scanDrive(tdb.db.QueryRowxContext(ctx, sqlSelectDrive+` WHERE end_time IS NULL ORDER BY id DESC LIMIT 1`))
+}
+
+// GetDrives returns all the drives, newest first.
+func (tdb *TelemDb) GetDrives(ctx context.Context) ([]Drive, error) {
+	rows, err := tdb.db.QueryxContext(ctx, sqlSelectDrive+` ORDER BY start_time DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	drives := make([]Drive, 0)
+	for rows.Next() {
+		d, err := scanDrive(rows)
+		if err != nil {
+			return nil, err
+		}
+		drives = append(drives, d)
+	}
+	return drives, rows.Err()
+}
+
+// Import is a log file that was imported into the database.
+type Import struct {
+	Id       int64     `json:"id"`
+	Filename string    `json:"filename"`
+	Hash     string    `json:"hash"` // sha256 of the file contents.
+	Date     time.Time `json:"date"` // when it was imported.
+	Count    int64     `json:"count"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+// ImportNotFoundError is when there is no import with the ID.
+type ImportNotFoundError int64
+
+func (e ImportNotFoundError) Error() string {
+	return fmt.Sprintf("import %d not found", int64(e))
+}
+
+const sqlSelectImport = `SELECT id, filename, hash, date, count,
+	coalesce(start_time, 0), coalesce(end_time, 0) FROM import_log`
+
+func scanImport(row interface{ Scan(...any) error }) (Import, error) {
+	var imp Import
+	var date, start, end int64
+	err := row.Scan(&imp.Id, &imp.Filename, &imp.Hash, &date, &imp.Count, &start, &end)
+	imp.Date = time.UnixMilli(date)
+	imp.Start = time.UnixMilli(start)
+	imp.End = time.UnixMilli(end)
+	return imp, err
+}
+
+// BeginImport records the start of an import. The events should be added
+// with AddImportEventsCtx, and FinishImport called at the end.
+func (tdb *TelemDb) BeginImport(ctx context.Context, filename string, hash string) (int64, error) {
+	res, err := tdb.db.ExecContext(ctx, `INSERT INTO import_log (filename, hash, date) VALUES (?, ?, ?)`,
+		filename, hash, time.Now().UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// FinishImport stores the results of an import.
+func (tdb *TelemDb) FinishImport(ctx context.Context, id int64, count int64, start, end time.Time) error {
+	_, err := tdb.db.ExecContext(ctx, `UPDATE import_log SET count = ?, start_time = ?, end_time = ? WHERE id = ?`,
+		count, start.UnixMilli(), end.UnixMilli(), id)
+	return err
+}
+
+// FindImport looks for an earlier import of a file with the same hash.
+// It returns sql.ErrNoRows if there isn't one.
+func (tdb *TelemDb) FindImport(ctx context.Context, hash string) (Import, error) {
+	return scanImport(tdb.db.QueryRowxContext(ctx, sqlSelectImport+` WHERE hash = ? ORDER BY id DESC LIMIT 1`, hash))
+}
+
+// GetImports returns every import, newest first.
+func (tdb *TelemDb) GetImports(ctx context.Context) ([]Import, error) {
+	rows, err := tdb.db.QueryxContext(ctx, sqlSelectImport+` ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	imports := make([]Import, 0)
+	for rows.Next() {
+		imp, err := scanImport(rows)
+		if err != nil {
+			return nil, err
+		}
+		imports = append(imports, imp)
+	}
+	return imports, rows.Err()
+}
+
+// DeleteImport removes an import and all the bus events and raw frames that
+// came from it.
+// It returns the number of events removed.
+func (tdb *TelemDb) DeleteImport(ctx context.Context, id int64) (int64, error) {
+	tx, err := tdb.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, `DELETE FROM import_log WHERE id = ?`, id)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n != 1 {
+		return 0, ImportNotFoundError(id)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM raw_frames WHERE import_id = ?`, id); err != nil {
+		return 0, err
+	}
+	res, err = tx.ExecContext(ctx, `DELETE FROM bus_events WHERE import_id = ?`, id)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return n, tx.Commit()
+}
@@ -3,12 +3,15 @@ package gotelem
 import (
 	"bufio"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -62,15 +65,30 @@ const exampleData = `1698013005.164 1455ED8FDBDFF4FC3BD
 `
 
 // MakeMockDatabase creates a new dummy database.
-func MakeMockDatabase(name string) *TelemDb {
-	fstring := fmt.Sprintf("file:%s?mode=memory&cache=shared", name)
-	tdb, err := OpenRawDb(fstring)
+// mockDatabases makes the name of every mock database unique. In-memory
+// databases are kept until they're closed, so without it a test run with
+// -count would get the database of the run before.
+var mockDatabases atomic.Int64
+
+// mockDatabaseURI is the URI of a new in-memory database. Open it more than
+// once with openMockDatabase to get the same database.
+func mockDatabaseURI(name string) string {
+	return fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", name, mockDatabases.Add(1))
+}
+
+func openMockDatabase(uri string, opts ...DbOption) *TelemDb {
+	tdb, err := OpenRawDb(uri, opts...)
 	if err != nil {
 		panic(err)
 	}
 	return tdb
 }
 
+// MakeMockDatabase makes a new, empty in-memory database.
+func MakeMockDatabase(name string, opts ...DbOption) *TelemDb {
+	return openMockDatabase(mockDatabaseURI(name), opts...)
+}
+
 func SeedMockDatabase(tdb *TelemDb) {
 	// seed the database now.
 	scanner := bufio.NewScanner(strings.NewReader(exampleData))
@@ -172,11 +190,207 @@ func TestTelemDb(t *testing.T) {
 		// todo - validate what this should be.
 	})
 
+	t.Run("test keyset pagination", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		SeedMockDatabase(tdb)
+		ctx := context.Background()
+
+		// the pages should match what's in the database, read in one go.
+		var evs []skylab.BusEvent
+		err := tdb.StreamPackets(ctx, BusEventFilter{}, KeysetModifier{Ascending: true}, func(ev skylab.BusEvent, c Cursor) error {
+			evs = append(evs, ev)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(evs) != len(GetSeedEvents()) {
+			t.Fatalf("expected only the seed events in the database, got %d", len(evs))
+		}
+
+		for _, asc := range []bool{true, false} {
+			page := KeysetModifier{Limit: 5, Ascending: asc}
+			var got []skylab.BusEvent
+			for {
+				pkts, next, err := tdb.GetPacketsPage(ctx, BusEventFilter{}, page)
+				if err != nil {
+					t.Fatalf("error getting page: %v", err)
+				}
+				if len(pkts) > page.Limit {
+					t.Fatalf("page too large, got %d", len(pkts))
+				}
+				got = append(got, pkts...)
+				if next == nil {
+					break
+				}
+				// make sure the token survives a round trip.
+				c, err := ParseCursor(next.String())
+				if err != nil || c != *next {
+					t.Fatalf("cursor round trip failed: %v", err)
+				}
+				page.After = &c
+			}
+			if len(got) != len(evs) {
+				t.Fatalf("expected %d packets, got %d", len(evs), len(got))
+			}
+			for i := range evs {
+				want := evs[i]
+				if !asc {
+					want = evs[len(evs)-1-i]
+				}
+				if !want.Equals(&got[i]) {
+					t.Fatalf("packet %d did not match (asc=%v), want %v got %v", i, asc, want, got[i])
+				}
+			}
+		}
+
+		vals, next, err := tdb.GetValuesPage(ctx, BusEventFilter{Names: []string{"bms_module"}}, "voltage", KeysetModifier{Limit: 2, Ascending: true})
+		if err != nil {
+			t.Fatalf("error getting values page: %v", err)
+		}
+		if len(vals) != 2 || next == nil {
+			t.Fatalf("expected 2 values and a next page, got %d %v", len(vals), next)
+		}
+		if _, err := ParseCursor("not a cursor"); err == nil {
+			t.Fatal("expected error for bad cursor")
+		}
+	})
+
+	t.Run("test streaming packets", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		SeedMockDatabase(tdb)
+		evs := GetSeedEvents()
+		ctx := context.Background()
+
+		n := 0
+		err := tdb.StreamPackets(ctx, BusEventFilter{}, KeysetModifier{Ascending: true}, func(ev skylab.BusEvent, c Cursor) error {
+			if n < len(evs) && !evs[n].Equals(&ev) {
+				t.Errorf("packet %d did not match, want %v got %v", n, evs[n], ev)
+			}
+			n++
+			return nil
+		})
+		if err != nil || n != len(evs) {
+			t.Fatalf("expected %d packets and no error, got %d %v", len(evs), n, err)
+		}
+
+		// stopping early is not an error.
+		n = 0
+		err = tdb.StreamPackets(ctx, BusEventFilter{}, KeysetModifier{}, func(ev skylab.BusEvent, c Cursor) error {
+			n++
+			if n == 3 {
+				return ErrStopStream
+			}
+			return nil
+		})
+		if err != nil || n != 3 {
+			t.Fatalf("expected to stop after 3 packets, got %d %v", n, err)
+		}
+
+		cctx, cancel := context.WithCancel(ctx)
+		err = tdb.StreamValues(cctx, BusEventFilter{Names: []string{"bms_module"}}, "voltage", KeysetModifier{}, func(d Datum, c Cursor) error {
+			cancel()
+			return nil
+		})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context canceled, got %v", err)
+		}
+
+		// a packet that can't be decoded is skipped, not the end of the stream.
+		if _, err := tdb.db.Exec(`INSERT INTO "bus_events" (ts, name, data) VALUES (?, 'not_a_packet', '{}')`, evs[0].Timestamp.UnixMilli()); err != nil {
+			t.Fatal(err)
+		}
+		n = 0
+		err = tdb.StreamPackets(ctx, BusEventFilter{}, KeysetModifier{Ascending: true}, func(ev skylab.BusEvent, c Cursor) error {
+			n++
+			return nil
+		})
+		if err != nil || n != len(evs) {
+			t.Fatalf("expected %d packets and no error, got %d %v", len(evs), n, err)
+		}
+	})
+
 	t.Run("test read-write packet", func(t *testing.T) {
 
 	})
 }
 
+func TestBusEventFilterMatch(t *testing.T) {
+	now := time.Now()
+	bmsEv := skylab.BusEvent{
+		Timestamp: now,
+		Name:      "bms_measurement",
+		Data:      &skylab.BmsMeasurement{},
+	}
+	moduleEv := skylab.BusEvent{
+		Timestamp: now,
+		Name:      "bms_module",
+		Data:      &skylab.BmsModule{Idx: 3},
+	}
+	tests := []struct {
+		name   string
+		filter BusEventFilter
+		ev     skylab.BusEvent
+		want   bool
+	}{
+		{
+			name:   "empty filter",
+			filter: BusEventFilter{},
+			ev:     bmsEv,
+			want:   true,
+		},
+		{
+			name:   "name match",
+			filter: BusEventFilter{Names: []string{"wsl_velocity", "bms_measurement"}},
+			ev:     bmsEv,
+			want:   true,
+		},
+		{
+			name:   "name mismatch",
+			filter: BusEventFilter{Names: []string{"wsl_velocity"}},
+			ev:     bmsEv,
+			want:   false,
+		},
+		{
+			name:   "before start",
+			filter: BusEventFilter{StartTime: now.Add(time.Second)},
+			ev:     bmsEv,
+			want:   false,
+		},
+		{
+			name:   "after end",
+			filter: BusEventFilter{EndTime: now.Add(-time.Second)},
+			ev:     bmsEv,
+			want:   false,
+		},
+		{
+			name:   "index match",
+			filter: BusEventFilter{Indexes: []int{1, 3}},
+			ev:     moduleEv,
+			want:   true,
+		},
+		{
+			name:   "index mismatch",
+			filter: BusEventFilter{Indexes: []int{1}},
+			ev:     moduleEv,
+			want:   false,
+		},
+		{
+			name:   "index on packet without index",
+			filter: BusEventFilter{Indexes: []int{0}},
+			ev:     bmsEv,
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.ev); got != tt.want {
+				t.Errorf("BusEventFilter.Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func MockDocument(key string) json.RawMessage {
 	var v = make(map[string]interface{})
 
@@ -322,4 +536,292 @@ func TestDbDocuments(t *testing.T) {
 		}
 	})
 
+	t.Run("test update document revision", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		ctx := context.Background()
+		tdb.AddDocument(ctx, MockDocument("hi"))
+
+		rev, err := tdb.UpdateDocumentRevision(ctx, "hi", MockDocument("hi"), 1)
+		if err != nil || rev != 2 {
+			t.Fatalf("UpdateDocumentRevision expected revision 2, got %d err=%v", rev, err)
+		}
+		_, err = tdb.UpdateDocumentRevision(ctx, "hi", MockDocument("hi"), 1)
+		var conflict *DocumentConflictError
+		if !errors.As(err, &conflict) || conflict.Revision != 2 {
+			t.Fatalf("UpdateDocumentRevision expected conflict at revision 2, got err=%v", err)
+		}
+		err = tdb.AddDocument(ctx, MockDocument("hi"))
+		if !errors.As(err, &conflict) {
+			t.Fatalf("AddDocument expected conflict, got err=%v", err)
+		}
+	})
+
+}
+
+func TestDocumentRevisions(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	ctx := context.Background()
+	docs := []json.RawMessage{MockDocument("hi"), MockDocument("hi"), MockDocument("hi")}
+	if err := tdb.AddDocument(ctx, docs[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range docs[1:] {
+		if err := tdb.UpdateDocument(ctx, "hi", d); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("list revisions", func(t *testing.T) {
+		revs, err := tdb.GetDocumentRevisions(ctx, "hi")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != 3 || revs[0].Revision != 3 || revs[2].Revision != 1 || revs[0].SavedAt == nil {
+			t.Fatalf("unexpected revisions %+v", revs)
+		}
+		old, err := tdb.GetDocumentAtRevision(ctx, "hi", 1)
+		if err != nil || !reflect.DeepEqual(old.Data, docs[0]) {
+			t.Fatalf("wrong first revision %s, err=%v", old.Data, err)
+		}
+		if _, err := tdb.GetDocumentRevisions(ctx, "nope"); !errors.Is(err, DocumentNotFoundError("nope")) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		change, err := tdb.RestoreDocument(ctx, "hi", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change.Type != "update" || change.Revision != 4 {
+			t.Fatalf("unexpected change %+v", change)
+		}
+		cur, _ := tdb.GetDocument(ctx, "hi")
+		if !reflect.DeepEqual(cur, docs[0]) {
+			t.Fatalf("restore didn't bring back the old document, got %s", cur)
+		}
+	})
+
+	t.Run("restore deleted", func(t *testing.T) {
+		if err := tdb.DeleteDocument(ctx, "hi"); err != nil {
+			t.Fatal(err)
+		}
+		change, err := tdb.RestoreDocument(ctx, "hi", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change.Type != "create" || change.Revision != 5 {
+			t.Fatalf("unexpected change %+v", change)
+		}
+		cur, _ := tdb.GetDocument(ctx, "hi")
+		if !reflect.DeepEqual(cur, docs[1]) {
+			t.Fatalf("restore didn't bring back the deleted document, got %s", cur)
+		}
+	})
+
+	t.Run("import", func(t *testing.T) {
+		cur, _ := tdb.GetDocument(ctx, "hi")
+		changed := MockDocument("hi")
+		bundle := []json.RawMessage{changed, MockDocument("new")}
+		changes, err := tdb.ImportDocuments(ctx, bundle, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(changes) != 1 || changes[0].Key != "new" || changes[0].Type != "create" {
+			t.Fatalf("expected only the new document to be created, got %+v", changes)
+		}
+		if got, _ := tdb.GetDocument(ctx, "hi"); !reflect.DeepEqual(got, cur) {
+			t.Fatal("import without overwrite changed an existing document")
+		}
+		changes, err = tdb.ImportDocuments(ctx, bundle, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the new document is the same, so it's skipped.
+		if len(changes) != 1 || changes[0].Key != "hi" || changes[0].Type != "update" {
+			t.Fatalf("expected only the changed document to be updated, got %+v", changes)
+		}
+	})
+}
+
+func TestDrives(t *testing.T) {
+	t.Run("drive lifecycle", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		ctx := context.Background()
+
+		d, err := tdb.StartDrive(ctx, "first")
+		if err != nil {
+			t.Fatalf("StartDrive expected no error, got %v", err)
+		}
+		if d.End != nil || d.Note != "first" {
+			t.Fatalf("bad new drive %+v", d)
+		}
+		if _, err := tdb.StartDrive(ctx, "second"); !errors.Is(err, ErrDriveRunning) {
+			t.Fatalf("expected ErrDriveRunning, got %v", err)
+		}
+		d, err = tdb.StopDrive(ctx, d.Id)
+		if err != nil || d.End == nil || !d.End.After(d.Start) {
+			t.Fatalf("StopDrive failed: %+v %v", d, err)
+		}
+		if _, err := tdb.StopDrive(ctx, d.Id); !errors.Is(err, ErrDriveStopped) {
+			t.Fatalf("expected ErrDriveStopped, got %v", err)
+		}
+		d, err = tdb.AnnotateDrive(ctx, d.Id, "changed")
+		if err != nil || d.Note != "changed" {
+			t.Fatalf("AnnotateDrive failed: %+v %v", d, err)
+		}
+		if _, err := tdb.GetDrive(ctx, 1234); !errors.Is(err, DriveNotFoundError(1234)) {
+			t.Fatalf("expected DriveNotFoundError, got %v", err)
+		}
+		if _, err := tdb.StartDrive(ctx, "second"); err != nil {
+			t.Fatalf("StartDrive after stop expected no error, got %v", err)
+		}
+		drives, err := tdb.GetDrives(ctx)
+		if err != nil || len(drives) != 2 {
+			t.Fatalf("expected 2 drives, got %d %v", len(drives), err)
+		}
+	})
+
+	t.Run("concurrent start", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		ctx := context.Background()
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tdb.StartDrive(ctx, "racing")
+			}()
+		}
+		wg.Wait()
+		drives, err := tdb.GetDrives(ctx)
+		if err != nil || len(drives) != 1 {
+			t.Fatalf("expected only one drive to start, got %d %v", len(drives), err)
+		}
+	})
+
+	t.Run("drive filter", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		SeedMockDatabase(tdb)
+		evs := GetSeedEvents()
+		ctx := context.Background()
+		// make a drive that covers the middle of the seed data.
+		start, end := evs[5].Timestamp, evs[10].Timestamp
+		_, err := tdb.db.Exec(`INSERT INTO drive_records (start_time, end_time) VALUES (?, ?)`,
+			start.UnixMilli(), end.UnixMilli())
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkts, err := tdb.GetPackets(ctx, BusEventFilter{DriveID: 1}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pkts) != 6 {
+			t.Fatalf("expected 6 packets in drive, got %d", len(pkts))
+		}
+		pkts, err = tdb.GetPackets(ctx, BusEventFilter{DriveID: 2}, nil)
+		if err != nil || len(pkts) != 0 {
+			t.Fatalf("expected no packets for missing drive, got %d %v", len(pkts), err)
+		}
+	})
+}
+
+func TestImports(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	ctx := context.Background()
+	evs := GetSeedEvents()
+
+	// one event that didn't come from an import.
+	if _, err := tdb.AddEvents(GetRandomBusEvent()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tdb.FindImport(ctx, "abcd"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("expected no import, got %v", err)
+	}
+	id, err := tdb.BeginImport(ctx, "test.log", "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := tdb.AddImportEventsCtx(ctx, id, evs...)
+	if err != nil || n != int64(len(evs)) {
+		t.Fatalf("expected %d events added, got %d %v", len(evs), n, err)
+	}
+	if err := tdb.FinishImport(ctx, id, n, evs[0].Timestamp, evs[len(evs)-1].Timestamp); err != nil {
+		t.Fatal(err)
+	}
+
+	imp, err := tdb.FindImport(ctx, "abcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if imp.Id != id || imp.Count != n || imp.Filename != "test.log" ||
+		imp.Start.UnixMilli() != evs[0].Timestamp.UnixMilli() {
+		t.Fatalf("bad import record %+v", imp)
+	}
+	imports, err := tdb.GetImports(ctx)
+	if err != nil || len(imports) != 1 {
+		t.Fatalf("expected one import, got %d %v", len(imports), err)
+	}
+
+	deleted, err := tdb.DeleteImport(ctx, id)
+	if err != nil || deleted != n {
+		t.Fatalf("expected %d events deleted, got %d %v", n, deleted, err)
+	}
+	pkts, err := tdb.GetPackets(ctx, BusEventFilter{}, nil)
+	if err != nil || len(pkts) != 1 {
+		t.Fatalf("expected only the non-import event to be left, got %d %v", len(pkts), err)
+	}
+	if _, err := tdb.DeleteImport(ctx, id); !errors.Is(err, ImportNotFoundError(id)) {
+		t.Fatalf("expected ImportNotFoundError, got %v", err)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	t.Run("dedupe inserts", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name(), WithDedupe(true))
+		ctx := context.Background()
+		evs := GetSeedEvents()
+		n, err := tdb.AddEventsCtx(ctx, evs...)
+		if err != nil || n != int64(len(evs)) {
+			t.Fatalf("expected %d inserted, got %d %v", len(evs), n, err)
+		}
+		// the second time nothing should be added.
+		n, err = tdb.AddEventsCtx(ctx, evs...)
+		if err != nil || n != 0 {
+			t.Fatalf("expected 0 inserted, got %d %v", n, err)
+		}
+		// same time, different data is not a duplicate.
+		ev := evs[0]
+		ev.Data = &skylab.WslVelocity{VehicleVelocity: 123}
+		n, err = tdb.AddEventsCtx(ctx, ev)
+		if err != nil || n != 1 {
+			t.Fatalf("expected 1 inserted, got %d %v", n, err)
+		}
+	})
+
+	t.Run("dedupe existing database", func(t *testing.T) {
+		uri := mockDatabaseURI(t.Name())
+		tdb := openMockDatabase(uri)
+		SeedMockDatabase(tdb)
+		SeedMockDatabase(tdb)
+		evs := GetSeedEvents()
+		ctx := context.Background()
+
+		removed, err := tdb.Dedupe(ctx)
+		if err != nil || removed != int64(len(evs)) {
+			t.Fatalf("expected %d removed, got %d %v", len(evs), removed, err)
+		}
+		pkts, err := tdb.GetPackets(ctx, BusEventFilter{}, nil)
+		if err != nil || len(pkts) != len(evs) {
+			t.Fatalf("expected %d packets left, got %d %v", len(evs), len(pkts), err)
+		}
+
+		// now inserts in dedupe mode should see the old events.
+		ddb := openMockDatabase(uri, WithDedupe(true))
+		n, err := ddb.AddEventsCtx(ctx, evs...)
+		if err != nil || n != 0 {
+			t.Fatalf("expected 0 inserted after dedupe, got %d %v", n, err)
+		}
+	})
 }
@@ -0,0 +1,234 @@
+package gotelem
+
+// this file builds an OpenMCT dictionary from the skylab definitions. The
+// dictionary is a tree of domain objects: the root folder has a folder for
+// each packet, repeated packets have a folder for each index, and every field
+// is a telemetry object. Bitfields are folders with a telemetry object per bit.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+const (
+	// DictionaryNamespace is the OpenMCT namespace of the dictionary objects.
+	DictionaryNamespace = "umnsvp"
+	// DictionaryRoot is the key of the root folder.
+	DictionaryRoot = "car"
+	// DatumType is the OpenMCT type of the telemetry objects.
+	DatumType = "umnsvp-datum"
+)
+
+type DomainIdentifier struct {
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+}
+
+type Enumeration struct {
+	Value  int    `json:"value"`
+	String string `json:"string"`
+}
+
+// TelemetryValue is OpenMCT value metadata.
+type TelemetryValue struct {
+	Key          string         `json:"key"`
+	Source       string         `json:"source,omitempty"`
+	Name         string         `json:"name"`
+	Format       string         `json:"format,omitempty"`
+	Units        string         `json:"units,omitempty"`
+	Enumerations []Enumeration  `json:"enumerations,omitempty"`
+	Hints        map[string]int `json:"hints,omitempty"`
+}
+
+type TelemetryMetadata struct {
+	Values []TelemetryValue `json:"values"`
+}
+
+// DictionaryDatum says where the value of a telemetry object comes from.
+type DictionaryDatum struct {
+	Packet string  `json:"packet"`
+	Field  string  `json:"field"`
+	Idx    *uint32 `json:"idx,omitempty"` // nil if the packet isn't repeated.
+	Bit    string  `json:"bit,omitempty"`
+}
+
+// Key is the key of the telemetry object for the datum.
+func (d DictionaryDatum) Key() string {
+	parts := []string{d.Packet}
+	if d.Idx != nil {
+		parts = append(parts, strconv.FormatUint(uint64(*d.Idx), 10))
+	}
+	parts = append(parts, d.Field)
+	if d.Bit != "" {
+		parts = append(parts, d.Bit)
+	}
+	return strings.Join(parts, ".")
+}
+
+// ParseDatumKey splits a telemetry object key into its parts. Keys look like
+// packet.field, with the index after the packet for repeated packets and the
+// bit after the field for bitfields, i.e bms_module.3.temp. Field names never
+// start with a number, so the index can't be mistaken for a field.
+func ParseDatumKey(key string) (DictionaryDatum, error) {
+	parts := strings.Split(key, ".")
+	if len(parts) < 2 {
+		return DictionaryDatum{}, fmt.Errorf("bad datum key %q", key)
+	}
+	d := DictionaryDatum{Packet: parts[0]}
+	parts = parts[1:]
+	if idx, err := strconv.ParseUint(parts[0], 10, 32); err == nil {
+		i := uint32(idx)
+		d.Idx = &i
+		parts = parts[1:]
+	}
+	switch len(parts) {
+	case 1:
+		d.Field = parts[0]
+	case 2:
+		d.Field, d.Bit = parts[0], parts[1]
+	default:
+		return DictionaryDatum{}, fmt.Errorf("bad datum key %q", key)
+	}
+	return d, nil
+}
+
+// DomainObject is an OpenMCT domain object. Folders have a composition,
+// telemetry objects have telemetry metadata and a datum.
+type DomainObject struct {
+	Identifier  DomainIdentifier   `json:"identifier"`
+	Name        string             `json:"name"`
+	Type        string             `json:"type"`
+	Location    string             `json:"location"` // namespace:key of the parent.
+	Notes       string             `json:"notes,omitempty"`
+	Composition []DomainIdentifier `json:"composition,omitempty"`
+	Telemetry   *TelemetryMetadata `json:"telemetry,omitempty"`
+	// Conversion is the scale of the raw packet values, zero if there isn't
+	// one. Values from the telemetry endpoints already have it applied.
+	Conversion float32          `json:"conversion,omitempty"`
+	Datum      *DictionaryDatum `json:"datum,omitempty"`
+}
+
+// Dictionary is every domain object generated from a set of definitions.
+type Dictionary struct {
+	Namespace string           `json:"namespace"`
+	Root      DomainIdentifier `json:"root"`
+	Objects   []*DomainObject  `json:"objects"`
+
+	index map[string]*DomainObject
+}
+
+// Object gets a domain object by key.
+func (d *Dictionary) Object(key string) (*DomainObject, bool) {
+	o, ok := d.index[key]
+	return o, ok
+}
+
+func (d *Dictionary) add(o *DomainObject, parent *DomainObject) *DomainObject {
+	if parent != nil {
+		o.Location = DictionaryNamespace + ":" + parent.Identifier.Key
+		parent.Composition = append(parent.Composition, o.Identifier)
+	}
+	d.Objects = append(d.Objects, o)
+	d.index[o.Identifier.Key] = o
+	return o
+}
+
+func folder(key, name string) *DomainObject {
+	return &DomainObject{
+		Identifier: DomainIdentifier{Namespace: DictionaryNamespace, Key: key},
+		Name:       name,
+		Type:       "folder",
+	}
+}
+
+var utcValue = TelemetryValue{
+	Key:    "utc",
+	Source: "ts",
+	Name:   "Timestamp",
+	Format: "utc",
+	Hints:  map[string]int{"domain": 1},
+}
+
+var bitEnumerations = []Enumeration{{Value: 0, String: "OFF"}, {Value: 1, String: "ON"}}
+
+func datum(d DictionaryDatum, name string, field *skylab.FieldDef) *DomainObject {
+	value := TelemetryValue{
+		Key:    "value",
+		Source: "val",
+		Name:   "Value",
+		Units:  field.Units,
+		Hints:  map[string]int{"range": 1},
+	}
+	switch {
+	case d.Bit != "":
+		value.Format = "enum"
+		value.Units = ""
+		value.Enumerations = bitEnumerations
+	case field.Type == "float" || field.Scale() != 1:
+		value.Format = "float"
+	default:
+		value.Format = "integer"
+	}
+	o := &DomainObject{
+		Identifier: DomainIdentifier{Namespace: DictionaryNamespace, Key: d.Key()},
+		Name:       name,
+		Type:       DatumType,
+		Telemetry:  &TelemetryMetadata{Values: []TelemetryValue{value, utcValue}},
+		Datum:      &d,
+	}
+	if d.Bit == "" && field.Conversion != 0 {
+		o.Conversion = field.Conversion
+	}
+	return o
+}
+
+// NewDictionary builds the dictionary for the definitions.
+func NewDictionary(defs *skylab.SkylabFile) *Dictionary {
+	d := &Dictionary{
+		Namespace: DictionaryNamespace,
+		Root:      DomainIdentifier{Namespace: DictionaryNamespace, Key: DictionaryRoot},
+		Objects:   make([]*DomainObject, 0),
+		index:     make(map[string]*DomainObject),
+	}
+	root := d.add(folder(DictionaryRoot, "the solar car"), nil)
+	root.Location = "ROOT"
+
+	for i := range defs.Packets {
+		p := &defs.Packets[i]
+		pf := folder(p.Name, p.Name)
+		pf.Notes = p.Description
+		d.add(pf, root)
+
+		if p.Repeat == 0 {
+			d.addFields(p, nil, pf)
+			continue
+		}
+		for _, idx := range p.Indexes() {
+			idx := idx
+			key := fmt.Sprintf("%s.%d", p.Name, idx)
+			idxf := d.add(folder(key, fmt.Sprintf("%s %d", p.Name, idx)), pf)
+			d.addFields(p, &idx, idxf)
+		}
+	}
+	return d
+}
+
+func (d *Dictionary) addFields(p *skylab.PacketDef, idx *uint32, parent *DomainObject) {
+	for i := range p.Data {
+		f := &p.Data[i]
+		dd := DictionaryDatum{Packet: p.Name, Field: f.Name, Idx: idx}
+		if f.Type != "bitfield" {
+			d.add(datum(dd, f.Name, f), parent)
+			continue
+		}
+		bf := d.add(folder(dd.Key(), f.Name), parent)
+		for _, bit := range f.Bits {
+			bd := dd
+			bd.Bit = bit.Name
+			d.add(datum(bd, bit.Name, f), bf)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package gotelem
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+func TestParseDatumKey(t *testing.T) {
+	idx := uint32(3)
+	tests := []struct {
+		key     string
+		want    DictionaryDatum
+		wantErr bool
+	}{
+		{key: "bms_measurement.current", want: DictionaryDatum{Packet: "bms_measurement", Field: "current"}},
+		{key: "bms_module.3.temp", want: DictionaryDatum{Packet: "bms_module", Field: "temp", Idx: &idx}},
+		{key: "battery_status.pack_choice.large_pack", want: DictionaryDatum{Packet: "battery_status", Field: "pack_choice", Bit: "large_pack"}},
+		{key: "bms_measurement", wantErr: true},
+		{key: "a.b.c.d", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			got, err := ParseDatumKey(tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseDatumKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseDatumKey() = %+v, want %+v", got, tt.want)
+			}
+			if got.Key() != tt.key {
+				t.Errorf("Key() = %s, want %s", got.Key(), tt.key)
+			}
+		})
+	}
+}
+
+func TestNewDictionary(t *testing.T) {
+	defs, err := skylab.Definitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dict := NewDictionary(defs)
+
+	t.Run("tree is consistent", func(t *testing.T) {
+		root, ok := dict.Object(DictionaryRoot)
+		if !ok || len(root.Composition) != len(defs.Packets) {
+			t.Fatalf("root folder should have every packet")
+		}
+		for _, o := range dict.Objects {
+			for _, c := range o.Composition {
+				child, ok := dict.Object(c.Key)
+				if !ok {
+					t.Fatalf("%s has missing child %s", o.Identifier.Key, c.Key)
+				}
+				if child.Location != DictionaryNamespace+":"+o.Identifier.Key {
+					t.Errorf("%s has location %s, expected %s", c.Key, child.Location, o.Identifier.Key)
+				}
+			}
+			if (o.Type == DatumType) != (o.Datum != nil) {
+				t.Errorf("%s: only telemetry objects should have a datum", o.Identifier.Key)
+			}
+			if o.Datum != nil && o.Datum.Key() != o.Identifier.Key {
+				t.Errorf("datum key %s doesn't match %s", o.Datum.Key(), o.Identifier.Key)
+			}
+		}
+	})
+
+	tests := []struct {
+		key        string
+		format     string
+		units      string
+		conversion float32
+	}{
+		{key: "bms_measurement.battery_voltage", format: "float", units: "V", conversion: 0.01},
+		{key: "bms_module.35.temperature", format: "float", units: "C", conversion: 1},
+		{key: "battery_status.pack_choice.small_pack", format: "enum"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			o, ok := dict.Object(tt.key)
+			if !ok {
+				t.Fatalf("missing object")
+			}
+			val := o.Telemetry.Values[0]
+			if val.Format != tt.format || val.Units != tt.units || o.Conversion != tt.conversion {
+				t.Errorf("got format %s units %s conversion %v", val.Format, val.Units, o.Conversion)
+			}
+			if val.Hints["range"] != 1 || o.Telemetry.Values[1].Hints["domain"] != 1 {
+				t.Errorf("missing hints: %+v", o.Telemetry.Values)
+			}
+		})
+	}
+
+	t.Run("repeated packets", func(t *testing.T) {
+		p, ok := dict.Object("bms_module")
+		if !ok || len(p.Composition) != 36 {
+			t.Fatalf("expected a folder for each index")
+		}
+		if _, ok := dict.Object("bms_module.36.temperature"); ok {
+			t.Errorf("index out of range should not exist")
+		}
+	})
+}
@@ -0,0 +1,64 @@
+package gotelem
+
+// this file implements pushing OpenMCT document changes to subscribers.
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// DocumentChange is sent to subscribers when an OpenMCT document changes.
+type DocumentChange struct {
+	Type     string          `json:"type"` // "create", "update" or "delete"
+	Key      string          `json:"key"`
+	Revision int64           `json:"revision,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"` // the new document, empty on delete.
+}
+
+// docHub fans out document changes. Changes are rare, so a slow subscriber
+// just misses them instead of blocking the writer.
+type docHub struct {
+	mu   sync.Mutex
+	subs map[chan DocumentChange]struct{}
+}
+
+func newDocHub() *docHub {
+	return &docHub{subs: make(map[chan DocumentChange]struct{})}
+}
+
+func (h *docHub) subscribe() chan DocumentChange {
+	ch := make(chan DocumentChange, 16)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *docHub) unsubscribe(ch chan DocumentChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, ch)
+}
+
+func (h *docHub) publish(c DocumentChange) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- c:
+		default:
+		}
+	}
+}
+
+// documentKey gets the key of an OpenMCT document, which is nested under
+// identifier.key.
+func documentKey(doc json.RawMessage) string {
+	var d struct {
+		Identifier struct {
+			Key string `json:"key"`
+		} `json:"identifier"`
+	}
+	json.Unmarshal(doc, &d)
+	return d.Identifier.Key
+}
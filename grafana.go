@@ -0,0 +1,295 @@
+package gotelem
+
+// this file implements the API of the Grafana JSON datasource plugin, so
+// stored telemetry can be plotted in Grafana. Metrics are packet.field
+// pairs from the schema, and drives are annotations.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+type grafanaRange struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// grafanaTarget is a query for a single metric. Type is timeserie (the
+// default) or table.
+type grafanaTarget struct {
+	Target string `json:"target"`
+	RefId  string `json:"refId"`
+	Type   string `json:"type"`
+	Hide   bool   `json:"hide"`
+}
+
+type grafanaQuery struct {
+	Range         grafanaRange    `json:"range"`
+	MaxDataPoints int             `json:"maxDataPoints"`
+	Targets       []grafanaTarget `json:"targets"`
+}
+
+// grafanaSeries is a time series response. Datapoints are [value, unix ms].
+type grafanaSeries struct {
+	Target     string   `json:"target"`
+	RefId      string   `json:"refId,omitempty"`
+	Datapoints [][2]any `json:"datapoints"`
+}
+
+type grafanaColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+type grafanaTable struct {
+	Type    string          `json:"type"` // always table.
+	RefId   string          `json:"refId,omitempty"`
+	Columns []grafanaColumn `json:"columns"`
+	Rows    [][]any         `json:"rows"`
+}
+
+type grafanaAnnotationQuery struct {
+	Range      grafanaRange    `json:"range"`
+	Annotation json.RawMessage `json:"annotation"`
+}
+
+type grafanaAnnotation struct {
+	// the annotation query, older versions of the plugin need it back.
+	Annotation json.RawMessage `json:"annotation,omitempty"`
+	Time       int64           `json:"time"`
+	TimeEnd    int64           `json:"timeEnd,omitempty"`
+	IsRegion   bool            `json:"isRegion"`
+	Title      string          `json:"title"`
+	Text       string          `json:"text"`
+	Tags       []string        `json:"tags"`
+}
+
+// grafanaMetrics is every packet.field in the schema. Bitfields aren't
+// numbers, so each bit is a metric instead (packet.field.bit).
+func grafanaMetrics(defs *skylab.SkylabFile) []string {
+	res := make([]string, 0)
+	for _, p := range defs.Packets {
+		for _, f := range p.Data {
+			if f.Type != "bitfield" {
+				res = append(res, p.Name+"."+f.Name)
+				continue
+			}
+			for _, b := range f.Bits {
+				res = append(res, p.Name+"."+f.Name+"."+b.Name)
+			}
+		}
+	}
+	return res
+}
+
+// grafanaObjects gets the telemetry objects of a target. Targets are
+// dictionary keys, and a repeated packet without an index is every index.
+func grafanaObjects(dict *Dictionary, defs *skylab.SkylabFile, target string) ([]*DomainObject, error) {
+	if obj, ok := datumObject(dict, target); ok {
+		return []*DomainObject{obj}, nil
+	}
+	d, err := ParseDatumKey(target)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := defs.Packet(d.Packet)
+	if !ok || d.Idx != nil || p.Repeat == 0 {
+		return nil, fmt.Errorf("unknown metric %q", target)
+	}
+	res := make([]*DomainObject, 0)
+	for _, idx := range p.Indexes() {
+		idx := idx
+		d.Idx = &idx
+		obj, ok := datumObject(dict, d.Key())
+		if !ok {
+			return nil, fmt.Errorf("unknown metric %q", target)
+		}
+		res = append(res, obj)
+	}
+	return res, nil
+}
+
+// grafanaDefaultPoints is the number of points to reduce to if the query
+// doesn't have maxDataPoints, and grafanaMaxPoints is the most it can ask for.
+const (
+	grafanaDefaultPoints = 1000
+	grafanaMaxPoints     = 10000
+)
+
+// grafanaValues gets the values of an object in the range, oldest first.
+// They're reduced to about size points with GetMinMax so peaks still show up.
+// The range must be set.
+func grafanaValues(r *http.Request, tdb *TelemDb, obj *DomainObject, rng grafanaRange, size int) ([]TelemetryPoint, error) {
+	bef := obj.Datum.filter()
+	bef.StartTime = rng.From
+	bef.EndTime = rng.To
+	field := obj.Datum.path()
+
+	if size <= 1 {
+		size = grafanaDefaultPoints
+	}
+	size = min(size, grafanaMaxPoints)
+	// min and max are two points for each bucket.
+	bucket := rng.To.Sub(rng.From) / time.Duration(max(size/2, 1))
+	var data []Datum
+	var err error
+	if bucket >= time.Millisecond {
+		data, err = tdb.GetMinMax(r.Context(), bef, field, bucket)
+	} else {
+		// the range is so short that there can't be more than size points.
+		data, err = tdb.GetValues(r.Context(), bef, field, nil)
+		// these are newest first.
+		slices.Reverse(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return toPoints(obj, data), nil
+}
+
+// GrafanaRouter is the API of the Grafana JSON datasource plugin. It's
+// mounted with RouterMods by the serve command, at /api/grafana.
+func GrafanaRouter(tdb *TelemDb) chi.Router {
+	r := chi.NewRouter()
+
+	// the plugin checks this when the datasource is saved.
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	r.Post("/search", func(w http.ResponseWriter, r *http.Request) {
+		defs, err := skylab.Definitions()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var req struct {
+			Target string `json:"target"`
+		}
+		// an empty body is a search for everything.
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res := slices.DeleteFunc(grafanaMetrics(defs), func(m string) bool {
+			return !strings.Contains(m, req.Target)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	r.Post("/query", func(w http.ResponseWriter, r *http.Request) {
+		dict, err := compiledDictionary()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defs, err := skylab.Definitions()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var req grafanaQuery
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// without a range, a query could be the whole database.
+		if req.Range.From.IsZero() || req.Range.To.IsZero() || !req.Range.To.After(req.Range.From) {
+			http.Error(w, "the query needs a range", http.StatusBadRequest)
+			return
+		}
+		res := make([]any, 0, len(req.Targets))
+		for _, t := range req.Targets {
+			if t.Hide || t.Target == "" {
+				continue
+			}
+			objs, err := grafanaObjects(dict, defs, t.Target)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, obj := range objs {
+				points, err := grafanaValues(r, tdb, obj, req.Range, req.MaxDataPoints)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				switch t.Type {
+				case "", "timeserie", "timeseries":
+					s := grafanaSeries{Target: obj.Identifier.Key, RefId: t.RefId, Datapoints: make([][2]any, len(points))}
+					for i, p := range points {
+						s.Datapoints[i] = [2]any{p.Value, p.Timestamp}
+					}
+					res = append(res, s)
+				case "table":
+					tbl := grafanaTable{
+						Type:    "table",
+						RefId:   t.RefId,
+						Columns: []grafanaColumn{{Text: "Time", Type: "time"}, {Text: obj.Identifier.Key, Type: "number"}},
+						Rows:    make([][]any, len(points)),
+					}
+					for i, p := range points {
+						tbl.Rows[i] = []any{p.Timestamp, p.Value}
+					}
+					res = append(res, tbl)
+				default:
+					http.Error(w, fmt.Sprintf("unknown target type %q", t.Type), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	// drives are shown as regions, running drives as a single point.
+	r.Post("/annotations", func(w http.ResponseWriter, r *http.Request) {
+		var req grafanaAnnotationQuery
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		drives, err := tdb.GetDrives(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		res := make([]grafanaAnnotation, 0)
+		for _, d := range drives {
+			if !req.Range.To.IsZero() && d.Start.After(req.Range.To) {
+				continue
+			}
+			if !req.Range.From.IsZero() && d.End != nil && d.End.Before(req.Range.From) {
+				continue
+			}
+			a := grafanaAnnotation{
+				Annotation: req.Annotation,
+				Time:       d.Start.UnixMilli(),
+				Title:      fmt.Sprintf("drive %d", d.Id),
+				Text:       d.Note,
+				Tags:       []string{"drive"},
+			}
+			if d.End != nil {
+				a.TimeEnd = d.End.UnixMilli()
+				a.IsRegion = true
+			}
+			res = append(res, a)
+		}
+		// GetDrives is newest first.
+		slices.Reverse(res)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	})
+
+	return r
+}
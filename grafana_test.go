@@ -0,0 +1,198 @@
+package gotelem
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+func TestGrafanaRouter(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	ctx := context.Background()
+	start := time.UnixMilli(1700000000000)
+
+	evs := make([]skylab.BusEvent, 0)
+	for i := 0; i < 10; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		// a peak in the middle, so it should survive reduction.
+		v := uint16(12000 + i)
+		if i == 5 {
+			v = 13000
+		}
+		evs = append(evs, skylab.BusEvent{Timestamp: ts, Name: "bms_measurement",
+			Data: &skylab.BmsMeasurement{BatteryVoltage: v}})
+		for _, idx := range []uint32{1, 2} {
+			evs = append(evs, skylab.BusEvent{Timestamp: ts, Name: "bms_module",
+				Data: &skylab.BmsModule{Temperature: float32(idx*10 + uint32(i)), Idx: idx}})
+		}
+	}
+	if _, err := tdb.AddEventsCtx(ctx, evs...); err != nil {
+		t.Fatal(err)
+	}
+	r := GrafanaRouter(tdb)
+
+	post := func(t *testing.T, path string, body any) (int, []byte) {
+		b, _ := json.Marshal(body)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(b))))
+		return w.Code, w.Body.Bytes()
+	}
+	rng := grafanaRange{From: start, To: start.Add(10 * time.Second)}
+
+	t.Run("health", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected ok, got %d", w.Code)
+		}
+	})
+
+	t.Run("search", func(t *testing.T) {
+		code, body := post(t, "/search", map[string]string{"target": "bms_measurement"})
+		if code != http.StatusOK {
+			t.Fatalf("incorrect status code %d: %s", code, body)
+		}
+		var res []string
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"bms_measurement.battery_voltage", "bms_measurement.aux_voltage", "bms_measurement.current"}
+		if !reflect.DeepEqual(res, want) {
+			t.Fatalf("got %v, want %v", res, want)
+		}
+	})
+
+	type series struct {
+		Target     string       `json:"target"`
+		Datapoints [][2]float64 `json:"datapoints"`
+	}
+	query := func(t *testing.T, q grafanaQuery) []series {
+		code, body := post(t, "/query", q)
+		if code != http.StatusOK {
+			t.Fatalf("incorrect status code %d: %s", code, body)
+		}
+		var res []series
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	t.Run("query", func(t *testing.T) {
+		res := query(t, grafanaQuery{Range: rng, Targets: []grafanaTarget{{Target: "bms_measurement.battery_voltage", RefId: "A"}}})
+		if len(res) != 1 || len(res[0].Datapoints) != 10 {
+			t.Fatalf("expected one series of 10 points, got %+v", res)
+		}
+		// the values are converted, and oldest first.
+		if p := res[0].Datapoints[0]; p[0] != 120 || p[1] != float64(start.UnixMilli()) {
+			t.Fatalf("wrong first point %v", p)
+		}
+	})
+
+	t.Run("repeated packet", func(t *testing.T) {
+		res := query(t, grafanaQuery{Range: rng, Targets: []grafanaTarget{{Target: "bms_module.temperature"}}})
+		defs, _ := skylab.Definitions()
+		p, _ := defs.Packet("bms_module")
+		if len(res) != len(p.Indexes()) {
+			t.Fatalf("expected a series per index, got %d", len(res))
+		}
+		for _, s := range res {
+			switch s.Target {
+			case "bms_module.1.temperature", "bms_module.2.temperature":
+				if len(s.Datapoints) != 10 {
+					t.Errorf("expected 10 points for %s, got %d", s.Target, len(s.Datapoints))
+				}
+			default:
+				if len(s.Datapoints) != 0 {
+					t.Errorf("expected no points for %s", s.Target)
+				}
+			}
+		}
+
+		res = query(t, grafanaQuery{Range: rng, Targets: []grafanaTarget{{Target: "bms_module.2.temperature"}}})
+		if len(res) != 1 || res[0].Datapoints[0][0] != 20 {
+			t.Fatalf("wrong single index series %+v", res)
+		}
+	})
+
+	t.Run("reduced", func(t *testing.T) {
+		res := query(t, grafanaQuery{Range: rng, MaxDataPoints: 4, Targets: []grafanaTarget{{Target: "bms_measurement.battery_voltage"}}})
+		if len(res) != 1 || len(res[0].Datapoints) > 4 {
+			t.Fatalf("expected at most 4 points, got %+v", res)
+		}
+		found := false
+		for _, p := range res[0].Datapoints {
+			found = found || p[0] == 130
+		}
+		if !found {
+			t.Fatalf("the peak was lost: %v", res[0].Datapoints)
+		}
+	})
+
+	t.Run("table", func(t *testing.T) {
+		code, body := post(t, "/query", grafanaQuery{Range: rng, Targets: []grafanaTarget{{Target: "bms_measurement.current", Type: "table"}}})
+		if code != http.StatusOK {
+			t.Fatalf("incorrect status code %d: %s", code, body)
+		}
+		var res []grafanaTable
+		if err := json.Unmarshal(body, &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != 1 || res[0].Type != "table" || len(res[0].Columns) != 2 || len(res[0].Rows) != 10 {
+			t.Fatalf("wrong table %+v", res)
+		}
+	})
+
+	t.Run("no range", func(t *testing.T) {
+		code, _ := post(t, "/query", grafanaQuery{Targets: []grafanaTarget{{Target: "bms_measurement.current"}}})
+		if code != http.StatusBadRequest {
+			t.Fatalf("expected bad request, got %d", code)
+		}
+	})
+
+	t.Run("unknown metric", func(t *testing.T) {
+		code, _ := post(t, "/query", grafanaQuery{Range: rng, Targets: []grafanaTarget{{Target: "bms_measurement.nope"}}})
+		if code != http.StatusBadRequest {
+			t.Fatalf("expected bad request, got %d", code)
+		}
+	})
+
+	t.Run("annotations", func(t *testing.T) {
+		d, err := tdb.StartDrive(ctx, "test drive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tdb.StopDrive(ctx, d.Id); err != nil {
+			t.Fatal(err)
+		}
+		annotations := func(rng grafanaRange) []grafanaAnnotation {
+			code, body := post(t, "/annotations", grafanaAnnotationQuery{Range: rng, Annotation: json.RawMessage(`{"name":"drives"}`)})
+			if code != http.StatusOK {
+				t.Fatalf("incorrect status code %d: %s", code, body)
+			}
+			var res []grafanaAnnotation
+			if err := json.Unmarshal(body, &res); err != nil {
+				t.Fatal(err)
+			}
+			return res
+		}
+		now := time.Now()
+		res := annotations(grafanaRange{From: now.Add(-time.Hour), To: now.Add(time.Hour)})
+		if len(res) != 1 || res[0].Text != "test drive" || !res[0].IsRegion || res[0].TimeEnd < res[0].Time {
+			t.Fatalf("wrong annotations %+v", res)
+		}
+		if string(res[0].Annotation) != `{"name":"drives"}` {
+			t.Errorf("annotation query wasn't sent back: %s", res[0].Annotation)
+		}
+		if res := annotations(rng); len(res) != 0 {
+			t.Fatalf("expected no annotations before the drive, got %+v", res)
+		}
+	})
+}
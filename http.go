@@ -4,9 +4,14 @@ package gotelem
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"log/slog"
@@ -55,6 +60,14 @@ func extractBusEventFilter(r *http.Request) (*BusEventFilter, error) {
 			bef.Indexes = append(bef.Indexes, int(idx))
 		}
 	}
+	if el := v.Get("drive"); el != "" {
+		// drive is a shorthand for the time range of a drive.
+		id, err := strconv.Atoi(el)
+		if err != nil {
+			return nil, err
+		}
+		bef.DriveID = id
+	}
 	return bef, nil
 }
 
@@ -83,17 +96,282 @@ func extractLimitModifier(r *http.Request) (*LimitOffsetModifier, error) {
 	return nil, nil
 }
 
+// extractKeysetModifier gets the cursor pagination options. It returns nil
+// if an offset was given, since those requests use LimitOffsetModifier.
+func extractKeysetModifier(r *http.Request) (*KeysetModifier, error) {
+	v := r.URL.Query()
+	if v.Has("offset") {
+		return nil, nil
+	}
+	page := &KeysetModifier{}
+	if el := v.Get("limit"); el != "" {
+		val, err := strconv.ParseInt(el, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		page.Limit = int(val)
+	}
+	switch v.Get("order") {
+	case "", "desc":
+	case "asc":
+		page.Ascending = true
+	default:
+		return nil, errors.New("order must be asc or desc")
+	}
+	if el := v.Get("cursor"); el != "" {
+		c, err := ParseCursor(el)
+		if err != nil {
+			return nil, err
+		}
+		page.After = &c
+	}
+	return page, nil
+}
+
+// pageResponse is the response for cursor paginated requests. Next is
+// empty on the last page.
+type pageResponse[T any] struct {
+	Data []T    `json:"data"`
+	Next string `json:"next,omitempty"`
+}
+
+// writePage writes the query results. If the client asked for a cursor, the
+// results are wrapped in a pageResponse, otherwise it's a plain array
+// like before.
+func writePage[T any](w http.ResponseWriter, r *http.Request, data []T, next *Cursor) {
+	w.Header().Set("Content-Type", "application/json")
+	var v any = data
+	if r.URL.Query().Has("cursor") {
+		resp := pageResponse[T]{Data: data}
+		if next != nil {
+			resp.Next = next.String()
+		}
+		v = resp
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(b)
+}
+
+// response formats. Binary is the skylab binary encoding, which only works
+// for packets.
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatBinary = "binary"
+)
+
+// negotiateFormat gets the format the client asked for, either with
+// ?format= or the Accept header. The default is JSON.
+func negotiateFormat(r *http.Request) (string, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+	case formatJSON, formatNDJSON, formatBinary:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown format %q", f)
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, skylab.BinaryMediaType):
+		return formatBinary, nil
+	case strings.Contains(accept, "ndjson"):
+		return formatNDJSON, nil
+	}
+	return formatJSON, nil
+}
+
+// wantsNDJSON checks if the client asked for newline delimited JSON, either
+// with the Accept header or ?format=ndjson.
+func wantsNDJSON(r *http.Request) bool {
+	f, _ := negotiateFormat(r)
+	return f == formatNDJSON
+}
+
+// streamFlushRows is how many rows are written between flushes.
+const streamFlushRows = 100
+
+// streamPage writes query results as they are read, so big queries don't
+// have to fit in memory. The output is the same as writePage, or one JSON
+// value per line for NDJSON. NDJSON can't have the next cursor in the body,
+// so it's sent in the Next-Cursor trailer instead.
+func streamPage[T any](w http.ResponseWriter, r *http.Request, page KeysetModifier,
+	stream func(KeysetModifier, func(T, Cursor) error) error) {
+	ndjson := wantsNDJSON(r)
+	withCursor := r.URL.Query().Has("cursor")
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if withCursor {
+			w.Header().Set("Trailer", "Next-Cursor")
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	open, end := "[", "]"
+	if withCursor {
+		open = `{"data":[`
+	}
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	n := 0
+	var last, next *Cursor
+	err := stream(page.probe(), func(v T, c Cursor) error {
+		if page.Limit > 0 && n == page.Limit {
+			next = last
+			return ErrStopStream
+		}
+		if !ndjson {
+			sep := ","
+			if n == 0 {
+				sep = open
+			}
+			if _, err := io.WriteString(w, sep); err != nil {
+				return err
+			}
+		}
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		n++
+		last = &c
+		if n%streamFlushRows == 0 {
+			rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if r.Context().Err() != nil {
+			// the client went away.
+			return
+		}
+		if n == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// we already sent a 200, so the only way to tell the client
+		// is to cut the response short.
+		panic(http.ErrAbortHandler)
+	}
+
+	if ndjson {
+		if next != nil {
+			w.Header().Set("Next-Cursor", next.String())
+		}
+		return
+	}
+	if n == 0 {
+		io.WriteString(w, open)
+	}
+	if withCursor {
+		end = "]}"
+		if next != nil {
+			end = fmt.Sprintf(`],"next":%q}`, next.String())
+		}
+	}
+	io.WriteString(w, end)
+}
+
+// streamBinary is streamPage for the binary format. Frames are written one
+// after another, and the next cursor is sent in the Next-Cursor trailer like
+// NDJSON.
+func streamBinary(w http.ResponseWriter, r *http.Request, page KeysetModifier,
+	stream func(KeysetModifier, func(skylab.BusEvent, Cursor) error) error) {
+	w.Header().Set("Content-Type", skylab.BinaryMediaType)
+	if r.URL.Query().Has("cursor") {
+		w.Header().Set("Trailer", "Next-Cursor")
+	}
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 0, 64)
+	n := 0
+	var last, next *Cursor
+	err := stream(page.probe(), func(ev skylab.BusEvent, c Cursor) error {
+		if page.Limit > 0 && n == page.Limit {
+			next = last
+			return ErrStopStream
+		}
+		var err error
+		buf, err = skylab.AppendBinary(buf[:0], ev)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+		n++
+		last = &c
+		if n%streamFlushRows == 0 {
+			rc.Flush()
+		}
+		return nil
+	})
+	if err != nil {
+		if r.Context().Err() != nil {
+			return
+		}
+		if n == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+	if next != nil {
+		w.Header().Set("Next-Cursor", next.String())
+	}
+}
+
+// writeBinary writes packets in the binary format.
+func writeBinary(w http.ResponseWriter, evs []skylab.BusEvent) {
+	b := make([]byte, 0, len(evs)*16)
+	for _, ev := range evs {
+		var err error
+		if b, err = skylab.AppendBinary(b, ev); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", skylab.BinaryMediaType)
+	w.Write(b)
+}
+
+// readPackets reads posted packets, which are either a JSON array or binary
+// frames depending on the Content-Type.
+func readPackets(r *http.Request) ([]skylab.BusEvent, error) {
+	var pkts []skylab.BusEvent
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mt != skylab.BinaryMediaType {
+		err := json.NewDecoder(r.Body).Decode(&pkts)
+		return pkts, err
+	}
+	dec := skylab.NewBinaryDecoder(r.Body)
+	for {
+		var ev skylab.BusEvent
+		err := dec.Decode(&ev)
+		if errors.Is(err, io.EOF) {
+			return pkts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pkts = append(pkts, ev)
+	}
+}
+
 type RouterMod func(chi.Router)
 
 var RouterMods = []RouterMod{}
 
-func TelemRouter(log *slog.Logger, broker *Broker, db *TelemDb) http.Handler {
+func TelemRouter(log *slog.Logger, broker *Broker, db *TelemDb, stats *StatsTracker) http.Handler {
 	r := chi.NewRouter()
 
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger) // TODO: integrate with slog instead of go default logger.
 	r.Use(middleware.Recoverer)
+	r.Use(stats.requests.middleware)
 	r.Use(middleware.SetHeader("Access-Control-Allow-Origin", "*"))
 
 	// heartbeat request.
@@ -101,7 +379,11 @@ func TelemRouter(log *slog.Logger, broker *Broker, db *TelemDb) http.Handler {
 		w.Write([]byte("pong"))
 	})
 
-	r.Mount("/api/v1", apiV1(broker, db))
+	r.Mount("/api/v1", apiV1(broker, db, stats))
+
+	// prometheus metrics of the server, and any skylab values from
+	// SetMetricsFields.
+	r.Get("/metrics", metricsHandler(broker, db, stats))
 
 	for _, mod := range RouterMods {
 		mod(r)
@@ -113,10 +395,10 @@ func TelemRouter(log *slog.Logger, broker *Broker, db *TelemDb) http.Handler {
 }
 
 // define API version 1 routes.
-func apiV1(broker *Broker, tdb *TelemDb) chi.Router {
+func apiV1(broker *Broker, tdb *TelemDb, stats *StatsTracker) chi.Router {
 	r := chi.NewRouter()
-	// this API only accepts JSON.
-	r.Use(middleware.AllowContentType("application/json"))
+	// this API only accepts JSON, and binary packets.
+	r.Use(middleware.AllowContentType("application/json", skylab.BinaryMediaType))
 	// no caching - always get the latest data.
 	// TODO: add a smart short expiry cache for queries that take a while.
 	r.Use(middleware.NoCache)
@@ -127,12 +409,17 @@ func apiV1(broker *Broker, tdb *TelemDb) chi.Router {
 		w.Write([]byte(skylab.SkylabDefinitions))
 	})
 
+	// OpenMCT domain objects for every packet field, built from the schema.
+	r.Route("/dictionary", apiV1Dictionary())
+
+	// values of single dictionary objects, for OpenMCT telemetry providers.
+	r.Route("/telemetry", apiV1Telemetry(broker, tdb, stats))
+
 	r.Route("/packets", func(r chi.Router) {
-		r.Get("/subscribe", apiV1PacketSubscribe(broker))
+		r.Get("/subscribe", apiV1PacketSubscribe(broker, stats))
 		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
-			var pkts []skylab.BusEvent
-			decoder := json.NewDecoder(r.Body)
-			if err := decoder.Decode(&pkts); err != nil {
+			pkts, err := readPackets(r)
+			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
@@ -145,6 +432,9 @@ func apiV1(broker *Broker, tdb *TelemDb) chi.Router {
 		// general packet history get.
 		r.Get("/", apiV1GetPackets(tdb))
 
+		// the latest value of every packet the broker has seen.
+		r.Get("/latest", apiV1GetLatest(broker))
+
 		// this is to get a single field from a packet.
 		r.Get("/{name:[a-z_]+}/{field:[a-z_]+}", apiV1GetValues(tdb))
 
@@ -154,25 +444,62 @@ func apiV1(broker *Broker, tdb *TelemDb) chi.Router {
 	r.Route("/openmct", apiV1OpenMCTStore(tdb))
 
 	// records are driving segments/runs.
+	r.Route("/drives", apiV1Drives(tdb))
+
+	// imported log files. Deleting an import removes its packets.
+	r.Route("/imports", apiV1Imports(tdb))
 
-	r.Get("/stats", func(w http.ResponseWriter, r *http.Request) {
+	// raw can frames, including ones that couldn't be decoded.
+	r.Get("/frames", apiV1GetRawFrames(tdb))
 
-	}) // v1 api stats (calls, clients, xbee connected, meta health ok)
+	// server health: http requests, broker clients, packet rates, database
+	// writes, and the status of the services.
+	r.Get("/stats", apiV1Stats(broker, tdb, stats))
 
 	return r
 }
 
-// this is a websocket stream.
-func apiV1PacketSubscribe(broker *Broker) http.HandlerFunc {
+// this is a websocket stream. The query parameters set the starting filter,
+// after that the client can change it with SubscribeControl messages. With
+// empty=true the client starts with nothing instead, for clients that only
+// use control messages.
+func apiV1PacketSubscribe(broker *Broker, stats *StatsTracker) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// pull filter from url query params.
 		bef, err := extractBusEventFilter(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		subs, err := newPacketSubs(*bef)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// without this, a client with no names gets every packet until
+		// its first subscribe.
+		if empty, _ := strconv.ParseBool(r.URL.Query().Get("empty")); empty {
+			subs.unsubscribe(SubscribeControl{Op: "unsubscribe"})
+		}
+		// packets can be binary messages instead of JSON, control replies
+		// are always JSON.
+		format, err := negotiateFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// setup connection. The broker does the filtering for us, so
+		// we only get the packets we asked for. Viewers only care about
+		// the latest values, so if we fall behind we only keep the latest
+		// of each packet and index.
+		opts := []SubscribeOption{WithPredicate(subs.wants), WithOverflowPolicy(Coalesce)}
+		// snapshot sends the latest values first, so new viewers
+		// don't have to wait for slow packets.
+		if snap, _ := strconv.ParseBool(r.URL.Query().Get("snapshot")); snap {
+			opts = append(opts, WithSnapshot())
 		}
-		// setup connection
 		conn_id := r.RemoteAddr + uuid.NewString()
-		sub, err := broker.Subscribe(conn_id)
+		sub, err := broker.Subscribe(conn_id, opts...)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			fmt.Fprintf(w, "error subscribing: %s", err)
@@ -188,35 +515,153 @@ func apiV1PacketSubscribe(broker *Broker) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		// closeread handles protocol/status messages,
-		// also handles clients closing the connection.
-		// we get a context to use from it.
-		ctx := c.CloseRead(r.Context())
+		defer c.CloseNow()
+		defer stats.trackWebsocket("packets")()
+		ctx := r.Context()
+
+		// control messages are read on their own goroutine, so all the
+		// writes happen here.
+		msgs := make(chan SubscribeControl)
+		readErr := make(chan error, 1)
+		go func() {
+			for {
+				var msg SubscribeControl
+				if err := wsjson.Read(ctx, c, &msg); err != nil {
+					readErr <- err
+					return
+				}
+				select {
+				case msgs <- msg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		// the subscription could have changed since the broker sent the
+		// event, or while it was held, so check it again.
+		write := func(ev skylab.BusEvent) {
+			if !subs.wants(ev) {
+				return
+			}
+			if format != formatBinary {
+				wsjson.Write(ctx, c, subs.render(ev))
+				return
+			}
+			// the binary form is always the whole packet, even if the
+			// client only subscribed to some fields.
+			if b, err := ev.MarshalBinary(); err == nil {
+				c.Write(ctx, websocket.MessageBinary, b)
+			}
+		}
+		out := newOutbox()
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		// send writes the events, and sets the timer for the next held one.
+		send := func(evs []skylab.BusEvent, next time.Time) {
+			for _, ev := range evs {
+				write(ev)
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timerC = nil
+			if !next.IsZero() {
+				timer = time.NewTimer(time.Until(next))
+				timerC = timer.C
+			}
+		}
+		offer := func(ev skylab.BusEvent) {
+			if out.offer(ev, time.Now()) {
+				write(ev)
+				return
+			}
+			send(out.flush(time.Now()))
+		}
 
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case msgIn := <-sub:
-				// short circuit if there's no names - send everything
-				if len(bef.Names) == 0 {
-					wsjson.Write(r.Context(), c, msgIn)
+			case err := <-readErr:
+				var ce websocket.CloseError
+				if !errors.As(err, &ce) {
+					c.Close(websocket.StatusUnsupportedData, "bad control message")
+				}
+				return
+			case <-timerC:
+				timerC = nil
+				send(out.flush(time.Now()))
+			case msg := <-msgs:
+				reply := SubscribeReply{Op: "ok", Id: msg.Id}
+				var err error
+				switch msg.Op {
+				case "subscribe":
+					err = subs.subscribe(msg)
+				case "unsubscribe":
+					err = subs.unsubscribe(msg)
+				case "rate":
+					err = out.setRate(msg.Names, msg.MaxRate)
+				case "pause":
+					out.paused = true
+				case "resume":
+					out.paused = false
+				case "ping":
+					reply.Op = "pong"
+				default:
+					err = fmt.Errorf("unknown op %q", msg.Op)
+				}
+				if err != nil {
+					reply.Op = "error"
+					reply.Error = err.Error()
 				}
-				// otherwise, send it if it matches one of our names.
-				for _, name := range bef.Names {
-					if name == msgIn.Name {
-						// send it
-						wsjson.Write(ctx, c, msgIn)
-						break
+				wsjson.Write(ctx, c, reply)
+				if err != nil {
+					continue
+				}
+				if msg.Op == "subscribe" && msg.Snapshot {
+					names := slices.Clone(msg.Names)
+					for _, f := range msg.Fields {
+						name, _, _ := strings.Cut(f, ".")
+						names = append(names, name)
+					}
+					for _, ev := range broker.latestMatching(func(ev skylab.BusEvent) bool {
+						return slices.Contains(names, ev.Name) && subs.wants(ev)
+					}) {
+						offer(ev)
 					}
 				}
-
+				// rates and pausing change what can be sent.
+				send(out.flush(time.Now()))
+			case ev := <-sub:
+				offer(ev)
 			}
 		}
 
 	}
 }
 
+// apiV1GetLatest returns the last-value table from the broker. It accepts
+// the same name and idx filters as the other packet endpoints.
+func apiV1GetLatest(broker *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		bef, err := extractBusEventFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, err := json.Marshal(broker.Latest(*bef))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(b)
+	}
+}
+
+// apiV1GetPackets gets packet history. Pass cursor (empty for the first page)
+// to get paginated results with a next token, and order=asc to get the
+// oldest packets first.
 func apiV1GetPackets(tdb *TelemDb) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// this should use http query params to return a list of packets.
@@ -225,6 +670,32 @@ func apiV1GetPackets(tdb *TelemDb) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if !checkDriveFilter(w, r, tdb, bef.DriveID) {
+			return
+		}
+
+		format, err := negotiateFormat(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		page, err := extractKeysetModifier(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if page != nil {
+			stream := func(p KeysetModifier, fn func(skylab.BusEvent, Cursor) error) error {
+				return tdb.StreamPackets(r.Context(), *bef, p, fn)
+			}
+			if format == formatBinary {
+				streamBinary(w, r, *page, stream)
+			} else {
+				streamPage(w, r, *page, stream)
+			}
+			return
+		}
 
 		lim, err := extractLimitModifier(r)
 		if err != nil {
@@ -238,6 +709,10 @@ func apiV1GetPackets(tdb *TelemDb) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if format == formatBinary {
+			writeBinary(w, res)
+			return
+		}
 		b, err := json.Marshal(res)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -260,9 +735,7 @@ func apiV1GetValues(db *TelemDb) http.HandlerFunc {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		lim, err := extractLimitModifier(r)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if !checkDriveFilter(w, r, db, bef.DriveID) {
 			return
 		}
 
@@ -273,6 +746,62 @@ func apiV1GetValues(db *TelemDb) http.HandlerFunc {
 		// override the bus event filter name option
 		bef.Names = []string{name}
 
+		// for plots, the values can be reduced with either bucket=10s,
+		// which gives aggregates, or points=N, which downsamples.
+		if el := r.URL.Query().Get("bucket"); el != "" {
+			bucket, err := time.ParseDuration(el)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if bucket < time.Millisecond {
+				http.Error(w, "bucket must be at least 1ms", http.StatusBadRequest)
+				return
+			}
+			res, err := db.GetAggregates(r.Context(), *bef, field, bucket)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writePage(w, r, res, nil)
+			return
+		}
+		if el := r.URL.Query().Get("points"); el != "" {
+			points, err := strconv.Atoi(el)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			res, err := db.GetDownsampled(r.Context(), *bef, field, points)
+			if errors.Is(err, ErrTooManyRows) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writePage(w, r, res, nil)
+			return
+		}
+
+		page, err := extractKeysetModifier(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if page != nil {
+			streamPage(w, r, *page, func(p KeysetModifier, fn func(Datum, Cursor) error) error {
+				return db.StreamValues(r.Context(), *bef, field, p, fn)
+			})
+			return
+		}
+
+		lim, err := extractLimitModifier(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
 		var res []Datum
 		// make the call, skip the limit modifier if it's nil.
 		res, err = db.GetValues(r.Context(), *bef, field, lim)
@@ -291,15 +820,440 @@ func apiV1GetValues(db *TelemDb) http.HandlerFunc {
 
 }
 
+// documentETag is the ETag for a document revision.
+func documentETag(rev int64) string {
+	return fmt.Sprintf(`"%d"`, rev)
+}
+
+// ifMatchRevision gets the revision the client expects from If-Match. It's
+// zero if there's no If-Match, which means any revision.
+func ifMatchRevision(r *http.Request) (int64, error) {
+	tag := r.Header.Get("If-Match")
+	if tag == "" || tag == "*" {
+		return 0, nil
+	}
+	tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+	return strconv.ParseInt(tag, 10, 64)
+}
+
+// writeDocumentError writes the status for a document store error.
+func writeDocumentError(w http.ResponseWriter, err error) {
+	var notFound DocumentNotFoundError
+	var conflict *DocumentConflictError
+	switch {
+	case errors.As(err, &notFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.As(err, &conflict):
+		if conflict.Revision != 0 {
+			w.Header().Set("ETag", documentETag(conflict.Revision))
+		}
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// readDocument reads a document from the request body, and checks that it's
+// a JSON object with a key.
+func readDocument(w http.ResponseWriter, r *http.Request) (json.RawMessage, string, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 10<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+	key := documentKey(body)
+	if !json.Valid(body) || key == "" {
+		http.Error(w, "document must be JSON with identifier.key", http.StatusBadRequest)
+		return nil, "", false
+	}
+	return body, key, true
+}
+
+// writeDocument writes a document with its revision as the ETag.
+func writeDocument(w http.ResponseWriter, doc json.RawMessage, rev int64, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", documentETag(rev))
+	w.WriteHeader(status)
+	w.Write(doc)
+}
+
+// DocumentBundle is an export of every OpenMCT document, used to move
+// layouts between servers.
+type DocumentBundle struct {
+	Version   int               `json:"version"`
+	Exported  time.Time         `json:"exported"`
+	Documents []json.RawMessage `json:"documents"`
+}
+
+// apiV1OpenMCTStore is the persistence store for OpenMCT objects. Every
+// document has a revision, which is sent as the ETag. Updates with If-Match
+// fail with 409 if the document was changed since. Old revisions are kept
+// and can be restored.
 func apiV1OpenMCTStore(db *TelemDb) func(chi.Router) {
+	hub := newDocHub()
 	return func(r chi.Router) {
 		// key is a column on our json store, it's nested under identifier.key
-		r.Get("/{key}", func(w http.ResponseWriter, r *http.Request) {})
-		r.Put("/{key}", func(w http.ResponseWriter, r *http.Request) {})
-		r.Delete("/{key}", func(w http.ResponseWriter, r *http.Request) {})
+		r.Get("/{key}", func(w http.ResponseWriter, r *http.Request) {
+			doc, rev, err := db.GetDocumentRevision(r.Context(), chi.URLParam(r, "key"))
+			if err != nil {
+				writeDocumentError(w, err)
+				return
+			}
+			writeDocument(w, doc, rev, http.StatusOK)
+		})
+		r.Put("/{key}", func(w http.ResponseWriter, r *http.Request) {
+			key := chi.URLParam(r, "key")
+			rev, err := ifMatchRevision(r)
+			if err != nil {
+				http.Error(w, "bad If-Match: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			doc, docKey, ok := readDocument(w, r)
+			if !ok {
+				return
+			}
+			if docKey != key {
+				http.Error(w, "document key doesn't match the url", http.StatusBadRequest)
+				return
+			}
+			newRev, err := db.UpdateDocumentRevision(r.Context(), key, doc, rev)
+			if err != nil {
+				writeDocumentError(w, err)
+				return
+			}
+			hub.publish(DocumentChange{Type: "update", Key: key, Revision: newRev, Data: doc})
+			writeDocument(w, doc, newRev, http.StatusOK)
+		})
+		r.Delete("/{key}", func(w http.ResponseWriter, r *http.Request) {
+			key := chi.URLParam(r, "key")
+			if err := db.DeleteDocument(r.Context(), key); err != nil {
+				writeDocumentError(w, err)
+				return
+			}
+			hub.publish(DocumentChange{Type: "delete", Key: key})
+			w.WriteHeader(http.StatusNoContent)
+		})
 		// create a new object.
-		r.Post("/", func(w http.ResponseWriter, r *http.Request) {})
-		// subscribe to object updates.
-		r.Get("/subscribe", func(w http.ResponseWriter, r *http.Request) {})
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			doc, key, ok := readDocument(w, r)
+			if !ok {
+				return
+			}
+			// a document that was deleted before continues from its old
+			// revisions, so it's not always 1.
+			rev, err := db.AddDocumentRevision(r.Context(), doc)
+			if err != nil {
+				writeDocumentError(w, err)
+				return
+			}
+			hub.publish(DocumentChange{Type: "create", Key: key, Revision: rev, Data: doc})
+			writeDocument(w, doc, rev, http.StatusCreated)
+		})
+		// list the revisions of an object, newest first.
+		r.Get("/{key}/revisions", func(w http.ResponseWriter, r *http.Request) {
+			revs, err := db.GetDocumentRevisions(r.Context(), chi.URLParam(r, "key"))
+			if err != nil {
+				writeDocumentError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(revs)
+		})
+		r.Route("/{key}/revisions/{rev:[0-9]+}", func(r chi.Router) {
+			rev := func(r *http.Request) int64 {
+				n, _ := strconv.ParseInt(chi.URLParam(r, "rev"), 10, 64)
+				return n
+			}
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				doc, err := db.GetDocumentAtRevision(r.Context(), chi.URLParam(r, "key"), rev(r))
+				if err != nil {
+					writeDocumentError(w, err)
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(doc)
+			})
+			// restoring saves the old revision as a new one.
+			r.Post("/restore", func(w http.ResponseWriter, r *http.Request) {
+				change, err := db.RestoreDocument(r.Context(), chi.URLParam(r, "key"), rev(r))
+				if err != nil {
+					writeDocumentError(w, err)
+					return
+				}
+				hub.publish(change)
+				writeDocument(w, change.Data, change.Revision, http.StatusOK)
+			})
+		})
+		// export every object as a bundle.
+		r.Get("/export", func(w http.ResponseWriter, r *http.Request) {
+			docs, err := db.GetAllDocuments(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="openmct.json"`)
+			json.NewEncoder(w).Encode(DocumentBundle{Version: 1, Exported: time.Now(), Documents: docs})
+		})
+		// import a bundle. Existing objects are skipped unless overwrite=true.
+		r.Post("/import", func(w http.ResponseWriter, r *http.Request) {
+			var bundle DocumentBundle
+			if err := json.NewDecoder(r.Body).Decode(&bundle); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if bundle.Version != 1 {
+				http.Error(w, fmt.Sprintf("unsupported bundle version %d", bundle.Version), http.StatusBadRequest)
+				return
+			}
+			for _, doc := range bundle.Documents {
+				if documentKey(doc) == "" {
+					http.Error(w, "document must be JSON with identifier.key", http.StatusBadRequest)
+					return
+				}
+			}
+			overwrite, _ := strconv.ParseBool(r.URL.Query().Get("overwrite"))
+			changes, err := db.ImportDocuments(r.Context(), bundle.Documents, overwrite)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res := map[string]int{"created": 0, "updated": 0, "skipped": len(bundle.Documents) - len(changes)}
+			for _, c := range changes {
+				if c.Type == "create" {
+					res["created"]++
+				} else {
+					res["updated"]++
+				}
+				hub.publish(c)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(res)
+		})
+		// subscribe to object updates. Pass key (can be repeated) to only get
+		// changes to some objects.
+		r.Get("/subscribe", func(w http.ResponseWriter, r *http.Request) {
+			keys := r.URL.Query()["key"]
+			changes := hub.subscribe()
+			defer hub.unsubscribe(changes)
+
+			c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+				InsecureSkipVerify: true,
+			})
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ctx := c.CloseRead(r.Context())
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case change := <-changes:
+					if len(keys) > 0 && !slices.Contains(keys, change.Key) {
+						continue
+					}
+					wsjson.Write(ctx, c, change)
+				}
+			}
+		})
+	}
+}
+
+// apiV1Dictionary serves the OpenMCT dictionary of the skylab packets.
+func apiV1Dictionary() func(chi.Router) {
+	return func(r chi.Router) {
+		// the definitions are compiled in, so the dictionary never changes.
+		dict, err := compiledDictionary()
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(dict)
+		})
+		r.Get("/{key}", func(w http.ResponseWriter, r *http.Request) {
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			obj, ok := dict.Object(chi.URLParam(r, "key"))
+			if !ok {
+				http.Error(w, "object not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(obj)
+		})
+	}
+}
+
+// writeDrive writes the drive with the status, or the right error status.
+func writeDrive(w http.ResponseWriter, d Drive, err error, status int) {
+	var notFound DriveNotFoundError
+	if errors.As(err, &notFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrDriveRunning) || errors.Is(err, ErrDriveStopped) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(d)
+}
+
+// checkDriveFilter looks up the drive the request is filtered by, if any. If
+// it doesn't exist the filter would match nothing, so it writes a 404 instead
+// and returns false.
+func checkDriveFilter(w http.ResponseWriter, r *http.Request, tdb *TelemDb, id int) bool {
+	if id == 0 {
+		return true
+	}
+	_, err := tdb.GetDrive(r.Context(), id)
+	var notFound DriveNotFoundError
+	if errors.As(err, &notFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// driveNote is the request body for starting and annotating drives.
+type driveNote struct {
+	Note string `json:"note"`
+}
+
+func apiV1Drives(tdb *TelemDb) func(chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			drives, err := tdb.GetDrives(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(drives)
+		})
+		// start a new drive. The body is optional.
+		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			var body driveNote
+			if r.ContentLength != 0 {
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			d, err := tdb.StartDrive(r.Context(), body.Note)
+			writeDrive(w, d, err, http.StatusCreated)
+		})
+		r.Route("/{id:[0-9]+}", func(r chi.Router) {
+			driveId := func(r *http.Request) int {
+				// the route pattern makes sure this is a number.
+				id, _ := strconv.Atoi(chi.URLParam(r, "id"))
+				return id
+			}
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				d, err := tdb.GetDrive(r.Context(), driveId(r))
+				writeDrive(w, d, err, http.StatusOK)
+			})
+			r.Post("/stop", func(w http.ResponseWriter, r *http.Request) {
+				d, err := tdb.StopDrive(r.Context(), driveId(r))
+				writeDrive(w, d, err, http.StatusOK)
+			})
+			r.Patch("/", func(w http.ResponseWriter, r *http.Request) {
+				var body driveNote
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				d, err := tdb.AnnotateDrive(r.Context(), driveId(r), body.Note)
+				writeDrive(w, d, err, http.StatusOK)
+			})
+		})
+	}
+}
+
+func apiV1Imports(tdb *TelemDb) func(chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			imports, err := tdb.GetImports(r.Context())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(imports)
+		})
+		r.Delete("/{id:[0-9]+}", func(w http.ResponseWriter, r *http.Request) {
+			id, _ := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+			n, err := tdb.DeleteImport(r.Context(), id)
+			var notFound ImportNotFoundError
+			if errors.As(err, &notFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int64{"deleted": n})
+		})
+	}
+}
+
+// apiV1GetRawFrames gets raw frames, oldest first. Filter with start, end,
+// drive, bus and id (which can be repeated, and can be hex with 0x).
+func apiV1GetRawFrames(tdb *TelemDb) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query()
+		filter := RawFrameFilter{Bus: v.Get("bus")}
+		for _, el := range v["id"] {
+			id, err := strconv.ParseUint(el, 0, 32)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			filter.Ids = append(filter.Ids, uint32(id))
+		}
+		// reuse the bus event parsing for the time range.
+		bef, err := extractBusEventFilter(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		filter.StartTime = bef.StartTime
+		filter.EndTime = bef.EndTime
+		filter.DriveID = bef.DriveID
+		if !checkDriveFilter(w, r, tdb, filter.DriveID) {
+			return
+		}
+
+		limit := 0
+		if el := v.Get("limit"); el != "" {
+			limit, err = strconv.Atoi(el)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		frames, err := tdb.GetRawFrames(r.Context(), filter, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(frames)
 	}
 }
@@ -1,16 +1,27 @@
 package gotelem
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/kschamplin/gotelem/internal/can"
 	"github.com/kschamplin/gotelem/skylab"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
 )
 
 func Test_extractBusEventFilter(t *testing.T) {
@@ -215,3 +226,916 @@ func Test_ApiV1GetPackets(t *testing.T) {
 		})
 	}
 }
+
+func Test_ApiV1GetLatest(t *testing.T) {
+	broker := NewBroker(10, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	evs := GetSeedEvents()
+	for _, ev := range evs {
+		broker.Publish("test", ev)
+	}
+	handler := apiV1GetLatest(broker)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "http://localhost/?name=bms_module&idx=2", nil))
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("incorrect status code: expected %d got %d", http.StatusOK, resp.StatusCode)
+	}
+	var resultEvents []skylab.BusEvent
+	if err := json.NewDecoder(resp.Body).Decode(&resultEvents); err != nil {
+		t.Fatalf("could not parse JSON response: %v", err)
+	}
+	if len(resultEvents) != 1 {
+		t.Fatalf("expected exactly one result, got %d", len(resultEvents))
+	}
+	// the seed data is in time order, so the latest is the last match.
+	var want skylab.BusEvent
+	for _, ev := range evs {
+		if (BusEventFilter{Names: []string{"bms_module"}, Indexes: []int{2}}).Match(ev) {
+			want = ev
+		}
+	}
+	if !want.Equals(&resultEvents[0]) {
+		t.Errorf("packet did not match, want %v got %v", want, resultEvents[0])
+	}
+}
+
+func Test_ApiV1GetPacketsCursor(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	SeedMockDatabase(tdb)
+	evs := GetSeedEvents()
+	handler := apiV1GetPackets(tdb)
+
+	var got []skylab.BusEvent
+	url := "http://localhost/?order=asc&limit=10&cursor="
+	for pages := 0; ; pages++ {
+		if pages > len(evs) {
+			t.Fatal("too many pages")
+		}
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodGet, url, nil))
+		resp := w.Result()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("incorrect status code: expected %d got %d", http.StatusOK, resp.StatusCode)
+		}
+		var page struct {
+			Data []skylab.BusEvent `json:"data"`
+			Next string            `json:"next"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatalf("could not parse JSON response: %v", err)
+		}
+		got = append(got, page.Data...)
+		if page.Next == "" {
+			break
+		}
+		url = "http://localhost/?order=asc&limit=10&cursor=" + page.Next
+	}
+	if len(got) != len(evs) {
+		t.Fatalf("response length did not match, want %d got %d", len(evs), len(got))
+	}
+	for i := range evs {
+		if !evs[i].Equals(&got[i]) {
+			t.Errorf("packet did not match, want %v got %v", evs[i], got[i])
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "http://localhost/?order=sideways", nil))
+	if w.Result().StatusCode != http.StatusBadRequest {
+		t.Errorf("expected bad request for bad order, got %d", w.Result().StatusCode)
+	}
+}
+
+func Test_ApiV1GetPacketsNDJSON(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	SeedMockDatabase(tdb)
+	evs := GetSeedEvents()
+	handler := apiV1GetPackets(tdb)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+	}{
+		{
+			name: "format param",
+			req:  httptest.NewRequest(http.MethodGet, "http://localhost/?order=asc&format=ndjson", nil),
+		},
+		{
+			name: "accept header",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "http://localhost/?order=asc", nil)
+				r.Header.Set("Accept", "application/x-ndjson")
+				return r
+			}(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, tt.req)
+			resp := w.Result()
+			if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+				t.Fatalf("expected ndjson content type, got %s", ct)
+			}
+			scanner := bufio.NewScanner(resp.Body)
+			i := 0
+			for scanner.Scan() {
+				var ev skylab.BusEvent
+				if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+					t.Fatalf("could not parse line %d: %v", i, err)
+				}
+				if i >= len(evs) || !evs[i].Equals(&ev) {
+					t.Fatalf("line %d did not match, got %v", i, ev)
+				}
+				i++
+			}
+			if i != len(evs) {
+				t.Fatalf("expected %d lines, got %d", len(evs), i)
+			}
+		})
+	}
+}
+
+func Test_ApiV1GetPacketsBinary(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	SeedMockDatabase(tdb)
+	evs := GetSeedEvents()
+	handler := apiV1GetPackets(tdb)
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		statusCode int
+		count      int
+		next       bool
+	}{
+		{
+			name:       "format param",
+			req:        httptest.NewRequest(http.MethodGet, "http://localhost/?order=asc&format=binary", nil),
+			statusCode: http.StatusOK,
+			count:      len(evs),
+		},
+		{
+			name: "accept header",
+			req: func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "http://localhost/?order=asc", nil)
+				r.Header.Set("Accept", skylab.BinaryMediaType)
+				return r
+			}(),
+			statusCode: http.StatusOK,
+			count:      len(evs),
+		},
+		{
+			name:       "cursor",
+			req:        httptest.NewRequest(http.MethodGet, "http://localhost/?order=asc&format=binary&cursor=&limit=2", nil),
+			statusCode: http.StatusOK,
+			count:      2,
+			next:       true,
+		},
+		{
+			name:       "unknown format",
+			req:        httptest.NewRequest(http.MethodGet, "http://localhost/?format=xml", nil),
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler(w, tt.req)
+			resp := w.Result()
+			if resp.StatusCode != tt.statusCode {
+				t.Fatalf("incorrect status code: expected %d got %d", tt.statusCode, resp.StatusCode)
+			}
+			if tt.statusCode != http.StatusOK {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != skylab.BinaryMediaType {
+				t.Fatalf("expected binary content type, got %s", ct)
+			}
+			dec := skylab.NewBinaryDecoder(resp.Body)
+			i := 0
+			for {
+				var ev skylab.BusEvent
+				err := dec.Decode(&ev)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("could not decode event %d: %v", i, err)
+				}
+				want, _ := evs[i].Data.MarshalPacket()
+				got, _ := ev.Data.MarshalPacket()
+				if ev.Name != evs[i].Name || !ev.Timestamp.Equal(evs[i].Timestamp) || !bytes.Equal(got, want) {
+					t.Fatalf("event %d did not match, got %v", i, ev)
+				}
+				i++
+			}
+			if i != tt.count {
+				t.Fatalf("expected %d events, got %d", tt.count, i)
+			}
+			if next := resp.Trailer.Get("Next-Cursor"); (next != "") != tt.next {
+				t.Fatalf("unexpected next cursor %q", next)
+			}
+		})
+	}
+
+	t.Run("post", func(t *testing.T) {
+		dst := MakeMockDatabase(t.Name())
+		r := apiV1(NewBroker(10, slog.Default()), dst, NewStatsTracker())
+		var body []byte
+		for _, ev := range evs {
+			var err error
+			if body, err = skylab.AppendBinary(body, ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+		req := httptest.NewRequest(http.MethodPost, "/packets/", bytes.NewReader(body))
+		req.Header.Set("Content-Type", skylab.BinaryMediaType)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("incorrect status code: expected %d got %d: %s", http.StatusOK, w.Code, w.Body)
+		}
+		got, err := dst.GetPackets(context.Background(), BusEventFilter{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != len(evs) {
+			t.Fatalf("expected %d packets stored, got %d", len(evs), len(got))
+		}
+	})
+}
+
+func Test_ApiV1Drives(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	r := chi.NewRouter()
+	r.Route("/", apiV1Drives(tdb))
+
+	do := func(method, path, body string) *http.Response {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w.Result()
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		statusCode int
+	}{
+		{name: "start drive", method: http.MethodPost, path: "/", body: `{"note": "test"}`, statusCode: http.StatusCreated},
+		{name: "start second drive", method: http.MethodPost, path: "/", statusCode: http.StatusConflict},
+		{name: "get drive", method: http.MethodGet, path: "/1", statusCode: http.StatusOK},
+		{name: "get missing drive", method: http.MethodGet, path: "/2", statusCode: http.StatusNotFound},
+		{name: "annotate drive", method: http.MethodPatch, path: "/1", body: `{"note": "changed"}`, statusCode: http.StatusOK},
+		{name: "stop drive", method: http.MethodPost, path: "/1/stop", statusCode: http.StatusOK},
+		{name: "stop drive again", method: http.MethodPost, path: "/1/stop", statusCode: http.StatusConflict},
+		{name: "list drives", method: http.MethodGet, path: "/", statusCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := do(tt.method, tt.path, tt.body)
+			if resp.StatusCode != tt.statusCode {
+				t.Fatalf("incorrect status code: expected %d got %d", tt.statusCode, resp.StatusCode)
+			}
+		})
+	}
+
+	var drives []Drive
+	if err := json.NewDecoder(do(http.MethodGet, "/", "").Body).Decode(&drives); err != nil {
+		t.Fatal(err)
+	}
+	if len(drives) != 1 || drives[0].Note != "changed" || drives[0].End == nil {
+		t.Fatalf("unexpected drives %+v", drives)
+	}
+
+	// filtering by a drive that doesn't exist is a 404, not an empty result.
+	for _, tt := range []struct {
+		name       string
+		handler    http.HandlerFunc
+		path       string
+		statusCode int
+	}{
+		{name: "packets", handler: apiV1GetPackets(tdb), path: "/?drive=1", statusCode: http.StatusOK},
+		{name: "packets missing drive", handler: apiV1GetPackets(tdb), path: "/?drive=2", statusCode: http.StatusNotFound},
+		{name: "frames", handler: apiV1GetRawFrames(tdb), path: "/?drive=1", statusCode: http.StatusOK},
+		{name: "frames missing drive", handler: apiV1GetRawFrames(tdb), path: "/?drive=2", statusCode: http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			tt.handler(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.statusCode {
+				t.Fatalf("incorrect status code: expected %d got %d", tt.statusCode, w.Code)
+			}
+		})
+	}
+}
+
+func Test_ApiV1OpenMCTStore(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	r := chi.NewRouter()
+	r.Route("/", apiV1OpenMCTStore(tdb))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/subscribe?key=hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+
+	doc := string(MockDocument("hi"))
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		ifMatch    string
+		statusCode int
+		etag       string
+	}{
+		{name: "create", method: http.MethodPost, path: "/", body: doc, statusCode: http.StatusCreated, etag: `"1"`},
+		{name: "create duplicate", method: http.MethodPost, path: "/", body: doc, statusCode: http.StatusConflict},
+		{name: "create without key", method: http.MethodPost, path: "/", body: `{"a": 1}`, statusCode: http.StatusBadRequest},
+		{name: "get", method: http.MethodGet, path: "/hi", statusCode: http.StatusOK, etag: `"1"`},
+		{name: "get missing", method: http.MethodGet, path: "/nope", statusCode: http.StatusNotFound},
+		{name: "update", method: http.MethodPut, path: "/hi", body: doc, ifMatch: `"1"`, statusCode: http.StatusOK, etag: `"2"`},
+		{name: "update stale", method: http.MethodPut, path: "/hi", body: doc, ifMatch: `"1"`, statusCode: http.StatusConflict, etag: `"2"`},
+		{name: "update without revision", method: http.MethodPut, path: "/hi", body: doc, statusCode: http.StatusOK, etag: `"3"`},
+		{name: "update wrong key", method: http.MethodPut, path: "/other", body: doc, statusCode: http.StatusBadRequest},
+		{name: "update missing", method: http.MethodPut, path: "/other", body: string(MockDocument("other")), statusCode: http.StatusNotFound},
+		{name: "delete", method: http.MethodDelete, path: "/hi", statusCode: http.StatusNoContent},
+		{name: "delete missing", method: http.MethodDelete, path: "/hi", statusCode: http.StatusNotFound},
+		// the revisions continue from before it was deleted.
+		{name: "create after delete", method: http.MethodPost, path: "/", body: doc, statusCode: http.StatusCreated, etag: `"4"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			resp := w.Result()
+			if resp.StatusCode != tt.statusCode {
+				t.Fatalf("incorrect status code: expected %d got %d", tt.statusCode, resp.StatusCode)
+			}
+			if tt.etag != "" && resp.Header.Get("ETag") != tt.etag {
+				t.Fatalf("incorrect etag: expected %s got %s", tt.etag, resp.Header.Get("ETag"))
+			}
+		})
+	}
+
+	// the subscriber should see every successful change, in order.
+	want := []DocumentChange{
+		{Type: "create", Key: "hi", Revision: 1},
+		{Type: "update", Key: "hi", Revision: 2},
+		{Type: "update", Key: "hi", Revision: 3},
+		{Type: "delete", Key: "hi"},
+	}
+	for _, w := range want {
+		var got DocumentChange
+		if err := wsjson.Read(ctx, conn, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Type != w.Type || got.Key != w.Key || got.Revision != w.Revision {
+			t.Fatalf("unexpected change %+v, want %+v", got, w)
+		}
+	}
+}
+
+func Test_ApiV1OpenMCTBundle(t *testing.T) {
+	src := chi.NewRouter()
+	src.Route("/", apiV1OpenMCTStore(MakeMockDatabase(t.Name()+"src")))
+	dst := chi.NewRouter()
+	dst.Route("/", apiV1OpenMCTStore(MakeMockDatabase(t.Name()+"dst")))
+
+	do := func(r http.Handler, method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	for _, key := range []string{"a", "b"} {
+		if w := do(src, http.MethodPost, "/", string(MockDocument(key))); w.Code != http.StatusCreated {
+			t.Fatalf("creating %s: got %d", key, w.Code)
+		}
+	}
+	do(src, http.MethodPut, "/a", string(MockDocument("a")))
+
+	t.Run("revisions", func(t *testing.T) {
+		var revs []DocumentRevision
+		w := do(src, http.MethodGet, "/a/revisions", "")
+		if err := json.NewDecoder(w.Body).Decode(&revs); err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != 2 {
+			t.Fatalf("expected 2 revisions, got %d", len(revs))
+		}
+		if w := do(src, http.MethodGet, "/a/revisions/1", ""); w.Code != http.StatusOK {
+			t.Fatalf("getting revision: got %d", w.Code)
+		}
+		if w := do(src, http.MethodGet, "/a/revisions/9", ""); w.Code != http.StatusNotFound {
+			t.Fatalf("getting missing revision: got %d", w.Code)
+		}
+		w = do(src, http.MethodPost, "/a/revisions/1/restore", "")
+		if w.Code != http.StatusOK || w.Header().Get("ETag") != `"3"` {
+			t.Fatalf("restoring: got %d etag %s", w.Code, w.Header().Get("ETag"))
+		}
+	})
+
+	t.Run("export and import", func(t *testing.T) {
+		export := do(src, http.MethodGet, "/export", "").Body.String()
+		var res map[string]int
+		w := do(dst, http.MethodPost, "/import", export)
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if res["created"] != 2 || res["skipped"] != 0 {
+			t.Fatalf("unexpected import result %v", res)
+		}
+		w = do(dst, http.MethodPost, "/import", export)
+		json.NewDecoder(w.Body).Decode(&res)
+		if res["created"] != 0 || res["skipped"] != 2 {
+			t.Fatalf("unexpected second import result %v", res)
+		}
+		a := do(src, http.MethodGet, "/a", "").Body.String()
+		if got := do(dst, http.MethodGet, "/a", "").Body.String(); got != a {
+			t.Fatalf("imported document differs: %s vs %s", got, a)
+		}
+		if w := do(dst, http.MethodPost, "/import", `{"version": 2}`); w.Code != http.StatusBadRequest {
+			t.Fatalf("expected bad version to fail, got %d", w.Code)
+		}
+	})
+}
+
+func Test_ApiV1Dictionary(t *testing.T) {
+	r := chi.NewRouter()
+	r.Route("/", apiV1Dictionary())
+
+	tests := []struct {
+		name       string
+		path       string
+		statusCode int
+	}{
+		{name: "whole dictionary", path: "/", statusCode: http.StatusOK},
+		{name: "root", path: "/car", statusCode: http.StatusOK},
+		{name: "datum", path: "/bms_measurement.current", statusCode: http.StatusOK},
+		{name: "missing", path: "/not_a_packet.field", statusCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.statusCode {
+				t.Fatalf("incorrect status code: expected %d got %d", tt.statusCode, w.Code)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/bms_measurement.current", nil))
+	var obj DomainObject
+	if err := json.NewDecoder(w.Body).Decode(&obj); err != nil {
+		t.Fatal(err)
+	}
+	if obj.Type != DatumType || obj.Datum == nil || obj.Datum.Field != "current" || obj.Location != "umnsvp:bms_measurement" {
+		t.Fatalf("unexpected object %+v", obj)
+	}
+}
+
+func Test_ApiV1TelemetryHistory(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	ctx := context.Background()
+	start := time.UnixMilli(1700000000000)
+	for i := 0; i < 4; i++ {
+		ts := start.Add(time.Duration(i) * time.Second)
+		_, err := tdb.AddEventsCtx(ctx,
+			skylab.BusEvent{Timestamp: ts, Name: "bms_measurement", Data: &skylab.BmsMeasurement{BatteryVoltage: uint16(100 * (i + 1))}},
+			skylab.BusEvent{Timestamp: ts, Name: "bms_module", Data: &skylab.BmsModule{Voltage: float32(i), Idx: uint32(i % 2)}},
+			skylab.BusEvent{Timestamp: ts, Name: "battery_status", Data: &skylab.BatteryStatus{PackChoice: skylab.BatteryStatusPackChoice{LargePack: i%2 == 1}}},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := chi.NewRouter()
+	r.Route("/", apiV1Telemetry(NewBroker(10, slog.Default()), tdb, NewStatsTracker()))
+
+	ms := func(i int) int64 {
+		return start.Add(time.Duration(i) * time.Second).UnixMilli()
+	}
+	tests := []struct {
+		name       string
+		path       string
+		statusCode int
+		want       []TelemetryPoint
+	}{
+		{name: "all values are scaled", path: fmt.Sprintf("/bms_measurement.battery_voltage?start=%d&end=%d", ms(0), ms(3)), statusCode: http.StatusOK,
+			want: []TelemetryPoint{{Timestamp: ms(0), Value: 1.0}, {Timestamp: ms(1), Value: 2.0}, {Timestamp: ms(2), Value: 3.0}, {Timestamp: ms(3), Value: 4.0}}},
+		{name: "time range", path: fmt.Sprintf("/bms_measurement.battery_voltage?start=%d&end=%d", ms(1), ms(2)), statusCode: http.StatusOK,
+			want: []TelemetryPoint{{Timestamp: ms(1), Value: 2.0}, {Timestamp: ms(2), Value: 3.0}}},
+		{name: "latest", path: "/bms_measurement.battery_voltage?strategy=latest", statusCode: http.StatusOK,
+			want: []TelemetryPoint{{Timestamp: ms(3), Value: 4.0}}},
+		{name: "latest size", path: "/bms_measurement.battery_voltage?strategy=latest&size=2", statusCode: http.StatusOK,
+			want: []TelemetryPoint{{Timestamp: ms(2), Value: 3.0}, {Timestamp: ms(3), Value: 4.0}}},
+		{name: "minmax", path: fmt.Sprintf("/bms_measurement.battery_voltage?strategy=minmax&size=1&start=%d&end=%d", ms(0), ms(0)+10000), statusCode: http.StatusOK,
+			want: []TelemetryPoint{{Timestamp: ms(0), Value: 1.0}, {Timestamp: ms(3), Value: 4.0}}},
+		{name: "short minmax", path: fmt.Sprintf("/bms_measurement.battery_voltage?strategy=minmax&start=%d&end=%d", ms(0), ms(3)), statusCode: http.StatusOK,
+			want: []TelemetryPoint{{Timestamp: ms(0), Value: 1.0}, {Timestamp: ms(1), Value: 2.0}, {Timestamp: ms(2), Value: 3.0}, {Timestamp: ms(3), Value: 4.0}}},
+		{name: "repeated packet", path: fmt.Sprintf("/bms_module.1.voltage?start=%d&end=%d", ms(0), ms(3)), statusCode: http.StatusOK,
+			want: []TelemetryPoint{{Timestamp: ms(1), Value: 1.0}, {Timestamp: ms(3), Value: 3.0}}},
+		{name: "bit", path: "/battery_status.pack_choice.large_pack?strategy=latest&size=2", statusCode: http.StatusOK,
+			want: []TelemetryPoint{{Timestamp: ms(2), Value: 0.0}, {Timestamp: ms(3), Value: 1.0}}},
+		{name: "unknown key", path: "/bms_measurement.nope", statusCode: http.StatusNotFound},
+		{name: "folder key", path: "/bms_measurement", statusCode: http.StatusNotFound},
+		{name: "bad strategy", path: "/bms_measurement.current?strategy=average", statusCode: http.StatusBadRequest},
+		{name: "bad time", path: "/bms_measurement.current?start=yesterday", statusCode: http.StatusBadRequest},
+		{name: "no range", path: "/bms_measurement.current", statusCode: http.StatusBadRequest},
+		{name: "no end", path: fmt.Sprintf("/bms_measurement.current?strategy=minmax&start=%d", ms(0)), statusCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if w.Code != tt.statusCode {
+				t.Fatalf("incorrect status code: expected %d got %d", tt.statusCode, w.Code)
+			}
+			if tt.want == nil {
+				return
+			}
+			var got []TelemetryPoint
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ApiV1TelemetryHistoryTooMany(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	start := time.UnixMilli(1700000000000)
+	evs := make([]skylab.BusEvent, maxTelemetryPoints+1)
+	for i := range evs {
+		evs[i] = skylab.BusEvent{Timestamp: start.Add(time.Duration(i) * time.Millisecond), Name: "bms_measurement", Data: &skylab.BmsMeasurement{BatteryVoltage: uint16(i)}}
+	}
+	// a few at a time, so the insert doesn't have too many variables.
+	for i := 0; i < len(evs); i += 1000 {
+		if _, err := tdb.AddEventsCtx(context.Background(), evs[i:min(i+1000, len(evs))]...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := chi.NewRouter()
+	r.Route("/", apiV1Telemetry(NewBroker(10, slog.Default()), tdb, NewStatsTracker()))
+
+	path := fmt.Sprintf("/bms_measurement.battery_voltage?start=%d&end=%d", start.UnixMilli(), evs[len(evs)-1].Timestamp.UnixMilli())
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("incorrect status code: expected %d got %d", http.StatusOK, w.Code)
+	}
+	var got []TelemetryPoint
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	// too many raw values, so it should be reduced with minmax. The buckets
+	// are aligned, so there can be one more than asked for.
+	if len(got) == 0 || len(got) > 2*(defaultMinMaxSize+1) {
+		t.Fatalf("expected the values to be reduced, got %d", len(got))
+	}
+}
+
+func Test_ApiV1TelemetrySubscribe(t *testing.T) {
+	broker := NewBroker(10, slog.Default())
+	r := chi.NewRouter()
+	r.Route("/", apiV1Telemetry(broker, MakeMockDatabase(t.Name()), NewStatsTracker()))
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	// this one should be sent when subscribing.
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(1000), Name: "bms_measurement", Data: &skylab.BmsMeasurement{BatteryVoltage: 100}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/subscribe", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+
+	read := func() map[string]any {
+		var msg map[string]any
+		if err := wsjson.Read(ctx, conn, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	send := func(req TelemetryRequest) {
+		if err := wsjson.Write(ctx, conn, req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(TelemetryRequest{Subscribe: []string{"bms_measurement.battery_voltage", "bms_module.1.voltage", "nope.nope"}})
+	if msg := read(); msg["error"] == nil {
+		t.Fatalf("expected an error for the unknown key, got %v", msg)
+	}
+	if msg := read(); msg["key"] != "bms_measurement.battery_voltage" || msg["val"] != 1.0 || msg["ts"] != 1000.0 {
+		t.Fatalf("expected the latest value, got %v", msg)
+	}
+
+	// the other index and unsubscribed packets are filtered out.
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(2000), Name: "bms_module", Data: &skylab.BmsModule{Voltage: 1, Idx: 0}})
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(2000), Name: "bms_soc", Data: &skylab.BmsSoc{}})
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(3000), Name: "bms_module", Data: &skylab.BmsModule{Voltage: 2, Idx: 1}})
+	if msg := read(); msg["key"] != "bms_module.1.voltage" || msg["val"] != 2.0 {
+		t.Fatalf("expected the module voltage, got %v", msg)
+	}
+
+	send(TelemetryRequest{Unsubscribe: []string{"bms_measurement.battery_voltage"}})
+	// there's no reply to an unsubscribe, so check with a key that's still subscribed.
+	send(TelemetryRequest{Subscribe: []string{"bms_module.1.voltage"}})
+	if msg := read(); msg["key"] != "bms_module.1.voltage" {
+		t.Fatalf("expected the module voltage, got %v", msg)
+	}
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(4000), Name: "bms_measurement", Data: &skylab.BmsMeasurement{BatteryVoltage: 200}})
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(5000), Name: "bms_module", Data: &skylab.BmsModule{Voltage: 3, Idx: 1}})
+	if msg := read(); msg["key"] != "bms_module.1.voltage" || msg["val"] != 3.0 {
+		t.Fatalf("expected the module voltage after unsubscribing, got %v", msg)
+	}
+
+	// values of the same key aren't coalesced while there's room.
+	for i := 0; i < 3; i++ {
+		broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(int64(6000 + i)), Name: "bms_module", Data: &skylab.BmsModule{Voltage: float32(4 + i), Idx: 1}})
+	}
+	for i := 0; i < 3; i++ {
+		if msg := read(); msg["val"] != float64(4+i) {
+			t.Fatalf("expected every value in order, got %v", msg)
+		}
+	}
+}
+
+func Test_ApiV1PacketSubscribeControl(t *testing.T) {
+	broker := NewBroker(10, slog.Default())
+	srv := httptest.NewServer(apiV1PacketSubscribe(broker, NewStatsTracker()))
+	defer srv.Close()
+
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(1000), Name: "bms_module", Data: &skylab.BmsModule{Voltage: 1, Temperature: 2, Idx: 1}})
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(1000), Name: "bms_module", Data: &skylab.BmsModule{Voltage: 3, Temperature: 4, Idx: 2}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"?name=bms_measurement", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+
+	read := func() map[string]any {
+		var msg map[string]any
+		if err := wsjson.Read(ctx, conn, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	control := func(msg SubscribeControl) map[string]any {
+		if err := wsjson.Write(ctx, conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		return read()
+	}
+	measurement := func(ts int64, v float32) {
+		broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(ts), Name: "bms_measurement", Data: &skylab.BmsMeasurement{Current: v}})
+	}
+
+	if reply := control(SubscribeControl{Op: "ping", Id: json.RawMessage(`7`)}); reply["op"] != "pong" || reply["id"] != 7.0 {
+		t.Fatalf("expected pong, got %v", reply)
+	}
+	// the query filter still works.
+	measurement(2000, 1)
+	if msg := read(); msg["name"] != "bms_measurement" {
+		t.Fatalf("expected a measurement, got %v", msg)
+	}
+
+	if reply := control(SubscribeControl{Op: "subscribe", Names: []string{"nope"}}); reply["op"] != "error" {
+		t.Fatalf("expected an error, got %v", reply)
+	}
+	if reply := control(SubscribeControl{Op: "bogus"}); reply["op"] != "error" {
+		t.Fatalf("expected an error, got %v", reply)
+	}
+
+	// the snapshot comes after the reply.
+	if reply := control(SubscribeControl{Op: "subscribe", Fields: []string{"bms_module.voltage"}, Indexes: []int{1}, Snapshot: true}); reply["op"] != "ok" {
+		t.Fatalf("expected ok, got %v", reply)
+	}
+	msg := read()
+	data, _ := msg["data"].(map[string]any)
+	if msg["name"] != "bms_module" || len(data) != 2 || data["voltage"] != 1.0 || data["idx"] != 1.0 {
+		t.Fatalf("expected a snapshot with only the voltage, got %v", msg)
+	}
+
+	if reply := control(SubscribeControl{Op: "pause"}); reply["op"] != "ok" {
+		t.Fatalf("expected ok, got %v", reply)
+	}
+	measurement(3000, 2)
+	measurement(4000, 3)
+	if reply := control(SubscribeControl{Op: "unsubscribe", Names: []string{"bms_module"}}); reply["op"] != "ok" {
+		t.Fatalf("expected ok, got %v", reply)
+	}
+	// only the latest held packet is sent on resume.
+	if reply := control(SubscribeControl{Op: "resume"}); reply["op"] != "ok" {
+		t.Fatalf("expected ok, got %v", reply)
+	}
+	msg = read()
+	data, _ = msg["data"].(map[string]any)
+	if msg["ts"] != 4000.0 || data["current"] != 3.0 {
+		t.Fatalf("expected the last measurement, got %v", msg)
+	}
+
+	if reply := control(SubscribeControl{Op: "rate", MaxRate: 1}); reply["op"] != "ok" {
+		t.Fatalf("expected ok, got %v", reply)
+	}
+	measurement(5000, 4)
+	measurement(6000, 5)
+	// the last measurement was just sent, so these are held for a second and
+	// only the newest is sent. A ping gets in first.
+	if reply := control(SubscribeControl{Op: "ping"}); reply["op"] != "pong" {
+		t.Fatalf("expected pong, got %v", reply)
+	}
+	if msg := read(); msg["ts"] != 6000.0 {
+		t.Fatalf("expected the held measurement, got %v", msg)
+	}
+}
+
+func Test_ApiV1PacketSubscribeEmpty(t *testing.T) {
+	broker := NewBroker(10, slog.Default())
+	srv := httptest.NewServer(apiV1PacketSubscribe(broker, NewStatsTracker()))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"?empty=true", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+
+	control := func(msg SubscribeControl) map[string]any {
+		if err := wsjson.Write(ctx, conn, msg); err != nil {
+			t.Fatal(err)
+		}
+		var reply map[string]any
+		if err := wsjson.Read(ctx, conn, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	// make sure the subscription is set up before publishing.
+	if reply := control(SubscribeControl{Op: "ping"}); reply["op"] != "pong" {
+		t.Fatalf("expected pong, got %v", reply)
+	}
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(1000), Name: "bms_soc", Data: &skylab.BmsSoc{}})
+	// nothing was subscribed, so the pong comes before any packet.
+	if reply := control(SubscribeControl{Op: "ping"}); reply["op"] != "pong" {
+		t.Fatalf("expected no packets before subscribing, got %v", reply)
+	}
+	if reply := control(SubscribeControl{Op: "subscribe", Names: []string{"bms_soc"}}); reply["op"] != "ok" {
+		t.Fatalf("expected ok, got %v", reply)
+	}
+	broker.Publish("test", skylab.BusEvent{Timestamp: time.UnixMilli(2000), Name: "bms_soc", Data: &skylab.BmsSoc{}})
+	var msg map[string]any
+	if err := wsjson.Read(ctx, conn, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg["name"] != "bms_soc" || msg["ts"] != 2000.0 {
+		t.Fatalf("expected the subscribed packet, got %v", msg)
+	}
+}
+
+func Test_ApiV1PacketSubscribeBinary(t *testing.T) {
+	broker := NewBroker(10, slog.Default())
+	srv := httptest.NewServer(apiV1PacketSubscribe(broker, NewStatsTracker()))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"?format=binary", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.CloseNow()
+
+	// replies are still JSON.
+	if err := wsjson.Write(ctx, conn, SubscribeControl{Op: "subscribe", Fields: []string{"bms_measurement.current"}}); err != nil {
+		t.Fatal(err)
+	}
+	typ, _, err := conn.Read(ctx)
+	if err != nil || typ != websocket.MessageText {
+		t.Fatalf("expected a text reply, got %v %v", typ, err)
+	}
+
+	ev := skylab.BusEvent{Timestamp: time.UnixMilli(1000), Name: "bms_measurement", Data: &skylab.BmsMeasurement{BatteryVoltage: 1, Current: 2}}
+	broker.Publish("test", ev)
+	typ, b, err := conn.Read(ctx)
+	if err != nil || typ != websocket.MessageBinary {
+		t.Fatalf("expected a binary message, got %v %v", typ, err)
+	}
+	var got skylab.BusEvent
+	if err := got.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	// binary messages are the whole packet.
+	if m, ok := got.Data.(*skylab.BmsMeasurement); !ok || *m != *ev.Data.(*skylab.BmsMeasurement) {
+		t.Fatalf("unexpected packet %+v", got)
+	}
+}
+
+func Test_ApiV1Stats(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	broker := NewBroker(1, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	tracker := NewStatsTracker()
+	r := TelemRouter(slog.Default(), broker, tdb, tracker)
+
+	if _, err := broker.Subscribe("slow"); err != nil {
+		t.Fatal(err)
+	}
+	evs := GetSeedEvents()
+	// the subscriber can only hold one, so the rest are dropped.
+	for _, ev := range evs[:3] {
+		broker.Publish("test", ev)
+	}
+	if _, err := tdb.AddEvents(evs...); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tdb.AddRawFramesCtx(context.Background(), NewRawFrame(time.Now(), can.Frame{Id: can.CanID{Id: 0x10}}, "can0")); err != nil {
+		t.Fatal(err)
+	}
+	tracker.RegisterStatus("test", func() any { return map[string]string{"state": "ok"} })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil))
+	resp := w.Result()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("incorrect status code: expected %d got %d", http.StatusOK, resp.StatusCode)
+	}
+	var stats ServerStats
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("could not parse JSON response: %v", err)
+	}
+
+	if stats.Uptime <= 0 || stats.Started.IsZero() {
+		t.Errorf("bad uptime %v since %v", stats.Uptime, stats.Started)
+	}
+	if stats.Http.Requests == 0 || stats.Http.Active == 0 {
+		t.Errorf("the stats request wasn't counted: %+v", stats.Http)
+	}
+	if stats.Broker.Subscribers != 1 || stats.Broker.Dropped != 2 || stats.Broker.Clients[0].Dropped != 2 {
+		t.Errorf("wrong subscriber stats: %+v", stats.Broker)
+	}
+	var published uint64
+	for _, p := range stats.Broker.Packets {
+		published += p.Count
+	}
+	if published != 3 {
+		t.Errorf("expected 3 packets counted, got %+v", stats.Broker.Packets)
+	}
+	if stats.Db == nil {
+		t.Fatalf("no db stats: %s", stats.DbError)
+	}
+	if stats.Db.Rows["bus_events"] != int64(len(evs)) || stats.Db.Rows["raw_frames"] != 1 {
+		t.Errorf("wrong row counts: %+v", stats.Db.Rows)
+	}
+	if stats.Db.Events.Batches != 1 || stats.Db.Events.Rows != uint64(len(evs)) || stats.Db.Frames.Rows != 1 {
+		t.Errorf("wrong write stats: %+v %+v", stats.Db.Events, stats.Db.Frames)
+	}
+	// the tracker is only this router's, so nothing else is registered.
+	if len(stats.Services) != 1 || !reflect.DeepEqual(stats.Services["test"], map[string]any{"state": "ok"}) {
+		t.Errorf("missing service status: %+v", stats.Services)
+	}
+
+	// the drops of a subscriber that left are still counted, and the rows
+	// aren't counted again right away.
+	broker.Unsubscribe("slow")
+	if _, err := tdb.AddEvents(evs[0]); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/stats", nil))
+	var again ServerStats
+	if err := json.NewDecoder(w.Result().Body).Decode(&again); err != nil {
+		t.Fatalf("could not parse JSON response: %v", err)
+	}
+	if again.Broker.Subscribers != 0 || again.Broker.Dropped != 2 {
+		t.Errorf("wrong subscriber stats after unsubscribing: %+v", again.Broker)
+	}
+	if again.Db == nil || !again.Db.RowsAt.Equal(stats.Db.RowsAt) || again.Db.Rows["bus_events"] != int64(len(evs)) {
+		t.Errorf("expected the cached row counts, got %+v", again.Db)
+	}
+}
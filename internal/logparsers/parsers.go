@@ -168,25 +168,38 @@ func parseSkylabifyLogLine(input string) (skylab.BusEvent, error) {
 	return b, err
 }
 
+// FrameToBusEvent decodes a can frame received at ts into a bus event.
+func FrameToBusEvent(frame can.Frame, ts time.Time) (skylab.BusEvent, error) {
+	var b = skylab.BusEvent{}
+	b.Timestamp = ts
+	var err error
+	b.Data, err = skylab.FromCanFrame(frame)
+	if err != nil {
+		return b, err
+	}
+	b.Name = b.Data.String()
+	return b, nil
+}
+
 // frameParseToBusEvent takes a line parser (that returns a can frame)
 // and makes it return a busEvent instead.
 func frameParseToBusEvent(fun CanFrameParser) BusEventParser {
 	return func(s string) (skylab.BusEvent, error) {
-		var b = skylab.BusEvent{}
 		frame, ts, err := fun(s)
 		if err != nil {
-			return b, err
+			return skylab.BusEvent{}, err
 		}
-		b.Timestamp = ts
-		b.Data, err = skylab.FromCanFrame(frame)
-		if err != nil {
-			return b, err
-		}
-		b.Name = b.Data.String()
-		return b, nil
+		return FrameToBusEvent(frame, ts)
 	}
 }
 
+// FrameParsersMap has the formats that contain raw can frames, so the frames
+// can be kept before they're decoded.
+var FrameParsersMap = map[string]CanFrameParser{
+	"telem":   parseTelemLogLine,
+	"candump": parseCanDumpLine,
+}
+
 var ParsersMap = map[string]BusEventParser{
 	"telem":   frameParseToBusEvent(parseTelemLogLine),
 	"candump": frameParseToBusEvent(parseCanDumpLine),
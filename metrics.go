@@ -0,0 +1,325 @@
+package gotelem
+
+// this file implements /metrics, which exports the server stats in the
+// Prometheus text format, so a Prometheus server can scrape the car. Some
+// skylab fields can be exported too, as gauges of their latest value.
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var (
+	metricsLock   sync.RWMutex
+	metricsFields []*DomainObject
+)
+
+// SetMetricsFields sets the skylab values that /metrics exports. The keys are
+// dictionary keys, so they can be a single value (bms_measurement.current), a
+// packet (bms_measurement), or a folder like a single index of a repeated
+// packet (bms_module.3).
+func SetMetricsFields(keys []string) error {
+	dict, err := compiledDictionary()
+	if err != nil {
+		return err
+	}
+	objs, err := metricDatums(dict, keys)
+	if err != nil {
+		return err
+	}
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	metricsFields = objs
+	return nil
+}
+
+// metricDatums gets every telemetry object under the keys.
+func metricDatums(dict *Dictionary, keys []string) ([]*DomainObject, error) {
+	res := make([]*DomainObject, 0)
+	seen := make(map[string]bool)
+	var walk func(o *DomainObject)
+	walk = func(o *DomainObject) {
+		if seen[o.Identifier.Key] {
+			return
+		}
+		seen[o.Identifier.Key] = true
+		if o.Datum != nil {
+			res = append(res, o)
+			return
+		}
+		for _, c := range o.Composition {
+			if child, ok := dict.Object(c.Key); ok {
+				walk(child)
+			}
+		}
+	}
+	for _, key := range keys {
+		o, ok := dict.Object(key)
+		if !ok {
+			return nil, fmt.Errorf("unknown dictionary key %q", key)
+		}
+		walk(o)
+	}
+	return res, nil
+}
+
+// metricsWriter writes the Prometheus text format.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// family starts a metric. Every sample of it must be written before the
+// next family.
+func (m *metricsWriter) family(name, typ, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+	fmt.Fprintf(m.w, "# TYPE %s %s\n", name, typ)
+}
+
+// sample writes a value. labels are name, value pairs.
+func (m *metricsWriter) sample(name string, v float64, labels ...string) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			fmt.Fprintf(m.w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		m.w.WriteByte('}')
+	}
+	m.w.WriteByte(' ')
+	m.w.WriteString(formatMetric(v))
+	m.w.WriteByte('\n')
+}
+
+func formatMetric(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func unixSeconds(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
+
+// writeServerMetrics writes the server internals.
+func writeServerMetrics(m *metricsWriter, broker *Broker, tdb *TelemDb, stats *StatsTracker) {
+	m.family("gotelem_start_time_seconds", "gauge", "Start time of the server since the unix epoch.")
+	m.sample("gotelem_start_time_seconds", unixSeconds(stats.started))
+	m.family("gotelem_uptime_seconds", "gauge", "How long the server has been running.")
+	m.sample("gotelem_uptime_seconds", time.Since(stats.started).Seconds())
+
+	hs := stats.httpStats()
+	m.family("gotelem_http_requests_total", "counter", "HTTP requests by status class.")
+	classes := make([]string, 0, len(hs.ByStatus))
+	for class := range hs.ByStatus {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		m.sample("gotelem_http_requests_total", float64(hs.ByStatus[class]), "code", class)
+	}
+	m.family("gotelem_http_active_requests", "gauge", "HTTP requests in progress, including websockets.")
+	m.sample("gotelem_http_active_requests", float64(hs.Active))
+	m.family("gotelem_websocket_clients", "gauge", "Connected websocket clients by endpoint.")
+	endpoints := make([]string, 0, len(hs.Websockets))
+	for ep := range hs.Websockets {
+		endpoints = append(endpoints, ep)
+	}
+	sort.Strings(endpoints)
+	for _, ep := range endpoints {
+		m.sample("gotelem_websocket_clients", float64(hs.Websockets[ep]), "endpoint", ep)
+	}
+
+	subs := broker.Stats()
+	delivered, dropped := broker.Totals()
+	m.family("gotelem_broker_subscribers", "gauge", "Subscribers of the broker.")
+	m.sample("gotelem_broker_subscribers", float64(len(subs)))
+	m.family("gotelem_broker_delivered_total", "counter", "Events delivered to every subscriber, including ones that left.")
+	m.sample("gotelem_broker_delivered_total", float64(delivered))
+	m.family("gotelem_broker_dropped_total", "counter", "Events dropped for every subscriber, including ones that left.")
+	m.sample("gotelem_broker_dropped_total", float64(dropped))
+	// every websocket client is a subscriber with a random name, so these are
+	// by policy to keep the number of series small.
+	queued := make(map[string]int)
+	for _, s := range subs {
+		queued[s.Policy] += s.Queued
+	}
+	policies := make([]string, 0, len(queued))
+	for p := range queued {
+		policies = append(policies, p)
+	}
+	sort.Strings(policies)
+	m.family("gotelem_broker_queued", "gauge", "Events waiting to be read by subscribers, by overflow policy.")
+	for _, p := range policies {
+		m.sample("gotelem_broker_queued", float64(queued[p]), "policy", p)
+	}
+
+	pkts := broker.PacketStats()
+	m.family("gotelem_packets_received_total", "counter", "Packets published to the broker by name.")
+	for _, p := range pkts {
+		m.sample("gotelem_packets_received_total", float64(p.Count), "packet", p.Name)
+	}
+	m.family("gotelem_packet_last_received_seconds", "gauge", "When a packet was last published, since the unix epoch.")
+	for _, p := range pkts {
+		m.sample("gotelem_packet_last_received_seconds", unixSeconds(p.Last), "packet", p.Name)
+	}
+
+	writes := tdb.writeTimings()
+	tables := make([]string, 0, len(writes))
+	for table := range writes {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	m.family("gotelem_db_insert_duration_seconds", "summary", "Time taken by database insert transactions.")
+	for _, t := range tables {
+		m.sample("gotelem_db_insert_duration_seconds_sum", writes[t].TotalMs/1000, "table", t)
+		m.sample("gotelem_db_insert_duration_seconds_count", float64(writes[t].Batches), "table", t)
+	}
+	m.family("gotelem_db_insert_last_duration_seconds", "gauge", "Time taken by the last insert transaction.")
+	for _, t := range tables {
+		m.sample("gotelem_db_insert_last_duration_seconds", writes[t].LastMs/1000, "table", t)
+	}
+	m.family("gotelem_db_insert_rows_total", "counter", "Rows inserted into the database.")
+	for _, t := range tables {
+		m.sample("gotelem_db_insert_rows_total", float64(writes[t].Rows), "table", t)
+	}
+	m.family("gotelem_db_insert_errors_total", "counter", "Insert transactions that failed.")
+	for _, t := range tables {
+		m.sample("gotelem_db_insert_errors_total", float64(writes[t].Errors), "table", t)
+	}
+}
+
+// fieldMetricName is the metric of a telemetry object. Indexes are a label,
+// so every index of a repeated packet is in the same metric.
+func fieldMetricName(d *DictionaryDatum) string {
+	name := "skylab_" + d.Packet + "_" + d.Field
+	if d.Bit != "" {
+		name += "_" + d.Bit
+	}
+	// skylab names are snake case already, but make sure.
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func metricFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	}
+	return datumFloat(v)
+}
+
+// writeFieldMetrics writes the latest value of the objects that the broker
+// has seen.
+func writeFieldMetrics(m *metricsWriter, broker *Broker, objs []*DomainObject) {
+	type family struct {
+		help    string
+		samples []TelemetryPoint
+	}
+	families := make(map[string]*family)
+	order := make([]string, 0)
+	byKey := make(map[string]string) // object key to metric name.
+	byPacket := make(map[string][]*DomainObject)
+	for _, o := range objs {
+		name := fieldMetricName(o.Datum)
+		byKey[o.Identifier.Key] = name
+		byPacket[o.Datum.Packet] = append(byPacket[o.Datum.Packet], o)
+		if _, ok := families[name]; ok {
+			continue
+		}
+		help := fmt.Sprintf("Latest value of %s.%s", o.Datum.Packet, o.Datum.path())
+		if units := o.Telemetry.Values[0].Units; units != "" {
+			help += " in " + units
+		}
+		families[name] = &family{help: help + "."}
+		order = append(order, name)
+	}
+
+	latest := broker.latestMatching(func(ev skylab.BusEvent) bool {
+		_, ok := byPacket[ev.Name]
+		return ok
+	})
+	idxOf := make(map[string]string)
+	for _, ev := range latest {
+		for _, p := range eventPoints(byPacket[ev.Name], ev) {
+			f := families[byKey[p.Key]]
+			f.samples = append(f.samples, p)
+			if idx, ok := packetIndex(ev.Data); ok {
+				idxOf[p.Key] = strconv.Itoa(idx)
+			}
+		}
+	}
+
+	for _, name := range order {
+		f := families[name]
+		if len(f.samples) == 0 {
+			continue
+		}
+		m.family(name, "gauge", f.help)
+		for _, p := range f.samples {
+			v, ok := metricFloat(p.Value)
+			if !ok {
+				continue
+			}
+			if idx, ok := idxOf[p.Key]; ok {
+				m.sample(name, v, "idx", idx)
+			} else {
+				m.sample(name, v)
+			}
+		}
+	}
+}
+
+// metricsHandler serves /metrics. The field query parameter picks the skylab
+// values to export instead of the ones from SetMetricsFields.
+func metricsHandler(broker *Broker, tdb *TelemDb, stats *StatsTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		metricsLock.RLock()
+		objs := metricsFields
+		metricsLock.RUnlock()
+		if keys := r.URL.Query()["field"]; len(keys) > 0 {
+			dict, err := compiledDictionary()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			objs, err = metricDatums(dict, keys)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", metricsContentType)
+		m := &metricsWriter{w: bufio.NewWriter(w)}
+		writeServerMetrics(m, broker, tdb, stats)
+		writeFieldMetrics(m, broker, objs)
+		m.w.Flush()
+	}
+}
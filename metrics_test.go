@@ -0,0 +1,168 @@
+package gotelem
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+func TestMetrics(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	broker := NewBroker(1, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	r := TelemRouter(slog.Default(), broker, tdb, NewStatsTracker())
+
+	for _, idx := range []uint32{3, 4} {
+		broker.Publish("test", skylab.BusEvent{
+			Timestamp: time.Now(),
+			Name:      "bms_module",
+			Data:      &skylab.BmsModule{Voltage: 3.5, Temperature: float32(20 + idx), Idx: idx},
+		})
+	}
+	if _, err := tdb.AddEvents(makeEvent()); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(t *testing.T, path string) (int, string) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		resp := w.Result()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// checkFormat makes sure that every line is a comment or a sample, and
+	// that the samples of a metric aren't split up.
+	checkFormat := func(t *testing.T, body string) {
+		seen := make(map[string]bool)
+		cur := ""
+		for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+			if strings.HasPrefix(line, "# ") {
+				continue
+			}
+			name, _, ok := strings.Cut(line, " ")
+			if !ok {
+				t.Fatalf("bad line %q", line)
+			}
+			name, _, _ = strings.Cut(name, "{")
+			name = strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_count")
+			if name != cur {
+				if seen[name] {
+					t.Fatalf("samples of %s are split up", name)
+				}
+				seen[name] = true
+				cur = name
+			}
+		}
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		statusCode int
+		want       []string
+		notWant    []string
+	}{
+		{
+			name:       "server",
+			path:       "/metrics",
+			statusCode: http.StatusOK,
+			want: []string{
+				"# TYPE gotelem_uptime_seconds gauge",
+				`gotelem_packets_received_total{packet="bms_module"} 2`,
+				"gotelem_broker_subscribers 0",
+				`gotelem_db_insert_rows_total{table="bus_events"} 1`,
+				`gotelem_db_insert_duration_seconds_count{table="bus_events"} 1`,
+			},
+			notWant: []string{"skylab_"},
+		},
+		{
+			name:       "whole packet",
+			path:       "/metrics?field=bms_module",
+			statusCode: http.StatusOK,
+			want: []string{
+				"# TYPE skylab_bms_module_voltage gauge",
+				`skylab_bms_module_voltage{idx="3"} 3.5`,
+				`skylab_bms_module_temperature{idx="3"} 23`,
+				`skylab_bms_module_temperature{idx="4"} 24`,
+			},
+		},
+		{
+			name:       "one index",
+			path:       "/metrics?field=bms_module.4.temperature",
+			statusCode: http.StatusOK,
+			want:       []string{`skylab_bms_module_temperature{idx="4"} 24`},
+			notWant:    []string{`idx="3"`, "skylab_bms_module_voltage"},
+		},
+		{
+			// nothing has been received, so there's nothing to export.
+			name:       "no value",
+			path:       "/metrics?field=wsl_velocity",
+			statusCode: http.StatusOK,
+			notWant:    []string{"skylab_"},
+		},
+		{
+			name:       "unknown field",
+			path:       "/metrics?field=bms_module.nope",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := get(t, tt.path)
+			if code != tt.statusCode {
+				t.Fatalf("incorrect status code: expected %d got %d: %s", tt.statusCode, code, body)
+			}
+			if code != http.StatusOK {
+				return
+			}
+			checkFormat(t, body)
+			for _, w := range tt.want {
+				if !strings.Contains(body, w+"\n") {
+					t.Errorf("missing %q in:\n%s", w, body)
+				}
+			}
+			for _, nw := range tt.notWant {
+				if strings.Contains(body, nw) {
+					t.Errorf("unexpected %q in:\n%s", nw, body)
+				}
+			}
+		})
+	}
+
+	t.Run("subscribers by policy", func(t *testing.T) {
+		if _, err := broker.Subscribe("127.0.0.1:1234-client", WithOverflowPolicy(Coalesce)); err != nil {
+			t.Fatal(err)
+		}
+		defer broker.Unsubscribe("127.0.0.1:1234-client")
+		broker.Publish("test", makeEvent())
+		_, body := get(t, "/metrics")
+		checkFormat(t, body)
+		if !strings.Contains(body, `gotelem_broker_queued{policy="coalesce"} 1`+"\n") {
+			t.Errorf("missing the queued events:\n%s", body)
+		}
+		if strings.Contains(body, "1234-client") {
+			t.Errorf("subscriber names shouldn't be labels:\n%s", body)
+		}
+	})
+
+	t.Run("configured fields", func(t *testing.T) {
+		if err := SetMetricsFields([]string{"bms_module.3.voltage"}); err != nil {
+			t.Fatal(err)
+		}
+		defer SetMetricsFields(nil)
+		_, body := get(t, "/metrics")
+		if !strings.Contains(body, `skylab_bms_module_voltage{idx="3"} 3.5`) {
+			t.Errorf("configured field is missing:\n%s", body)
+		}
+		if err := SetMetricsFields([]string{"nope"}); err == nil {
+			t.Error("expected an error for an unknown key")
+		}
+	})
+}
@@ -1,14 +1,19 @@
 package gotelem
 
 import (
+	"crypto/sha256"
+	"database/sql"
 	"embed"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"path"
 	"regexp"
 	"sort"
 	"strconv"
+	"time"
 )
 
 // embed the migrations into applications so they can update databases.
@@ -24,24 +29,223 @@ type Migration struct {
 	FileName string
 }
 
+// MigrationStep is a single migration applied in one direction.
+type MigrationStep struct {
+	Migration
+	Direction string // "up" or "down"
+}
+
+// MigrationError is returned when a migration step fails. The database is
+// left at the version before the failing step.
 type MigrationError struct {
+	Version   int
+	Direction string
+	Err       error
+}
+
+func (e *MigrationError) Error() string {
+	return fmt.Sprintf("migration %d (%s) failed: %v", e.Version, e.Direction, e.Err)
+}
+
+func (e *MigrationError) Unwrap() error {
+	return e.Err
+}
+
+// MigrationDriftError is returned when migrations that were already applied
+// to the database don't match the ones embedded in the program.
+type MigrationDriftError struct {
+	Drift []MigrationDrift
+}
+
+func (e *MigrationDriftError) Error() string {
+	d := e.Drift[0]
+	msg := fmt.Sprintf("migration %d (%s) changed since it was applied", d.Version, d.Name)
+	if len(e.Drift) > 1 {
+		msg += fmt.Sprintf(", and %d others", len(e.Drift)-1)
+	}
+	return msg
+}
+
+// AppliedMigration is a row of the migration history.
+type AppliedMigration struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time // nil if it was applied before the history was kept.
+	Checksum  string
+}
+
+// MigrationDrift is an applied migration whose SQL is different from the
+// embedded migration with the same version.
+type MigrationDrift struct {
+	Version  int
+	Name     string
+	Applied  string // checksum when it was applied
+	Embedded string // checksum of the embedded migration
+}
+
+// the history table is managed by the migration runner rather than by a
+// migration, since it needs to exist to record the migrations themselves.
+const sqlMigrationHistory = `CREATE TABLE IF NOT EXISTS "migration_history" (
+	"version"	INTEGER NOT NULL PRIMARY KEY,
+	"name"	TEXT NOT NULL,
+	"applied_at"	INTEGER, -- unix milliseconds, NULL if it was applied before history was kept.
+	"checksum"	TEXT NOT NULL -- sha256 of the up migration, hex encoded.
+)`
+
+func migrationChecksum(stmt []byte) string {
+	sum := sha256.Sum256(stmt)
+	return hex.EncodeToString(sum[:])
+}
+
+func readMigration(m Migration) ([]byte, error) {
+	f, err := migrationsFs.Open(path.Join("migrations", m.FileName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// ensureHistory creates the history table, and fills in migrations that were
+// applied before it existed. Those get the checksum of the embedded migration,
+// since there's no way to know what was actually run.
+func ensureHistory(tdb *TelemDb, migrations map[int]map[string]Migration) error {
+	if _, err := tdb.db.Exec(sqlMigrationHistory); err != nil {
+		return err
+	}
+	current, err := tdb.GetVersion()
+	if err != nil {
+		return err
+	}
+	for v := 1; v <= current; v++ {
+		m, ok := migrations[v]["up"]
+		if !ok {
+			// the database is newer than us.
+			break
+		}
+		stmt, err := readMigration(m)
+		if err != nil {
+			return err
+		}
+		_, err = tdb.db.Exec(`INSERT OR IGNORE INTO "migration_history" (version, name, applied_at, checksum) VALUES (?, ?, NULL, ?)`,
+			v, m.Name, migrationChecksum(stmt))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetMigrationHistory returns the migrations applied to the database, oldest first.
+func GetMigrationHistory(tdb *TelemDb) ([]AppliedMigration, error) {
+	migrations, err := getMigrations(migrationsFs)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureHistory(tdb, migrations); err != nil {
+		return nil, err
+	}
+	return readHistory(tdb)
+}
+
+// ReadMigrationHistory is GetMigrationHistory without changing the database.
+// If the history table doesn't exist yet it returns nothing, since the
+// migrations from before it aren't filled in.
+func ReadMigrationHistory(tdb *TelemDb) ([]AppliedMigration, error) {
+	var n int
+	err := tdb.db.Get(&n, `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'migration_history'`)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return make([]AppliedMigration, 0), nil
+	}
+	return readHistory(tdb)
+}
+
+func readHistory(tdb *TelemDb) ([]AppliedMigration, error) {
+	rows, err := tdb.db.Query(`SELECT version, name, applied_at, checksum FROM "migration_history" ORDER BY version ASC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]AppliedMigration, 0)
+	for rows.Next() {
+		var m AppliedMigration
+		var appliedAt sql.NullInt64
+		if err := rows.Scan(&m.Version, &m.Name, &appliedAt, &m.Checksum); err != nil {
+			return nil, err
+		}
+		if appliedAt.Valid {
+			t := time.UnixMilli(appliedAt.Int64)
+			m.AppliedAt = &t
+		}
+		res = append(res, m)
+	}
+	return res, rows.Err()
+}
+
+// CheckMigrations compares the migration history with the embedded
+// migrations, and returns the ones that have been changed since they were
+// applied.
+func CheckMigrations(tdb *TelemDb) ([]MigrationDrift, error) {
+	history, err := GetMigrationHistory(tdb)
+	if err != nil {
+		return nil, err
+	}
+	return CheckMigrationHistory(history)
+}
+
+// CheckMigrationHistory is CheckMigrations for a history that was already
+// read, like from ReadMigrationHistory.
+func CheckMigrationHistory(history []AppliedMigration) ([]MigrationDrift, error) {
+	migrations, err := getMigrations(migrationsFs)
+	if err != nil {
+		return nil, err
+	}
+	drift := make([]MigrationDrift, 0)
+	for _, applied := range history {
+		m, ok := migrations[applied.Version]["up"]
+		if !ok {
+			continue
+		}
+		stmt, err := readMigration(m)
+		if err != nil {
+			return nil, err
+		}
+		if sum := migrationChecksum(stmt); sum != applied.Checksum {
+			drift = append(drift, MigrationDrift{
+				Version:  applied.Version,
+				Name:     applied.Name,
+				Applied:  applied.Checksum,
+				Embedded: sum,
+			})
+		}
+	}
+	return drift, nil
 }
 
 // getMigrations returns a list of migrations, which are correctly index. zero is nil.
-func getMigrations(files fs.FS) map[int]map[string]Migration {
+func getMigrations(files fs.FS) (map[int]map[string]Migration, error) {
 
 	res := make(map[int]map[string]Migration) // version number -> direction -> migration.
 
-	fs.WalkDir(files, ".", func(path string, d fs.DirEntry, err error) error {
+	err := fs.WalkDir(files, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
 
 		if d.IsDir() {
 			return nil
 		}
 		m := migrationRegex.FindStringSubmatch(d.Name())
 		if len(m) != 4 {
-			panic("error parsing migration name")
+			return fmt.Errorf("error parsing migration name %q", d.Name())
+		}
+		migrationVer, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("error parsing migration version %q: %w", d.Name(), err)
 		}
-		migrationVer, _ := strconv.ParseInt(m[1], 10, 64)
 
 		mig := Migration{
 			Name:     m[2],
@@ -60,79 +264,168 @@ func getMigrations(files fs.FS) map[int]map[string]Migration {
 
 		return nil
 	})
-	return res
+	return res, err
 }
 
-func RunMigrations(tdb *TelemDb) (finalVer int, err error) {
-
-	currentVer, err := tdb.GetVersion()
-	if err != nil {
-		return
-	}
-
-	migrations := getMigrations(migrationsFs)
-
+// latestVersion checks that there are no gaps in the migrations and returns
+// the highest version.
+func latestVersion(migrations map[int]map[string]Migration) (int, error) {
 	// get a sorted list of versions.
-	vers := make([]int, len(migrations))
-
-	i := 0
+	vers := make([]int, 0, len(migrations))
 	for k := range migrations {
-		vers[i] = k
-		i++
+		vers = append(vers, k)
 	}
 	sort.Ints(vers)
-	expectedVer := 1
 
 	// check to make sure that there are no gaps (increasing by one each time)
-	for _, v := range vers {
-		if v != expectedVer {
-			err = errors.New("missing update between")
-			return 0, err
-			// invalid
+	for i, v := range vers {
+		if v != i+1 {
+			return 0, fmt.Errorf("missing migration for version %d", i+1)
 		}
-		expectedVer = v + 1
 	}
+	return len(vers), nil
+}
 
-	finalVer = vers[len(vers)-1]
-	// now apply the mappings based on current ver.
-
-	tx, err := tdb.db.Begin()
-	defer tx.Rollback()
+// LatestMigration is the version of the newest migration embedded in the program.
+func LatestMigration() (int, error) {
+	migrations, err := getMigrations(migrationsFs)
 	if err != nil {
 		return 0, err
 	}
-	for v := currentVer + 1; v <= finalVer; v++ {
-		// attempt to get the "up" migration.
-		mMap, ok := migrations[v]
+	return latestVersion(migrations)
+}
+
+// PlanMigrations returns the steps needed to go from the current version of
+// the database to the target, in the order they would be applied.
+func PlanMigrations(tdb *TelemDb, target int) ([]MigrationStep, error) {
+	currentVer, err := tdb.GetVersion()
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := getMigrations(migrationsFs)
+	if err != nil {
+		return nil, err
+	}
+	return planMigrations(migrations, currentVer, target)
+}
+
+func planMigrations(migrations map[int]map[string]Migration, current, target int) ([]MigrationStep, error) {
+	latest, err := latestVersion(migrations)
+	if err != nil {
+		return nil, err
+	}
+	if target < 0 || target > latest {
+		return nil, fmt.Errorf("target version %d out of range 0-%d", target, latest)
+	}
+
+	steps := make([]MigrationStep, 0)
+	// going up applies current+1 ... target, going down undoes current ... target+1.
+	for v := current + 1; v <= target; v++ {
+		m, ok := migrations[v]["up"]
 		if !ok {
-			err = errors.New("could not find migration for version")
-			return 0, err
+			return nil, &MigrationError{Version: v, Direction: "up", Err: errors.New("could not get up migration")}
 		}
-		upMigration, ok := mMap["up"]
+		steps = append(steps, MigrationStep{Migration: m, Direction: "up"})
+	}
+	for v := current; v > target; v-- {
+		m, ok := migrations[v]["down"]
 		if !ok {
-			err = errors.New("could not get up migration")
-			return 0, err
-		}
-		upFile, err := migrationsFs.Open(path.Join("migrations", upMigration.FileName))
-		if err != nil {
-			return 0, err
+			return nil, &MigrationError{Version: v, Direction: "down", Err: errors.New("could not get down migration")}
 		}
+		steps = append(steps, MigrationStep{Migration: m, Direction: "down"})
+	}
+	return steps, nil
+}
 
-		upStmt, err := io.ReadAll(upFile)
-		if err != nil {
-			return 0, err
-		}
-		// open the file name
-		// execute the file.
-		_, err = tx.Exec(string(upStmt))
-		if err != nil {
-			return 0, err
-		}
+// applyMigration runs a single step and updates the user_version and history
+// in the same transaction, so a failed step doesn't leave the database
+// half-migrated.
+func applyMigration(tdb *TelemDb, step MigrationStep) error {
+	ver := int(step.Version)
+	newVer := ver
+	if step.Direction == "down" {
+		newVer = ver - 1
+	}
+	wrap := func(err error) error {
+		return &MigrationError{Version: ver, Direction: step.Direction, Err: err}
+	}
 
+	stmt, err := readMigration(step.Migration)
+	if err != nil {
+		return wrap(err)
 	}
-	// if all the versions applied correctly, update the PRAGMA user_version in the database.
-	tx.Commit()
-	err = tdb.SetVersion(finalVer)
 
+	tx, err := tdb.db.Begin()
+	if err != nil {
+		return wrap(err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(string(stmt)); err != nil {
+		return wrap(err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", newVer)); err != nil {
+		return wrap(err)
+	}
+	if step.Direction == "up" {
+		_, err = tx.Exec(`INSERT OR REPLACE INTO "migration_history" (version, name, applied_at, checksum) VALUES (?, ?, ?, ?)`,
+			ver, step.Name, time.Now().UnixMilli(), migrationChecksum(stmt))
+	} else {
+		_, err = tx.Exec(`DELETE FROM "migration_history" WHERE version = ?`, ver)
+	}
+	if err != nil {
+		return wrap(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return wrap(err)
+	}
+	return nil
+}
+
+// MigrateTo moves the database up or down to the target version. It returns
+// the version the database ended up at, which is the last version that applied
+// successfully if there was an error.
+func MigrateTo(tdb *TelemDb, target int) (finalVer int, err error) {
+	finalVer, err = tdb.GetVersion()
+	if err != nil {
+		return
+	}
+	migrations, err := getMigrations(migrationsFs)
+	if err != nil {
+		return
+	}
+	if err = ensureHistory(tdb, migrations); err != nil {
+		return
+	}
+	steps, err := planMigrations(migrations, finalVer, target)
+	if err != nil {
+		return
+	}
+	for _, step := range steps {
+		if err = applyMigration(tdb, step); err != nil {
+			return
+		}
+		finalVer = int(step.Version)
+		if step.Direction == "down" {
+			finalVer--
+		}
+	}
 	return
 }
+
+// RunMigrations brings the database up to the latest version. Databases that
+// are newer than this program are left alone.
+func RunMigrations(tdb *TelemDb) (finalVer int, err error) {
+	currentVer, err := tdb.GetVersion()
+	if err != nil {
+		return
+	}
+	latest, err := LatestMigration()
+	if err != nil {
+		return 0, err
+	}
+	if currentVer >= latest {
+		return currentVer, nil
+	}
+	return MigrateTo(tdb, latest)
+}
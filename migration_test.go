@@ -2,6 +2,7 @@ package gotelem
 
 import (
 	"embed"
+	"errors"
 	"reflect"
 	"testing"
 )
@@ -50,7 +51,11 @@ func Test_getMigrations(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := getMigrations(testFs); !reflect.DeepEqual(got, tt.want) {
+			got, err := getMigrations(testFs)
+			if err != nil {
+				t.Fatalf("getMigrations() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("getMigrations() = %v, want %v", got, tt.want)
 			}
 		})
@@ -58,6 +63,10 @@ func Test_getMigrations(t *testing.T) {
 }
 
 func TestRunMigrations(t *testing.T) {
+	latest, err := LatestMigration()
+	if err != nil {
+		t.Fatal(err)
+	}
 	type args struct {
 		tdb *TelemDb
 	}
@@ -67,7 +76,16 @@ func TestRunMigrations(t *testing.T) {
 		wantFinalVer int
 		wantErr      bool
 	}{
-		// TODO: Add test cases.
+		{
+			name:         "fresh database",
+			args:         args{tdb: MakeMockDatabase(t.Name()+"fresh", WithAutoMigrate(false))},
+			wantFinalVer: latest,
+		},
+		{
+			name:         "already migrated",
+			args:         args{tdb: MakeMockDatabase(t.Name() + "migrated")},
+			wantFinalVer: latest,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -82,3 +100,182 @@ func TestRunMigrations(t *testing.T) {
 		})
 	}
 }
+
+func TestMigrateTo(t *testing.T) {
+	latest, err := LatestMigration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("down and up", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		// every down migration has to work, and undo everything.
+		for v := latest - 1; v >= 0; v-- {
+			got, err := MigrateTo(tdb, v)
+			if err != nil {
+				t.Fatalf("migrating down to %d: %v", v, err)
+			}
+			if got != v {
+				t.Fatalf("expected version %d, got %d", v, got)
+			}
+		}
+		var tables int
+		if err := tdb.db.Get(&tables, "SELECT count(*) FROM sqlite_schema WHERE name NOT LIKE 'sqlite_%' AND name != 'migration_history'"); err != nil {
+			t.Fatal(err)
+		}
+		if tables != 0 {
+			t.Fatalf("expected empty schema at version 0, got %d objects", tables)
+		}
+		if history, err := GetMigrationHistory(tdb); err != nil || len(history) != 0 {
+			t.Fatalf("expected empty history at version 0, got %v, %v", history, err)
+		}
+		got, err := MigrateTo(tdb, latest)
+		if err != nil || got != latest {
+			t.Fatalf("migrating back up: got %d, %v", got, err)
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		steps, err := PlanMigrations(tdb, latest-2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(steps) != 2 || steps[0].Version != uint(latest) || steps[0].Direction != "down" {
+			t.Fatalf("unexpected plan %v", steps)
+		}
+		if v, _ := tdb.GetVersion(); v != latest {
+			t.Fatalf("planning changed the version to %d", v)
+		}
+	})
+
+	t.Run("bad target", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		if _, err := MigrateTo(tdb, latest+1); err == nil {
+			t.Fatal("expected error for target past the latest version")
+		}
+	})
+
+	t.Run("failed step", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name(), WithAutoMigrate(false))
+		if _, err := MigrateTo(tdb, 1); err != nil {
+			t.Fatal(err)
+		}
+		// make migration 2 fail by creating its table first.
+		if _, err := tdb.db.Exec(`CREATE TABLE "drive_records" (id INTEGER)`); err != nil {
+			t.Fatal(err)
+		}
+		got, err := MigrateTo(tdb, latest)
+		var merr *MigrationError
+		if !errors.As(err, &merr) {
+			t.Fatalf("expected MigrationError, got %v", err)
+		}
+		if merr.Version != 2 || merr.Direction != "up" {
+			t.Errorf("wrong step in error: %v", merr)
+		}
+		if v, _ := tdb.GetVersion(); got != 1 || v != 1 {
+			t.Errorf("expected database to stay at version 1, got %d (returned %d)", v, got)
+		}
+	})
+}
+
+func TestMigrationHistory(t *testing.T) {
+	latest, err := LatestMigration()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("recorded", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		history, err := GetMigrationHistory(tdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != latest {
+			t.Fatalf("expected %d migrations in history, got %d", latest, len(history))
+		}
+		for i, m := range history {
+			if m.Version != i+1 || m.AppliedAt == nil || len(m.Checksum) != 64 {
+				t.Errorf("bad history entry %+v", m)
+			}
+		}
+		drift, err := CheckMigrations(tdb)
+		if err != nil || len(drift) != 0 {
+			t.Fatalf("expected no drift, got %v, %v", drift, err)
+		}
+	})
+
+	t.Run("backfill", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name(), WithAutoMigrate(false))
+		if _, err := MigrateTo(tdb, 3); err != nil {
+			t.Fatal(err)
+		}
+		// pretend this database is from before the history was kept.
+		if _, err := tdb.db.Exec(`DROP TABLE "migration_history"`); err != nil {
+			t.Fatal(err)
+		}
+		history, err := GetMigrationHistory(tdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) != 3 {
+			t.Fatalf("expected 3 backfilled migrations, got %d", len(history))
+		}
+		for _, m := range history {
+			if m.AppliedAt != nil {
+				t.Errorf("backfilled migration %d should have no applied time", m.Version)
+			}
+		}
+	})
+
+	t.Run("read only", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name(), WithAutoMigrate(false))
+		if _, err := MigrateTo(tdb, 3); err != nil {
+			t.Fatal(err)
+		}
+		history, err := ReadMigrationHistory(tdb)
+		if err != nil || len(history) != 3 {
+			t.Fatalf("expected 3 migrations in history, got %v, %v", history, err)
+		}
+		if _, err := tdb.db.Exec(`DROP TABLE "migration_history"`); err != nil {
+			t.Fatal(err)
+		}
+		history, err = ReadMigrationHistory(tdb)
+		if err != nil || len(history) != 0 {
+			t.Fatalf("expected no history, got %v, %v", history, err)
+		}
+		// it shouldn't have been put back.
+		var n int
+		if err := tdb.db.Get(&n, `SELECT COUNT(*) FROM sqlite_master WHERE name = 'migration_history'`); err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Fatal("migration history table was created")
+		}
+	})
+
+	t.Run("drift", func(t *testing.T) {
+		uri := mockDatabaseURI(t.Name())
+		tdb := openMockDatabase(uri)
+		if _, err := tdb.db.Exec(`UPDATE "migration_history" SET checksum = 'bad' WHERE version = 2`); err != nil {
+			t.Fatal(err)
+		}
+		drift, err := CheckMigrations(tdb)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(drift) != 1 || drift[0].Version != 2 || drift[0].Applied != "bad" {
+			t.Fatalf("unexpected drift %v", drift)
+		}
+
+		// the shared in-memory database stays open while tdb is.
+		if _, err := OpenRawDb(uri); err != nil {
+			t.Fatalf("expected non-strict open to succeed, got %v", err)
+		}
+		_, err = OpenRawDb(uri, WithStrictMigrations(true))
+		var derr *MigrationDriftError
+		if !errors.As(err, &derr) {
+			t.Fatalf("expected MigrationDriftError, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS "raw_import";
+DROP INDEX IF EXISTS "raw_ids_timestamped";
+DROP INDEX IF EXISTS "raw_times";
+DROP TABLE "raw_frames";
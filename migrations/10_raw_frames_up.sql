@@ -0,0 +1,15 @@
+-- raw_frames keeps every CAN frame as it was received, including ones that
+-- skylab can't decode, so data can be audited or decoded again later.
+CREATE TABLE "raw_frames" (
+	"ts"	INTEGER NOT NULL, -- timestamp, unix milliseconds
+	"id"	INTEGER NOT NULL, -- CAN id
+	"extended"	INTEGER NOT NULL DEFAULT 0, -- 1 if the id is extended (29 bit)
+	"kind"	INTEGER NOT NULL DEFAULT 0, -- frame kind, see can.Kind
+	"data"	BLOB NOT NULL,
+	"bus"	TEXT, -- the bus it was received on, NULL if unknown
+	"import_id"	INTEGER -- NULL if it didn't come from an import.
+);
+
+CREATE INDEX "raw_times" ON "raw_frames" ("ts" DESC);
+CREATE INDEX "raw_ids_timestamped" ON "raw_frames" ("id", "ts" DESC);
+CREATE INDEX "raw_import" ON "raw_frames" ("import_id") WHERE "import_id" IS NOT NULL;
@@ -0,0 +1 @@
+ALTER TABLE openmct_objects DROP COLUMN revision;
@@ -0,0 +1,3 @@
+-- revision counts updates to a document, so clients can't overwrite changes
+-- they haven't seen.
+ALTER TABLE openmct_objects ADD COLUMN revision INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1 @@
+DROP TABLE openmct_revisions;
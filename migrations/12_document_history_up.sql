@@ -0,0 +1,10 @@
+-- every revision of every openmct document, so broken layouts can be restored.
+-- revisions are kept when a document is deleted.
+CREATE TABLE openmct_revisions (
+	key TEXT NOT NULL,
+	revision INTEGER NOT NULL,
+	data TEXT NOT NULL,
+	saved_at INTEGER, -- unix milliseconds, NULL for revisions from before history was kept.
+	PRIMARY KEY (key, revision)
+);
+INSERT INTO openmct_revisions (key, revision, data, saved_at) SELECT key, revision, data, NULL FROM openmct_objects;
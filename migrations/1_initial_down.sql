@@ -1,3 +1,3 @@
+DROP INDEX IF EXISTS "times";
+DROP INDEX IF EXISTS "ids_timestamped";
 DROP TABLE "bus_events";
-DROP INDEX "ids_timestamped";
-DROP INDEX "times";
\ No newline at end of file
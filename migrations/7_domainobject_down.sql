@@ -1,2 +1,2 @@
+DROP INDEX IF EXISTS openmct_key;
 DROP TABLE openmct_objects;
-DROP INDEX openmct_key;
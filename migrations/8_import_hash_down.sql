@@ -0,0 +1,14 @@
+DROP INDEX IF EXISTS "bus_import";
+ALTER TABLE "bus_events" DROP COLUMN "import_id";
+
+DROP INDEX IF EXISTS "import_hash";
+CREATE TABLE "import_log_old" (
+	"filename"	TEXT NOT NULL,
+	"date"	TIMESTAMP NOT NULL,
+	"count"	INTEGER NOT NULL,
+	"start_time"	INTEGER NOT NULL,
+	"end_time"	INTEGER NOT NULL
+);
+INSERT INTO "import_log_old" SELECT filename, date, count, coalesce(start_time, 0), coalesce(end_time, 0) FROM "import_log";
+DROP TABLE "import_log";
+ALTER TABLE "import_log_old" RENAME TO "import_log";
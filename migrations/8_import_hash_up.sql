@@ -0,0 +1,20 @@
+-- import_log gets an id, so imported bus events can point back at their import,
+-- and a hash of the file contents, so the same log isn't imported twice.
+CREATE TABLE "import_log_new" (
+	"id"	INTEGER NOT NULL UNIQUE,
+	"filename"	TEXT NOT NULL,
+	"hash"	TEXT NOT NULL, -- sha256 of the file, hex encoded.
+	"date"	INTEGER NOT NULL, -- when the import happened, unix milliseconds
+	"count"	INTEGER NOT NULL DEFAULT 0, -- number of packets imported
+	"start_time"	INTEGER, -- first packet timestamp
+	"end_time"	INTEGER, -- last packet timestamp
+	PRIMARY KEY("id" AUTOINCREMENT)
+);
+INSERT INTO "import_log_new" (filename, hash, date, count, start_time, end_time)
+	SELECT filename, '', date, count, start_time, end_time FROM "import_log";
+DROP TABLE "import_log";
+ALTER TABLE "import_log_new" RENAME TO "import_log";
+CREATE INDEX "import_hash" ON "import_log" ("hash");
+
+ALTER TABLE "bus_events" ADD COLUMN "import_id" INTEGER; -- NULL if it didn't come from an import.
+CREATE INDEX "bus_import" ON "bus_events" ("import_id") WHERE "import_id" IS NOT NULL;
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS "bus_dedupe";
+ALTER TABLE "bus_events" DROP COLUMN "content_hash";
@@ -0,0 +1,4 @@
+-- content_hash identifies identical events (same name and data), so inserts can
+-- skip duplicates. It's NULL for events that were inserted without dedupe.
+ALTER TABLE "bus_events" ADD COLUMN "content_hash" INTEGER;
+CREATE UNIQUE INDEX "bus_dedupe" ON "bus_events" ("ts", "content_hash") WHERE "content_hash" IS NOT NULL;
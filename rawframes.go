@@ -0,0 +1,387 @@
+package gotelem
+
+// this file implements storing raw CAN frames, which are kept next to the
+// decoded bus events.
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/kschamplin/gotelem/internal/can"
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+// RawFrame is a CAN frame as it was received, before being decoded.
+type RawFrame struct {
+	Timestamp time.Time `json:"ts"`
+	Id        uint32    `json:"id"`
+	Extended  bool      `json:"extended"`
+	Kind      can.Kind  `json:"kind"`
+	Data      []byte    `json:"data"`
+	Bus       string    `json:"bus,omitempty"` // empty if unknown.
+}
+
+// NewRawFrame makes a RawFrame from a can frame.
+func NewRawFrame(ts time.Time, f can.Frame, bus string) RawFrame {
+	return RawFrame{
+		Timestamp: ts,
+		Id:        f.Id.Id,
+		Extended:  f.Id.Extended,
+		Kind:      f.Kind,
+		Data:      f.Data,
+		Bus:       bus,
+	}
+}
+
+// Frame gets the can frame back out of the raw frame.
+func (r RawFrame) Frame() can.Frame {
+	return can.Frame{
+		Id:   can.CanID{Id: r.Id, Extended: r.Extended},
+		Data: r.Data,
+		Kind: r.Kind,
+	}
+}
+
+// RawFrameFilter is a filter for raw frames.
+type RawFrameFilter struct {
+	StartTime time.Time
+	EndTime   time.Time
+	Ids       []uint32 // the CAN ids to get, all of them if empty.
+	Bus       string
+	DriveID   int // limits the time range to a drive, like BusEventFilter.
+}
+
+func (f *RawFrameFilter) sqlWhere() ([]string, []any) {
+	whereFrags := make([]string, 0)
+	args := make([]any, 0)
+	if !f.StartTime.IsZero() {
+		whereFrags = append(whereFrags, "ts >= ?")
+		args = append(args, f.StartTime.UnixMilli())
+	}
+	if !f.EndTime.IsZero() {
+		whereFrags = append(whereFrags, "ts <= ?")
+		args = append(args, f.EndTime.UnixMilli())
+	}
+	if len(f.Ids) > 0 {
+		whereFrags = append(whereFrags, "id IN ("+strings.TrimSuffix(strings.Repeat("?,", len(f.Ids)), ",")+")")
+		for _, id := range f.Ids {
+			args = append(args, id)
+		}
+	}
+	if f.Bus != "" {
+		whereFrags = append(whereFrags, "bus = ?")
+		args = append(args, f.Bus)
+	}
+	if f.DriveID != 0 {
+		whereFrags = append(whereFrags, sqlDriveRange)
+		args = append(args, f.DriveID, f.DriveID)
+	}
+	return whereFrags, args
+}
+
+// AddRawFramesCtx adds raw CAN frames to the database.
+func (tdb *TelemDb) AddRawFramesCtx(ctx context.Context, frames ...RawFrame) (int64, error) {
+	return tdb.addRawFrames(ctx, nil, frames)
+}
+
+// AddImportRawFramesCtx adds raw frames that came from an import, so they're
+// removed with DeleteImport.
+func (tdb *TelemDb) AddImportRawFramesCtx(ctx context.Context, importId int64, frames ...RawFrame) (int64, error) {
+	return tdb.addRawFrames(ctx, importId, frames)
+}
+
+func (tdb *TelemDb) addRawFrames(ctx context.Context, importId any, frames []RawFrame) (n int64, err error) {
+	if len(frames) == 0 {
+		return 0, nil
+	}
+	start := time.Now()
+	defer func() { tdb.frameWrites.record(start, n, err) }()
+	tx, err := tdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	// sqlite limits the number of variables in a statement, so big batches
+	// are split up.
+	const rowSql = "(?, ?, ?, ?, ?, ?, ?)"
+	const maxRows = 1000
+	for len(frames) > 0 {
+		chunk := frames[:min(len(frames), maxRows)]
+		frames = frames[len(chunk):]
+
+		inserts := make([]string, len(chunk))
+		vals := make([]any, 0, len(chunk)*7)
+		for i, f := range chunk {
+			inserts[i] = rowSql
+			var bus any
+			if f.Bus != "" {
+				bus = f.Bus
+			}
+			data := f.Data
+			if data == nil {
+				// the column is NOT NULL, frames with no data are empty blobs.
+				data = []byte{}
+			}
+			vals = append(vals, f.Timestamp.UnixMilli(), f.Id, f.Extended, f.Kind, data, bus, importId)
+		}
+		sqlStmt := `INSERT INTO "raw_frames" (ts, id, extended, kind, data, bus, import_id) VALUES ` + strings.Join(inserts, ",")
+		res, err := tx.ExecContext(ctx, sqlStmt, vals...)
+		if err != nil {
+			return 0, err
+		}
+		rows, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		n += rows
+	}
+	err = tx.Commit()
+	return
+}
+
+// StreamRawFrames calls fn for every raw frame that matches the filter, oldest
+// first. Returning ErrStopStream from fn stops early without an error.
+func (tdb *TelemDb) StreamRawFrames(ctx context.Context, filter RawFrameFilter, fn func(RawFrame) error) error {
+	whereFrags, args := filter.sqlWhere()
+	sb := strings.Builder{}
+	sb.WriteString(`SELECT ts, id, extended, kind, data, bus FROM "raw_frames"`)
+	if len(whereFrags) > 0 {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(strings.Join(whereFrags, " AND "))
+	}
+	sb.WriteString(" ORDER BY ts ASC, rowid ASC")
+
+	rows, err := tdb.db.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f RawFrame
+		var ts int64
+		var bus sql.NullString
+		if err := rows.Scan(&ts, &f.Id, &f.Extended, &f.Kind, &f.Data, &bus); err != nil {
+			return err
+		}
+		f.Timestamp = time.UnixMilli(ts)
+		f.Bus = bus.String
+		if err := fn(f); err != nil {
+			if errors.Is(err, ErrStopStream) {
+				return nil
+			}
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// GetRawFrames gets raw frames that match the filter, oldest first.
+func (tdb *TelemDb) GetRawFrames(ctx context.Context, filter RawFrameFilter, limit int) ([]RawFrame, error) {
+	res := make([]RawFrame, 0)
+	err := tdb.StreamRawFrames(ctx, filter, func(f RawFrame) error {
+		res = append(res, f)
+		if limit > 0 && len(res) >= limit {
+			return ErrStopStream
+		}
+		return nil
+	})
+	return res, err
+}
+
+// FrameDecoder turns a can frame into a packet, i.e skylab.FromCanFrame or
+// the FromCanFrame of a skylab.Decoder.
+type FrameDecoder func(can.Frame) (skylab.Packet, error)
+
+// RedecodeStats are the results of Redecode.
+type RedecodeStats struct {
+	Frames  int64 // raw frames that were read
+	Decoded int64 // bus events that were inserted
+	Unknown int64 // frames with ids the decoder doesn't know
+	Errors  int64 // frames that failed to decode
+	Removed int64 // bus events that were replaced
+}
+
+// redecodeKey is an event that a raw frame replaces.
+type redecodeKey struct {
+	ts       int64
+	name     string
+	idx      sql.NullInt64 // null for packets that aren't repeated.
+	importId sql.NullInt64
+}
+
+// redecodeWindow is the time range that Redecode does in each transaction,
+// so big redecodes don't have to fit in memory.
+const redecodeWindow = time.Minute
+
+// redecodeIdx gets the idx column of the event for a packet.
+func redecodeIdx(p skylab.Packet) sql.NullInt64 {
+	if d, ok := p.(*skylab.DynamicPacket); ok {
+		if d.Def.Repeat == 0 {
+			return sql.NullInt64{}
+		}
+		return sql.NullInt64{Int64: int64(d.Idx), Valid: true}
+	}
+	if idx, ok := packetIndex(p); ok {
+		return sql.NullInt64{Int64: int64(idx), Valid: true}
+	}
+	return sql.NullInt64{}
+}
+
+// Redecode decodes the raw frames that match the filter again, and replaces
+// the bus events that came from them. This fixes stored data after a packet
+// definition was wrong. Old events are found by timestamp, name, index and
+// import, using the packet from both the compiled definitions and the
+// decoder, so an event from another source (i.e xbee) with all of those the
+// same is replaced too. Events keep the import they came from. It's done in
+// windows of redecodeWindow, each in its own transaction, so if it fails the
+// windows before it are already done. With dryRun nothing is changed, but the
+// stats are still returned.
+func (tdb *TelemDb) Redecode(ctx context.Context, filter RawFrameFilter, decode FrameDecoder, dryRun bool) (RedecodeStats, error) {
+	var stats RedecodeStats
+	windowMs := redecodeWindow.Milliseconds()
+	var from int64
+	if !filter.StartTime.IsZero() {
+		from = filter.StartTime.UnixMilli()
+	}
+	for {
+		// skip to the next frame, so gaps in the data don't cost anything.
+		next := filter
+		next.StartTime = time.UnixMilli(from)
+		whereFrags, args := next.sqlWhere()
+		var start sql.NullInt64
+		err := tdb.db.QueryRowContext(ctx, `SELECT min(ts) FROM "raw_frames" WHERE `+
+			strings.Join(whereFrags, " AND "), args...).Scan(&start)
+		if err != nil {
+			return stats, err
+		}
+		if !start.Valid {
+			return stats, nil
+		}
+		window := filter
+		window.StartTime = time.UnixMilli(start.Int64)
+		window.EndTime = time.UnixMilli(start.Int64 + windowMs - 1)
+		if !filter.EndTime.IsZero() && window.EndTime.After(filter.EndTime) {
+			window.EndTime = filter.EndTime
+		}
+		if err := tdb.redecodeWindow(ctx, window, decode, dryRun, &stats); err != nil {
+			return stats, err
+		}
+		from = window.EndTime.UnixMilli() + 1
+	}
+}
+
+// redecodeWindow does Redecode for one window in a transaction, and adds to
+// the stats.
+func (tdb *TelemDb) redecodeWindow(ctx context.Context, filter RawFrameFilter, decode FrameDecoder,
+	dryRun bool, stats *RedecodeStats) error {
+	whereFrags, args := filter.sqlWhere()
+	sb := strings.Builder{}
+	sb.WriteString(`SELECT ts, id, extended, kind, data, import_id FROM "raw_frames"`)
+	if len(whereFrags) > 0 {
+		sb.WriteString(" WHERE ")
+		sb.WriteString(strings.Join(whereFrags, " AND "))
+	}
+	sb.WriteString(" ORDER BY ts ASC, rowid ASC")
+
+	// the stats are only added once the window is done.
+	var ws RedecodeStats
+	// events by import id, zero is events that didn't come from an import.
+	events := make(map[int64][]skylab.BusEvent)
+	keys := make(map[redecodeKey]struct{})
+
+	tx, err := tdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, sb.String(), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var f RawFrame
+		var ts int64
+		var importId sql.NullInt64
+		if err := rows.Scan(&ts, &f.Id, &f.Extended, &f.Kind, &f.Data, &importId); err != nil {
+			return err
+		}
+		ws.Frames++
+		frame := f.Frame()
+		if old, err := skylab.FromCanFrame(frame); err == nil {
+			keys[redecodeKey{ts, old.String(), redecodeIdx(old), importId}] = struct{}{}
+		}
+		p, err := decode(frame)
+		var idErr *skylab.UnknownIdError
+		if errors.As(err, &idErr) {
+			ws.Unknown++
+			continue
+		} else if err != nil {
+			ws.Errors++
+			continue
+		}
+		keys[redecodeKey{ts, p.String(), redecodeIdx(p), importId}] = struct{}{}
+		events[importId.Int64] = append(events[importId.Int64], skylab.BusEvent{
+			Timestamp: time.UnixMilli(ts),
+			Name:      p.String(),
+			Data:      p,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	del, err := tx.PrepareContext(ctx, `DELETE FROM bus_events WHERE ts = ? AND name = ? AND idx IS ? AND import_id IS ?`)
+	if err != nil {
+		return err
+	}
+	defer del.Close()
+	for k := range keys {
+		res, err := del.ExecContext(ctx, k.ts, k.name, k.idx, k.importId)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		ws.Removed += n
+	}
+
+	const batch = 1000
+	for importId, evs := range events {
+		var id any
+		if importId != 0 {
+			id = importId
+		}
+		for len(evs) > 0 {
+			chunk := evs[:min(len(evs), batch)]
+			evs = evs[len(chunk):]
+			n, err := tdb.insertEvents(ctx, tx, id, chunk)
+			if err != nil {
+				return err
+			}
+			ws.Decoded += n
+		}
+	}
+	if !dryRun {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	stats.Frames += ws.Frames
+	stats.Decoded += ws.Decoded
+	stats.Unknown += ws.Unknown
+	stats.Errors += ws.Errors
+	stats.Removed += ws.Removed
+	return nil
+}
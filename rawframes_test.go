@@ -0,0 +1,255 @@
+package gotelem
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kschamplin/gotelem/internal/can"
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+func TestRawFrames(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	ctx := context.Background()
+	start := time.UnixMilli(1700000000000)
+
+	frames := []RawFrame{
+		NewRawFrame(start, can.Frame{Id: can.CanID{Id: 0x10}, Data: []byte{1, 2, 3}}, "can0"),
+		// nothing in skylab uses this id, but it should still be kept.
+		NewRawFrame(start.Add(time.Millisecond), can.Frame{Id: can.CanID{Id: 0x7ff}, Data: []byte{0xff}}, "can0"),
+		NewRawFrame(start.Add(2*time.Millisecond), can.Frame{Id: can.CanID{Id: 0x1abcdef, Extended: true}, Data: nil}, "can1"),
+	}
+	n, err := tdb.AddRawFramesCtx(ctx, frames...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(frames)) {
+		t.Fatalf("expected %d frames added, got %d", len(frames), n)
+	}
+
+	// a drive that covers the last two frames.
+	_, err = tdb.db.Exec(`INSERT INTO drive_records (start_time, end_time) VALUES (?, ?)`,
+		start.Add(time.Millisecond).UnixMilli(), start.Add(2*time.Millisecond).UnixMilli())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		filter RawFrameFilter
+		want   []int // indexes into frames
+	}{
+		{name: "all", filter: RawFrameFilter{}, want: []int{0, 1, 2}},
+		{name: "by id", filter: RawFrameFilter{Ids: []uint32{0x7ff, 0x1abcdef}}, want: []int{1, 2}},
+		{name: "by bus", filter: RawFrameFilter{Bus: "can1"}, want: []int{2}},
+		{name: "by time", filter: RawFrameFilter{StartTime: start.Add(time.Millisecond), EndTime: start.Add(time.Millisecond)}, want: []int{1}},
+		{name: "by drive", filter: RawFrameFilter{DriveID: 1}, want: []int{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tdb.GetRawFrames(ctx, tt.filter, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected %d frames, got %d", len(tt.want), len(got))
+			}
+			for i, idx := range tt.want {
+				w := frames[idx]
+				g := got[i]
+				if g.Id != w.Id || g.Extended != w.Extended || g.Bus != w.Bus ||
+					!g.Timestamp.Equal(w.Timestamp) || !bytes.Equal(g.Data, w.Data) {
+					t.Errorf("frame %d mismatch, got %+v want %+v", i, g, w)
+				}
+			}
+		})
+	}
+
+	t.Run("import delete", func(t *testing.T) {
+		id, err := tdb.BeginImport(ctx, "raw.log", "rawhash")
+		if err != nil {
+			t.Fatal(err)
+		}
+		imported := NewRawFrame(start.Add(time.Hour), can.Frame{Id: can.CanID{Id: 0x20}, Data: []byte{4}}, "")
+		if _, err := tdb.AddImportRawFramesCtx(ctx, id, imported); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tdb.DeleteImport(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		got, err := tdb.GetRawFrames(ctx, RawFrameFilter{Ids: []uint32{0x20}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 0 {
+			t.Fatalf("expected imported frames to be deleted, got %d", len(got))
+		}
+	})
+}
+
+func TestRedecode(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	ctx := context.Background()
+	t0 := time.UnixMilli(1700000000000)
+	t1 := t0.Add(time.Second)
+
+	measurement := func(battery, aux uint16) can.Frame {
+		f, err := skylab.ToCanFrame(&skylab.BmsMeasurement{BatteryVoltage: battery, AuxVoltage: aux, Current: 1.5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	if _, err := tdb.AddRawFramesCtx(ctx,
+		NewRawFrame(t0, measurement(100, 12), "can0"),
+		NewRawFrame(t0, can.Frame{Id: can.CanID{Id: 0x7ff}, Data: []byte{1}}, "can0"),
+	); err != nil {
+		t.Fatal(err)
+	}
+	importId, err := tdb.BeginImport(ctx, "redecode.log", "redecodehash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tdb.AddImportRawFramesCtx(ctx, importId, NewRawFrame(t1, measurement(200, 13), "")); err != nil {
+		t.Fatal(err)
+	}
+	// the stored events were decoded wrong, and there's an unrelated event at the same time.
+	if _, err := tdb.AddEventsCtx(ctx,
+		skylab.BusEvent{Timestamp: t0, Name: "bms_measurement", Data: &skylab.BmsMeasurement{BatteryVoltage: 1}},
+		skylab.BusEvent{Timestamp: t0, Name: "bms_soc", Data: &skylab.BmsSoc{}},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tdb.AddImportEventsCtx(ctx, importId,
+		skylab.BusEvent{Timestamp: t1, Name: "bms_measurement", Data: &skylab.BmsMeasurement{BatteryVoltage: 2}},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	measurements := func() []*skylab.BmsMeasurement {
+		res := make([]*skylab.BmsMeasurement, 0)
+		err := tdb.StreamPackets(ctx, BusEventFilter{Names: []string{"bms_measurement"}}, KeysetModifier{Ascending: true},
+			func(ev skylab.BusEvent, c Cursor) error {
+				res = append(res, ev.Data.(*skylab.BmsMeasurement))
+				return nil
+			})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	t.Run("dry run", func(t *testing.T) {
+		stats, err := tdb.Redecode(ctx, RawFrameFilter{}, skylab.FromCanFrame, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := RedecodeStats{Frames: 3, Decoded: 2, Unknown: 1, Removed: 2}
+		if stats != want {
+			t.Fatalf("got stats %+v, want %+v", stats, want)
+		}
+		if m := measurements(); m[0].BatteryVoltage != 1 {
+			t.Fatal("dry run changed the database")
+		}
+	})
+
+	t.Run("compiled definitions", func(t *testing.T) {
+		if _, err := tdb.Redecode(ctx, RawFrameFilter{}, skylab.FromCanFrame, false); err != nil {
+			t.Fatal(err)
+		}
+		m := measurements()
+		if len(m) != 2 || m[0].BatteryVoltage != 100 || m[1].BatteryVoltage != 200 {
+			t.Fatalf("events weren't replaced: %+v", m)
+		}
+		soc, err := tdb.GetPackets(ctx, BusEventFilter{Names: []string{"bms_soc"}}, nil)
+		if err != nil || len(soc) != 1 {
+			t.Fatalf("unrelated event was removed: %v, %v", soc, err)
+		}
+	})
+
+	t.Run("runtime definitions", func(t *testing.T) {
+		defs, err := skylab.Definitions()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// pretend the two voltages were the wrong way around.
+		def, _ := defs.Packet("bms_measurement")
+		fixed := *def
+		fixed.Data = append([]skylab.FieldDef{}, def.Data...)
+		fixed.Data[0].Name, fixed.Data[1].Name = fixed.Data[1].Name, fixed.Data[0].Name
+		dec, err := skylab.NewDecoder(&skylab.SkylabFile{Packets: []skylab.PacketDef{fixed}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// only redecode the first one.
+		_, err = tdb.Redecode(ctx, RawFrameFilter{EndTime: t0}, dec.FromCanFrame, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := measurements()
+		if len(m) != 2 || m[0].BatteryVoltage != 12 || m[0].AuxVoltage != 100 || m[1].BatteryVoltage != 200 {
+			t.Fatalf("unexpected events after redecode: %+v %+v", m[0], m[1])
+		}
+	})
+
+	t.Run("keeps import", func(t *testing.T) {
+		if _, err := tdb.DeleteImport(ctx, importId); err != nil {
+			t.Fatal(err)
+		}
+		if m := measurements(); len(m) != 1 {
+			t.Fatalf("expected the imported event to be deleted, got %d events", len(m))
+		}
+	})
+}
+
+func TestRedecodeWindows(t *testing.T) {
+	tdb := MakeMockDatabase(t.Name())
+	ctx := context.Background()
+	t0 := time.UnixMilli(1700000000000)
+
+	module := func(idx uint32, v float32) can.Frame {
+		f, err := skylab.ToCanFrame(&skylab.BmsModule{Voltage: v, Idx: idx})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	// frames far enough apart to be in different windows.
+	times := []time.Time{t0, t0.Add(redecodeWindow + time.Second), t0.Add(10 * redecodeWindow)}
+	for _, ts := range times {
+		if _, err := tdb.AddRawFramesCtx(ctx, NewRawFrame(ts, module(1, 3.5), "can0")); err != nil {
+			t.Fatal(err)
+		}
+		// the stored event is wrong, and another index at the same time has no frame.
+		if _, err := tdb.AddEventsCtx(ctx,
+			skylab.BusEvent{Timestamp: ts, Name: "bms_module", Data: &skylab.BmsModule{Voltage: 1, Idx: 1}},
+			skylab.BusEvent{Timestamp: ts, Name: "bms_module", Data: &skylab.BmsModule{Voltage: 2, Idx: 2}},
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := tdb.Redecode(ctx, RawFrameFilter{}, skylab.FromCanFrame, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RedecodeStats{Frames: 3, Decoded: 3, Removed: 3}
+	if stats != want {
+		t.Fatalf("got stats %+v, want %+v", stats, want)
+	}
+	evs, err := tdb.GetPackets(ctx, BusEventFilter{Names: []string{"bms_module"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evs) != 6 {
+		t.Fatalf("expected 6 events, got %d", len(evs))
+	}
+	for _, ev := range evs {
+		m := ev.Data.(*skylab.BmsModule)
+		if m.Idx == 1 && m.Voltage != 3.5 || m.Idx == 2 && m.Voltage != 2 {
+			t.Errorf("wrong event after redecode: %+v", m)
+		}
+	}
+}
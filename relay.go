@@ -0,0 +1,434 @@
+package gotelem
+
+// this file implements relaying bus events between gotelem instances,
+// i.e the car laptop and the pit laptop.
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// RelayMessage is the wire format for the relay protocol. Over TCP it is
+// sent as one JSON object per line, over websockets one per message.
+// The first message on a link is a hello, which has no event and tells
+// the other side our node ID.
+type RelayMessage struct {
+	Origin string           `json:"origin"` // node ID of the instance that first saw the event.
+	Hops   int              `json:"hops"`   // number of relays the event has already passed.
+	Event  *skylab.BusEvent `json:"event,omitempty"`
+}
+
+// rawRelayMessage is a RelayMessage as it's read, before the event is
+// decoded. The other side may have a different version of the definitions,
+// so an event we don't know about shouldn't break the link.
+type rawRelayMessage struct {
+	Origin string               `json:"origin"`
+	Hops   int                  `json:"hops"`
+	Event  *skylab.RawJsonEvent `json:"event,omitempty"`
+}
+
+// decode decodes the event, if there is one.
+func (m rawRelayMessage) decode() (RelayMessage, error) {
+	msg := RelayMessage{Origin: m.Origin, Hops: m.Hops}
+	if m.Event == nil {
+		return msg, nil
+	}
+	data, err := skylab.FromJson(m.Event.Name, m.Event.Data)
+	if err != nil {
+		return msg, err
+	}
+	msg.Event = &skylab.BusEvent{
+		Timestamp: time.UnixMilli(m.Event.Timestamp),
+		Name:      m.Event.Name,
+		Data:      data,
+	}
+	return msg, nil
+}
+
+// RelayLinkConfig controls which packets flow over a relay link.
+type RelayLinkConfig struct {
+	Name    string   // name of the link, used in logs.
+	Send    []string // packet names sent to the remote. Empty sends everything.
+	Receive []string // packet names accepted from the remote. Empty accepts everything.
+}
+
+func (c RelayLinkConfig) sends(name string) bool {
+	return len(c.Send) == 0 || slices.Contains(c.Send, name)
+}
+
+func (c RelayLinkConfig) receives(name string) bool {
+	return len(c.Receive) == 0 || slices.Contains(c.Receive, name)
+}
+
+// relayConn is a connection to another relay, either TCP or websocket.
+type relayConn interface {
+	ReadMessage(ctx context.Context) (rawRelayMessage, error)
+	WriteMessage(ctx context.Context, msg RelayMessage) error
+	Close() error
+}
+
+type tcpRelayConn struct {
+	conn net.Conn
+	dec  *json.Decoder
+	enc  *json.Encoder
+}
+
+func newTcpRelayConn(conn net.Conn) *tcpRelayConn {
+	return &tcpRelayConn{
+		conn: conn,
+		dec:  json.NewDecoder(bufio.NewReader(conn)),
+		enc:  json.NewEncoder(conn), // Encode adds the newline for us.
+	}
+}
+
+func (c *tcpRelayConn) ReadMessage(ctx context.Context) (msg rawRelayMessage, err error) {
+	err = c.dec.Decode(&msg)
+	return
+}
+
+func (c *tcpRelayConn) WriteMessage(ctx context.Context, msg RelayMessage) error {
+	return c.enc.Encode(msg)
+}
+
+func (c *tcpRelayConn) Close() error {
+	return c.conn.Close()
+}
+
+type wsRelayConn struct {
+	conn *websocket.Conn
+}
+
+func (c *wsRelayConn) ReadMessage(ctx context.Context) (msg rawRelayMessage, err error) {
+	err = wsjson.Read(ctx, c.conn, &msg)
+	return
+}
+
+func (c *wsRelayConn) WriteMessage(ctx context.Context, msg RelayMessage) error {
+	return wsjson.Write(ctx, c.conn, msg)
+}
+
+func (c *wsRelayConn) Close() error {
+	return c.conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// maxRelayMessageSize is the largest websocket message a relay reads. Every
+// message is a single event, and the biggest packets are a few hundred bytes
+// of JSON, so this leaves a lot of room for packets we don't know about.
+const maxRelayMessageSize = 64 << 10
+
+// relaySender is the broker name used by the relay. Events that came from
+// other nodes are published with it, so they aren't sent straight back.
+const relaySender = "relay"
+
+// DefaultRelayMaxHops is the default limit on how far an event can travel.
+const DefaultRelayMaxHops = 4
+
+// seenCacheSize is how many recent events the relay remembers, to catch
+// duplicates when there is more than one path between two nodes.
+const seenCacheSize = 4096
+
+type relayLink struct {
+	cfg    RelayLinkConfig
+	remote string // node ID of the other side.
+	out    chan RelayMessage
+}
+
+// Relay connects the local Broker to brokers on other gotelem instances.
+// Every event carries the ID of the node it came from and a hop count,
+// which are used to avoid sending events in circles.
+type Relay struct {
+	NodeID  string
+	MaxHops int
+
+	broker *Broker
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	links map[*relayLink]struct{}
+
+	seen     map[string]struct{}
+	seenRing []string
+	seenPos  int
+}
+
+// NewRelay creates a relay for the broker. The node ID must be unique
+// across all the connected instances.
+func NewRelay(nodeID string, broker *Broker, logger *slog.Logger) *Relay {
+	return &Relay{
+		NodeID:   nodeID,
+		MaxHops:  DefaultRelayMaxHops,
+		broker:   broker,
+		logger:   logger,
+		links:    make(map[*relayLink]struct{}),
+		seen:     make(map[string]struct{}),
+		seenRing: make([]string, seenCacheSize),
+	}
+}
+
+// Run forwards local broker events to every connected link until the
+// context is cancelled.
+func (r *Relay) Run(ctx context.Context) error {
+	rxCh, err := r.broker.Subscribe(relaySender)
+	if err != nil {
+		return err
+	}
+	defer r.broker.Unsubscribe(relaySender)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev := <-rxCh:
+			msg := RelayMessage{Origin: r.NodeID, Hops: 0, Event: &ev}
+			r.markSeen(msg)
+			r.forward(msg, nil)
+		}
+	}
+}
+
+// eventKey identifies an event for duplicate detection. Timestamps are
+// sent as milliseconds, so that's all the precision we can use.
+func eventKey(msg RelayMessage) string {
+	idx, _ := packetIndex(msg.Event.Data)
+	return fmt.Sprintf("%s/%s/%d/%d", msg.Origin, msg.Event.Name, idx, msg.Event.Timestamp.UnixMilli())
+}
+
+// markSeen remembers the event, and returns false if it was already seen.
+func (r *Relay) markSeen(msg RelayMessage) bool {
+	key := eventKey(msg)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.seen[key]; ok {
+		return false
+	}
+	// evict the oldest entry to keep the cache bounded.
+	delete(r.seen, r.seenRing[r.seenPos])
+	r.seenRing[r.seenPos] = key
+	r.seenPos = (r.seenPos + 1) % len(r.seenRing)
+	r.seen[key] = struct{}{}
+	return true
+}
+
+// forward sends the message to every link except the one it came from
+// and the node that created it.
+func (r *Relay) forward(msg RelayMessage, from *relayLink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for link := range r.links {
+		if link == from || link.remote == msg.Origin || !link.cfg.sends(msg.Event.Name) {
+			continue
+		}
+		select {
+		case link.out <- msg:
+		default:
+			r.logger.Warn("relay link buffer full", "link", link.cfg.Name)
+		}
+	}
+}
+
+// receive handles an event that came from another node.
+func (r *Relay) receive(msg RelayMessage, from *relayLink) {
+	if msg.Event == nil || msg.Event.Data == nil {
+		return
+	}
+	if msg.Origin == r.NodeID {
+		// it came back around to us.
+		return
+	}
+	if !from.cfg.receives(msg.Event.Name) {
+		return
+	}
+	if !r.markSeen(msg) {
+		return
+	}
+	r.broker.Publish(relaySender, *msg.Event)
+
+	msg.Hops++
+	if msg.Hops < r.MaxHops {
+		r.forward(msg, from)
+	}
+}
+
+// runLink does the hello exchange and then relays events until the
+// connection fails or the context is cancelled.
+func (r *Relay) runLink(ctx context.Context, conn relayConn, cfg RelayLinkConfig) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer conn.Close()
+
+	// close the connection if the context is cancelled, since the tcp
+	// reader doesn't look at it.
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	if err := conn.WriteMessage(ctx, RelayMessage{Origin: r.NodeID}); err != nil {
+		return err
+	}
+	hello, err := conn.ReadMessage(ctx)
+	if err != nil {
+		return err
+	}
+	if hello.Origin == "" || hello.Origin == r.NodeID {
+		return fmt.Errorf("bad relay node id %q", hello.Origin)
+	}
+
+	link := &relayLink{
+		cfg:    cfg,
+		remote: hello.Origin,
+		out:    make(chan RelayMessage, 256),
+	}
+	r.mu.Lock()
+	r.links[link] = struct{}{}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.links, link)
+		r.mu.Unlock()
+	}()
+	r.logger.Info("relay link up", "link", cfg.Name, "remote", hello.Origin)
+
+	writeErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-link.out:
+				if err := conn.WriteMessage(ctx, msg); err != nil {
+					writeErr <- err
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	// unknown packets are only logged once for each name.
+	unknown := make(map[string]bool)
+	for {
+		raw, err := conn.ReadMessage(ctx)
+		if err != nil {
+			select {
+			case err = <-writeErr:
+			default:
+			}
+			return err
+		}
+		msg, err := raw.decode()
+		if err != nil {
+			if !unknown[raw.Event.Name] {
+				unknown[raw.Event.Name] = true
+				r.logger.Warn("skipping relay event", "link", cfg.Name, "remote", hello.Origin,
+					"name", raw.Event.Name, "err", err)
+			}
+			continue
+		}
+		r.receive(msg, link)
+	}
+}
+
+// dialRelay connects to a remote relay. The url can be tcp://host:port
+// or ws(s)://host:port/path.
+func dialRelay(ctx context.Context, addr string) (relayConn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "tcp":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		return newTcpRelayConn(conn), nil
+	case "ws", "wss":
+		conn, _, err := websocket.Dial(ctx, addr, nil)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetReadLimit(maxRelayMessageSize)
+		return &wsRelayConn{conn: conn}, nil
+	}
+	return nil, errors.New("unknown relay scheme " + u.Scheme)
+}
+
+// Dial connects to a remote relay and keeps the link up, reconnecting
+// with a backoff whenever it drops. It returns when the context is cancelled.
+func (r *Relay) Dial(ctx context.Context, addr string, cfg RelayLinkConfig) {
+	const minBackoff = 1 * time.Second
+	const maxBackoff = 30 * time.Second
+	backoff := minBackoff
+	for {
+		conn, err := dialRelay(ctx, addr)
+		if err == nil {
+			start := time.Now()
+			err = r.runLink(ctx, conn, cfg)
+			// only reset the backoff if the link was up for a while.
+			if time.Since(start) > maxBackoff {
+				backoff = minBackoff
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		r.logger.Warn("relay link down, reconnecting", "link", cfg.Name, "addr", addr, "err", err, "wait", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// ServeTCP accepts relay links on the listener until the context is cancelled.
+func (r *Relay) ServeTCP(ctx context.Context, ln net.Listener, cfg RelayLinkConfig) error {
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			err := r.runLink(ctx, newTcpRelayConn(conn), cfg)
+			r.logger.Info("relay link closed", "link", cfg.Name, "remote", conn.RemoteAddr(), "err", err)
+		}()
+	}
+}
+
+// ServeWS creates a handler that accepts relay links over websockets.
+func (r *Relay) ServeWS(cfg RelayLinkConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		c, err := websocket.Accept(w, req, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			return
+		}
+		c.SetReadLimit(maxRelayMessageSize)
+		err = r.runLink(req.Context(), &wsRelayConn{conn: c}, cfg)
+		r.logger.Info("relay link closed", "link", cfg.Name, "remote", req.RemoteAddr, "err", err)
+	}
+}
@@ -0,0 +1,192 @@
+package gotelem
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+	"nhooyr.io/websocket"
+)
+
+// makeRelayPair links two brokers over a local TCP relay.
+func makeRelayPair(t *testing.T, cfgA, cfgB RelayLinkConfig) (*Broker, *Broker) {
+	t.Helper()
+	flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	brokerA := NewBroker(10, flog)
+	brokerB := NewBroker(10, flog)
+	relayA := NewRelay("A", brokerA, flog.With("node", "A"))
+	relayB := NewRelay("B", brokerB, flog.With("node", "B"))
+	go relayA.Run(ctx)
+	go relayB.Run(ctx)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go relayA.ServeTCP(ctx, ln, cfgA)
+	go relayB.Dial(ctx, "tcp://"+ln.Addr().String(), cfgB)
+
+	// wait for the link to come up.
+	deadline := time.Now().Add(time.Second)
+	for {
+		relayA.mu.Lock()
+		upA := len(relayA.links)
+		relayA.mu.Unlock()
+		relayB.mu.Lock()
+		upB := len(relayB.links)
+		relayB.mu.Unlock()
+		if upA == 1 && upB == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for relay link")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return brokerA, brokerB
+}
+
+func TestRelay(t *testing.T) {
+	t.Run("relay both ways", func(t *testing.T) {
+		brokerA, brokerB := makeRelayPair(t, RelayLinkConfig{Name: "a"}, RelayLinkConfig{Name: "b"})
+		subA, _ := brokerA.Subscribe("test")
+		subB, _ := brokerB.Subscribe("test")
+
+		// the wire format only has millisecond timestamps.
+		ev := makeEvent()
+		ev.Timestamp = ev.Timestamp.Truncate(time.Millisecond)
+		brokerA.Publish("source", ev)
+		select {
+		case got := <-subB:
+			if !ev.Equals(&got) {
+				t.Fatalf("events not equal, want %v got %v", ev, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for relayed event")
+		}
+		// drain the local copy.
+		<-subA
+
+		ev2 := makeEvent()
+		ev2.Timestamp = ev2.Timestamp.Truncate(time.Millisecond).Add(time.Second)
+		brokerB.Publish("source", ev2)
+		select {
+		case got := <-subA:
+			if !ev2.Equals(&got) {
+				t.Fatalf("events not equal, want %v got %v", ev2, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for relayed event")
+		}
+		<-subB
+
+		// nothing should echo back.
+		select {
+		case got := <-subA:
+			t.Fatalf("got echoed event on A: %v", got)
+		case got := <-subB:
+			t.Fatalf("got echoed event on B: %v", got)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+
+	t.Run("relay filters", func(t *testing.T) {
+		brokerA, brokerB := makeRelayPair(t,
+			RelayLinkConfig{Name: "a", Send: []string{"wsl_velocity"}},
+			RelayLinkConfig{Name: "b"})
+		subB, _ := brokerB.Subscribe("test")
+
+		brokerA.Publish("source", makeEvent())
+		brokerA.Publish("source", skylab.BusEvent{
+			Timestamp: time.Now(),
+			Name:      "wsl_velocity",
+			Data:      &skylab.WslVelocity{},
+		})
+		select {
+		case got := <-subB:
+			if got.Name != "wsl_velocity" {
+				t.Fatalf("expected only wsl_velocity, got %s", got.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for relayed event")
+		}
+	})
+
+	t.Run("unknown packet", func(t *testing.T) {
+		flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		broker := NewBroker(10, flog)
+		relay := NewRelay("A", broker, flog)
+		go relay.Run(ctx)
+		sub, _ := broker.Subscribe("test")
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go relay.ServeTCP(ctx, ln, RelayLinkConfig{Name: "a"})
+
+		// a newer node can send packets that we don't know about.
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ts := time.Now().UnixMilli()
+		fmt.Fprintf(conn, `{"origin":"B","hops":0}`+"\n")
+		fmt.Fprintf(conn, `{"origin":"B","hops":0,"event":{"ts":%d,"name":"not_a_packet","data":{}}}`+"\n", ts)
+		fmt.Fprintf(conn, `{"origin":"B","hops":0,"event":{"ts":%d,"name":"wsl_velocity","data":{}}}`+"\n", ts)
+
+		select {
+		case got := <-sub:
+			if got.Name != "wsl_velocity" {
+				t.Fatalf("expected wsl_velocity, got %s", got.Name)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for the event after the unknown packet")
+		}
+	})
+
+	t.Run("websocket read limit", func(t *testing.T) {
+		flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		relay := NewRelay("A", NewBroker(10, flog), flog)
+		go relay.Run(ctx)
+		srv := httptest.NewServer(relay.ServeWS(RelayLinkConfig{Name: "a"}))
+		defer srv.Close()
+
+		conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.CloseNow()
+		if err := conn.Write(ctx, websocket.MessageText, []byte(`{"origin":"B","hops":0}`)); err != nil {
+			t.Fatal(err)
+		}
+		big := fmt.Sprintf(`{"origin":"%s","hops":0}`, strings.Repeat("B", maxRelayMessageSize))
+		// the write can fail if the relay has already closed the link.
+		conn.Write(ctx, websocket.MessageText, []byte(big))
+
+		// the relay should close the link rather than read it.
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				if websocket.CloseStatus(err) != websocket.StatusMessageTooBig {
+					t.Fatalf("expected the link to be closed for a big message, got %v", err)
+				}
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,339 @@
+package gotelem
+
+// this file implements replaying stored drives back into the broker.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+// replaySender is the broker name used by replays.
+const replaySender = "replay"
+
+// replayWindow is how much recorded time is loaded from the database at once.
+// This keeps memory use low for long drives.
+const replayWindow = 30 * time.Second
+
+// ReplayStatus is the current state of a Replayer.
+type ReplayStatus struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Position time.Time `json:"position"` // timestamp of the last published event.
+	Speed    float64   `json:"speed"`
+	Paused   bool      `json:"paused"`
+	Loop     bool      `json:"loop"`
+	Finished bool      `json:"finished"`
+}
+
+// Replayer republishes events from the database into the broker, keeping
+// the original spacing between them. The speed can be changed, and it can
+// be paused, seeked and looped while running.
+type Replayer struct {
+	// Restamp replaces the event timestamps with the time they are published,
+	// so realtime views treat the replay like live data.
+	Restamp bool
+
+	tdb    *TelemDb
+	broker *Broker
+	logger *slog.Logger
+	filter BusEventFilter
+
+	mu       sync.Mutex
+	start    time.Time
+	end      time.Time
+	pos      time.Time
+	speed    float64
+	paused   bool
+	loop     bool
+	finished bool
+	seeked   bool // the position was moved, drop anything we loaded.
+	dirty    bool // the timing changed, so the wall clock anchor is stale.
+	wake     chan struct{}
+}
+
+// NewReplayer creates a replay of the events matching the filter. If the
+// filter has no start or end time, the first or last matching event is used.
+func NewReplayer(tdb *TelemDb, broker *Broker, filter BusEventFilter, logger *slog.Logger) *Replayer {
+	return &Replayer{
+		tdb:    tdb,
+		broker: broker,
+		logger: logger,
+		filter: filter,
+		speed:  1.0,
+		dirty:  true,
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// poke wakes up the run loop after a change.
+func (rp *Replayer) poke() {
+	select {
+	case rp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns the current replay state.
+func (rp *Replayer) Status() ReplayStatus {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return ReplayStatus{
+		Start:    rp.start,
+		End:      rp.end,
+		Position: rp.pos,
+		Speed:    rp.speed,
+		Paused:   rp.paused,
+		Loop:     rp.loop,
+		Finished: rp.finished,
+	}
+}
+
+// Pause stops publishing events until Resume is called.
+func (rp *Replayer) Pause() {
+	rp.mu.Lock()
+	rp.paused = true
+	rp.mu.Unlock()
+	rp.poke()
+}
+
+// Resume continues a paused replay. If the replay finished, it starts over.
+func (rp *Replayer) Resume() {
+	rp.mu.Lock()
+	if rp.finished {
+		rp.finished = false
+		rp.pos = rp.start
+		rp.seeked = true
+	}
+	rp.paused = false
+	rp.dirty = true
+	rp.mu.Unlock()
+	rp.poke()
+}
+
+// Seek moves the replay to the given time. It must be within the replay range.
+func (rp *Replayer) Seek(t time.Time) error {
+	rp.mu.Lock()
+	defer rp.poke()
+	defer rp.mu.Unlock()
+	if t.Before(rp.start) || t.After(rp.end) {
+		return errors.New("seek time out of range")
+	}
+	rp.pos = t
+	rp.finished = false
+	rp.seeked = true
+	rp.dirty = true
+	return nil
+}
+
+// SetSpeed changes the playback speed. 2.0 is twice as fast as real time.
+func (rp *Replayer) SetSpeed(speed float64) error {
+	if speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+	rp.mu.Lock()
+	rp.speed = speed
+	rp.dirty = true
+	rp.mu.Unlock()
+	rp.poke()
+	return nil
+}
+
+// SetLoop controls if the replay starts over when it reaches the end.
+func (rp *Replayer) SetLoop(loop bool) {
+	rp.mu.Lock()
+	rp.loop = loop
+	rp.mu.Unlock()
+	rp.poke()
+}
+
+// load gets the events in [from, to] in time order.
+func (rp *Replayer) load(ctx context.Context, from, to time.Time) ([]skylab.BusEvent, error) {
+	f := rp.filter
+	f.StartTime = from
+	f.EndTime = to
+	events, _, err := rp.tdb.GetPacketsPage(ctx, f, KeysetModifier{Ascending: true})
+	return events, err
+}
+
+// Run publishes events until the context is cancelled. When the replay
+// finishes, it either loops or waits to be resumed or seeked.
+func (rp *Replayer) Run(ctx context.Context) error {
+	start, end, err := rp.tdb.GetTimeRange(ctx, rp.filter)
+	if err != nil {
+		return err
+	}
+	if !rp.filter.StartTime.IsZero() {
+		start = rp.filter.StartTime
+	}
+	if !rp.filter.EndTime.IsZero() {
+		end = rp.filter.EndTime
+	}
+	if start.IsZero() || end.IsZero() {
+		return errors.New("no events to replay")
+	}
+	rp.mu.Lock()
+	rp.start, rp.end = start, end
+	rp.pos = start
+	rp.seeked = true
+	rp.mu.Unlock()
+
+	var buf []skylab.BusEvent
+	var loadedTo time.Time // everything up to here has been loaded.
+	// the wall clock time that corresponds to anchorPos in the recording.
+	var anchorWall, anchorPos time.Time
+	var speed float64
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		rp.mu.Lock()
+		if rp.seeked {
+			buf = nil
+			loadedTo = rp.pos.Add(-time.Millisecond)
+			rp.seeked = false
+		}
+		if rp.dirty {
+			anchorWall, anchorPos, speed = time.Now(), rp.pos, rp.speed
+			rp.dirty = false
+		}
+		paused := rp.paused || rp.finished
+		rp.mu.Unlock()
+
+		if paused {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-rp.wake:
+			}
+			continue
+		}
+
+		if len(buf) == 0 {
+			if !loadedTo.Before(end) {
+				rp.mu.Lock()
+				if rp.loop {
+					rp.pos = rp.start
+					rp.seeked = true
+					rp.dirty = true
+				} else {
+					rp.logger.Info("replay finished")
+					rp.finished = true
+				}
+				rp.mu.Unlock()
+				continue
+			}
+			from := loadedTo.Add(time.Millisecond)
+			to := from.Add(replayWindow - time.Millisecond)
+			if to.After(end) {
+				to = end
+			}
+			buf, err = rp.load(ctx, from, to)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			loadedTo = to
+			continue
+		}
+
+		ev := buf[0]
+		due := anchorWall.Add(time.Duration(float64(ev.Timestamp.Sub(anchorPos)) / speed))
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil
+			case <-rp.wake:
+				// something changed, go back to the top and check.
+				timer.Stop()
+				continue
+			case <-timer.C:
+			}
+		}
+
+		buf = buf[1:]
+		rp.mu.Lock()
+		// a seek could have happened after the timer fired, so this event
+		// is from the old position and shouldn't move it back.
+		if rp.seeked {
+			rp.mu.Unlock()
+			continue
+		}
+		rp.pos = ev.Timestamp
+		rp.mu.Unlock()
+		if rp.Restamp {
+			ev.Timestamp = time.Now()
+		}
+		rp.broker.Publish(replaySender, ev)
+	}
+}
+
+// Router creates the HTTP controls for the replay.
+func (rp *Replayer) Router() chi.Router {
+	r := chi.NewRouter()
+
+	writeStatus := func(w http.ResponseWriter) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rp.Status())
+	}
+
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w)
+	})
+	r.Post("/pause", func(w http.ResponseWriter, r *http.Request) {
+		rp.Pause()
+		writeStatus(w)
+	})
+	r.Post("/resume", func(w http.ResponseWriter, r *http.Request) {
+		rp.Resume()
+		writeStatus(w)
+	})
+	// seek takes an RFC3339 time, i.e /seek?t=2024-03-07T13:28:08Z
+	r.Post("/seek", func(w http.ResponseWriter, r *http.Request) {
+		t, err := time.Parse(time.RFC3339, r.URL.Query().Get("t"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rp.Seek(t); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeStatus(w)
+	})
+	r.Post("/speed", func(w http.ResponseWriter, r *http.Request) {
+		speed, err := strconv.ParseFloat(r.URL.Query().Get("x"), 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := rp.SetSpeed(speed); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeStatus(w)
+	})
+	r.Post("/loop", func(w http.ResponseWriter, r *http.Request) {
+		loop, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rp.SetLoop(loop)
+		writeStatus(w)
+	})
+	return r
+}
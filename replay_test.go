@@ -0,0 +1,91 @@
+package gotelem
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReplayer(t *testing.T) {
+	flog := slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+	t.Run("replay all events in order", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		SeedMockDatabase(tdb)
+		evs := GetSeedEvents()
+		broker := NewBroker(100, flog)
+		sub, _ := broker.Subscribe("test")
+
+		rp := NewReplayer(tdb, broker, BusEventFilter{}, flog)
+		rp.SetSpeed(100)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go rp.Run(ctx)
+
+		for i := range evs {
+			select {
+			case got := <-sub:
+				if !evs[i].Equals(&got) {
+					t.Fatalf("event %d did not match, want %v got %v", i, evs[i], got)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("timeout waiting for event %d", i)
+			}
+		}
+		// wait for the replay to notice it's done.
+		deadline := time.Now().Add(time.Second)
+		for !rp.Status().Finished {
+			if time.Now().After(deadline) {
+				t.Fatal("replay did not finish")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("seek and pause", func(t *testing.T) {
+		tdb := MakeMockDatabase(t.Name())
+		SeedMockDatabase(tdb)
+		evs := GetSeedEvents()
+		broker := NewBroker(100, flog)
+		sub, _ := broker.Subscribe("test")
+
+		rp := NewReplayer(tdb, broker, BusEventFilter{}, flog)
+		rp.Pause()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go rp.Run(ctx)
+
+		// wait for the range to be loaded.
+		deadline := time.Now().Add(time.Second)
+		for rp.Status().End.IsZero() {
+			if time.Now().After(deadline) {
+				t.Fatal("replay did not start")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		select {
+		case ev := <-sub:
+			t.Fatalf("got event while paused: %v", ev)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		last := evs[len(evs)-1]
+		if err := rp.Seek(last.Timestamp); err != nil {
+			t.Fatal(err)
+		}
+		if err := rp.Seek(last.Timestamp.Add(time.Hour)); err == nil {
+			t.Fatal("expected error seeking out of range")
+		}
+		rp.Resume()
+		select {
+		case got := <-sub:
+			if !last.Equals(&got) {
+				t.Fatalf("expected last event after seek, got %v", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+	})
+}
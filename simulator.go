@@ -0,0 +1,564 @@
+package gotelem
+
+// this file implements a vehicle simulator that generates every skylab packet,
+// for demos and load testing without the car.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+	"gopkg.in/yaml.v3"
+)
+
+// simSender is the broker name used by the simulator.
+const simSender = "simulator"
+
+// simTick is how often the simulator steps the vehicle model.
+const simTick = 10 * time.Millisecond
+
+// SimField controls how a single field is generated. All values are in
+// engineering units, i.e after the conversion from the definitions is applied.
+type SimField struct {
+	// Kind is one of "walk" (bounded random walk), "sine" or "const".
+	Kind string  `yaml:"kind"`
+	Min  float64 `yaml:"min"`
+	Max  float64 `yaml:"max"`
+	// Step is the largest change of a walk per sample. Defaults to 1/50 of the range.
+	Step float64 `yaml:"step"`
+	// Period of a sine wave, i.e "30s".
+	Period time.Duration `yaml:"period"`
+	// Value is used by "const". For bitfields, it's the bitmask.
+	Value float64 `yaml:"value"`
+}
+
+// SimPacket controls how a packet is generated.
+type SimPacket struct {
+	// Rate in Hz. Zero uses the default rate of the profile.
+	Rate     float64             `yaml:"rate"`
+	Disabled bool                `yaml:"disabled"`
+	Fields   map[string]SimField `yaml:"fields"`
+}
+
+// SimVehicle holds the parameters of the vehicle model. Fields that come from
+// the model (speed, pack current, motor and array power, ...) are derived from
+// the same state, so related packets agree with each other.
+type SimVehicle struct {
+	MaxSpeed          float64 `yaml:"max_speed"`          // m/s
+	Mass              float64 `yaml:"mass"`               // kg
+	DragArea          float64 `yaml:"drag_area"`          // Cd*A, m^2
+	RollingResistance float64 `yaml:"rolling_resistance"` // coefficient
+	Efficiency        float64 `yaml:"efficiency"`         // motor + controller, 0-1
+	WheelRadius       float64 `yaml:"wheel_radius"`       // m
+	PackVoltage       float64 `yaml:"pack_voltage"`       // V, when full
+	PackResistance    float64 `yaml:"pack_resistance"`    // ohms
+	PackCapacity      float64 `yaml:"pack_capacity"`      // Ah
+	ArrayPower        float64 `yaml:"array_power"`        // W, peak
+}
+
+// SimProfile is the configuration of the simulator, usually loaded from YAML:
+//
+//	seed: 42
+//	default_rate: 1
+//	vehicle:
+//	  max_speed: 20
+//	packets:
+//	  bms_measurement:
+//	    rate: 10
+//	    fields:
+//	      aux_voltage: {kind: sine, min: 11.5, max: 12.5, period: 60s}
+//	  bms_kill:
+//	    disabled: true
+//
+// Packets that aren't listed are sent at the default rate, with fields from
+// the vehicle model or a random walk.
+type SimProfile struct {
+	// Seed for the random numbers. Zero uses the current time.
+	Seed        int64                `yaml:"seed"`
+	DefaultRate float64              `yaml:"default_rate"`
+	Vehicle     SimVehicle           `yaml:"vehicle"`
+	Packets     map[string]SimPacket `yaml:"packets"`
+}
+
+// DefaultSimProfile returns a profile that sends the drive packets quickly,
+// and leaves out commands that don't make sense to send constantly.
+func DefaultSimProfile() SimProfile {
+	fast := SimPacket{Rate: 10}
+	off := SimPacket{Disabled: true}
+	return SimProfile{
+		DefaultRate: 1,
+		Vehicle:     defaultSimVehicle,
+		Packets: map[string]SimPacket{
+			"bms_measurement": {Rate: 10, Fields: map[string]SimField{
+				"aux_voltage": {Kind: "walk", Min: 11.8, Max: 12.6, Step: 0.01},
+			}},
+			"car_speed":             fast,
+			"wsl_velocity":          fast,
+			"wsr_velocity":          fast,
+			"wsl_bus_measurement":   fast,
+			"wsr_bus_measurement":   fast,
+			"tritium_motor_drive_l": fast,
+			"tritium_motor_drive_r": fast,
+			"tritium_motor_power_l": fast,
+			"tritium_motor_power_r": fast,
+			"array_power":           {Rate: 5},
+			"bms_module":            {Rate: 0.5},
+			"tracker_data":          {Rate: 2},
+
+			"bms_kill":              off,
+			"bms_ah_set":            off,
+			"bms_wh_set":            off,
+			"bms_set_min_fan_speed": off,
+			"array_energy_reset":    off,
+			"telemetry_rtc_reset":   off,
+			"tritium_reset_l":       off,
+			"tritium_reset_r":       off,
+		},
+	}
+}
+
+var defaultSimVehicle = SimVehicle{
+	MaxSpeed:          25,
+	Mass:              300,
+	DragArea:          0.15,
+	RollingResistance: 0.006,
+	Efficiency:        0.95,
+	WheelRadius:       0.28,
+	PackVoltage:       130,
+	PackResistance:    0.05,
+	PackCapacity:      40,
+	ArrayPower:        800,
+}
+
+// ParseSimProfile parses a YAML profile. Vehicle parameters that are left out
+// use the defaults.
+func ParseSimProfile(data []byte) (SimProfile, error) {
+	var p SimProfile
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// LoadSimProfile reads a YAML profile from a file.
+func LoadSimProfile(path string) (SimProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return SimProfile{}, err
+	}
+	return ParseSimProfile(data)
+}
+
+// simVehicleState is the state of the vehicle model.
+type simVehicleState struct {
+	SimVehicle
+	t            float64 // seconds since start.
+	speed        float64
+	target       float64
+	nextTarget   float64
+	accel        float64
+	motorPower   float64 // electrical power into both motor controllers, W.
+	arrayPower   float64
+	packVoltage  float64
+	packCurrent  float64 // positive is discharging.
+	ahUsed       float64
+	whUsed       float64
+	motorAh      float64
+	odometer     float64
+	arrayEnergy  float64 // J
+	moduleOffset []float64
+}
+
+// the number of series modules, from the bms_module definition.
+const simModules = 36
+
+// the number of MPPTs, from the tracker_data definition.
+const simTrackers = 6
+
+// simTrackerVoltage is the array voltage at the MPPTs.
+const simTrackerVoltage = 100.0
+
+func (v *simVehicleState) soc() float64 {
+	return max(0, min(1, 1-v.ahUsed/v.PackCapacity))
+}
+
+func (v *simVehicleState) motorCurrent() float64 {
+	return v.motorPower / v.packVoltage
+}
+
+func (v *simVehicleState) rpm() float64 {
+	return v.speed / (2 * math.Pi * v.WheelRadius) * 60
+}
+
+func (v *simVehicleState) module(idx int) float64 {
+	return v.packVoltage/simModules + v.moduleOffset[idx]
+}
+
+func (v *simVehicleState) moduleTemp(idx int) float64 {
+	return 25 + 0.2*math.Abs(v.packCurrent) + 100*v.moduleOffset[idx]
+}
+
+// step advances the model by dt seconds.
+func (v *simVehicleState) step(dt float64, rng *rand.Rand) {
+	v.t += dt
+	// the driver picks a new speed every so often.
+	if v.t >= v.nextTarget {
+		v.target = v.MaxSpeed * (0.3 + 0.7*rng.Float64())
+		v.nextTarget = v.t + 10 + 20*rng.Float64()
+	}
+	v.accel = max(-1, min(1, (v.target-v.speed)*0.2))
+	v.speed = max(0, v.speed+v.accel*dt)
+
+	const g = 9.81
+	const rho = 1.2
+	force := v.Mass*v.accel + 0.5*rho*v.DragArea*v.speed*v.speed + v.RollingResistance*v.Mass*g
+	mech := force * v.speed
+	if mech > 0 {
+		v.motorPower = mech / v.Efficiency
+	} else {
+		v.motorPower = mech * v.Efficiency // regen
+	}
+
+	// slow sine for clouds moving over, never below half power.
+	v.arrayPower = v.ArrayPower * (0.75 + 0.25*math.Sin(2*math.Pi*v.t/600))
+
+	// the pack supplies whatever the array doesn't.
+	v.packVoltage = v.PackVoltage*(0.85+0.15*v.soc()) - v.packCurrent*v.PackResistance
+	v.packCurrent = (v.motorPower - v.arrayPower) / v.packVoltage
+
+	v.ahUsed += v.packCurrent * dt / 3600
+	v.whUsed += v.packCurrent * v.packVoltage * dt / 3600
+	v.motorAh += v.motorCurrent() * dt / 3600
+	v.odometer += v.speed * dt
+	v.arrayEnergy += v.arrayPower * dt
+}
+
+// simSignal computes a field from the vehicle model, in engineering units.
+type simSignal func(v *simVehicleState, idx int) float64
+
+// simPhysics maps "packet.field" to the part of the vehicle model it shows.
+var simPhysics = map[string]simSignal{
+	"bms_measurement.battery_voltage": func(v *simVehicleState, _ int) float64 { return v.packVoltage },
+	"bms_measurement.current":         func(v *simVehicleState, _ int) float64 { return v.packCurrent },
+
+	"bms_soc.soc":        func(v *simVehicleState, _ int) float64 { return 100 * v.soc() },
+	"bms_capacity.Ah":    func(v *simVehicleState, _ int) float64 { return v.PackCapacity - v.ahUsed },
+	"bms_capacity.Wh":    func(v *simVehicleState, _ int) float64 { return v.PackCapacity*v.PackVoltage - v.whUsed },
+	"bms_module.voltage": func(v *simVehicleState, idx int) float64 { return v.module(idx) },
+	"bms_module.temperature": func(v *simVehicleState, idx int) float64 {
+		return v.moduleTemp(idx)
+	},
+	"bms_module_min_max.module_max_voltage": func(v *simVehicleState, _ int) float64 {
+		return v.packVoltage/simModules + slices.Max(v.moduleOffset)
+	},
+	"bms_module_min_max.module_min_voltage": func(v *simVehicleState, _ int) float64 {
+		return v.packVoltage/simModules + slices.Min(v.moduleOffset)
+	},
+	"bms_module_min_max.module_max_temp": func(v *simVehicleState, _ int) float64 {
+		return 25 + 0.2*math.Abs(v.packCurrent) + 100*slices.Max(v.moduleOffset)
+	},
+	"bms_module_min_max.module_min_temp": func(v *simVehicleState, _ int) float64 {
+		return 25 + 0.2*math.Abs(v.packCurrent) + 100*slices.Min(v.moduleOffset)
+	},
+
+	"car_speed.speed":                 func(v *simVehicleState, _ int) float64 { return v.speed },
+	"distance_traveled.trip_distance": func(v *simVehicleState, _ int) float64 { return v.odometer },
+
+	"array_power.front_array_channel_0": func(v *simVehicleState, _ int) float64 { return v.arrayPower / 4 },
+	"array_power.front_array_channel_1": func(v *simVehicleState, _ int) float64 { return v.arrayPower / 4 },
+	"array_power.rear_array_channel_0":  func(v *simVehicleState, _ int) float64 { return v.arrayPower / 4 },
+	"array_power.rear_array_channel_1":  func(v *simVehicleState, _ int) float64 { return v.arrayPower / 4 },
+	"array_energy.energy":               func(v *simVehicleState, _ int) float64 { return v.arrayEnergy },
+
+	"tracker_data.array_voltage":   func(v *simVehicleState, _ int) float64 { return simTrackerVoltage },
+	"tracker_data.array_current":   func(v *simVehicleState, _ int) float64 { return v.arrayPower / simTrackers / simTrackerVoltage },
+	"tracker_data.battery_voltage": func(v *simVehicleState, _ int) float64 { return v.packVoltage },
+}
+
+// the left and right sides each take half the power.
+func init() {
+	for _, side := range []string{"l", "r"} {
+		simPhysics["tritium_motor_power_"+side+".bus_current"] = func(v *simVehicleState, _ int) float64 { return v.motorCurrent() / 2 }
+		simPhysics["tritium_motor_drive_"+side+".motor_velocity"] = func(v *simVehicleState, _ int) float64 { return v.rpm() }
+		simPhysics["tritium_motor_drive_"+side+".motor_current"] = func(v *simVehicleState, _ int) float64 {
+			return max(0, min(1, v.motorPower/5000))
+		}
+		simPhysics["ws"+side+"_bus_measurement.bus_voltage"] = func(v *simVehicleState, _ int) float64 { return v.packVoltage }
+		simPhysics["ws"+side+"_bus_measurement.bus_current"] = func(v *simVehicleState, _ int) float64 { return v.motorCurrent() / 2 }
+		simPhysics["ws"+side+"_velocity.motor_velocity"] = func(v *simVehicleState, _ int) float64 { return v.rpm() }
+		simPhysics["ws"+side+"_velocity.vehicle_velocity"] = func(v *simVehicleState, _ int) float64 { return v.speed }
+		simPhysics["ws"+side+"_odometer_bus_amphours_measurement.odometer"] = func(v *simVehicleState, _ int) float64 { return v.odometer }
+		simPhysics["ws"+side+"_odometer_bus_amphours_measurement.dc_bus_amphours"] = func(v *simVehicleState, _ int) float64 { return v.motorAh / 2 }
+	}
+}
+
+// typeRange is the range of raw values a field type can hold.
+func typeRange(typ string) (lo, hi float64) {
+	switch typ {
+	case "uint8_t", "bitfield":
+		return 0, math.MaxUint8
+	case "int8_t":
+		return math.MinInt8, math.MaxInt8
+	case "uint16_t":
+		return 0, math.MaxUint16
+	case "int16_t":
+		return math.MinInt16, math.MaxInt16
+	case "uint32_t":
+		return 0, math.MaxUint32
+	case "int32_t":
+		return math.MinInt32, math.MaxInt32
+	case "uint64_t", "int64_t":
+		// keep to what a float64 holds exactly, the json round trip would fail otherwise.
+		if typ == "uint64_t" {
+			return 0, 1 << 53
+		}
+		return -(1 << 53), 1 << 53
+	}
+	return -math.MaxFloat32, math.MaxFloat32
+}
+
+// simGen generates one field of one packet instance.
+type simGen struct {
+	def   *skylab.FieldDef
+	cfg   SimField
+	phys  simSignal
+	value float64
+}
+
+func (g *simGen) next(v *simVehicleState, idx int, rng *rand.Rand) any {
+	var eng float64
+	switch {
+	case g.cfg.Kind == "const":
+		eng = g.cfg.Value
+	case g.cfg.Kind == "sine":
+		mid, amp := (g.cfg.Max+g.cfg.Min)/2, (g.cfg.Max-g.cfg.Min)/2
+		eng = mid + amp*math.Sin(2*math.Pi*v.t/g.cfg.Period.Seconds())
+	case g.cfg.Kind == "walk" || g.phys == nil:
+		if g.def.Type == "bitfield" {
+			// flip a bit once in a while.
+			if rng.Float64() < 0.01 {
+				g.value = float64(uint8(g.value) ^ 1<<rng.Intn(max(1, len(g.def.Bits))))
+			}
+			eng = g.value
+			break
+		}
+		step := g.cfg.Step
+		if step == 0 {
+			step = (g.cfg.Max - g.cfg.Min) / 50
+		}
+		g.value = max(g.cfg.Min, min(g.cfg.Max, g.value+(2*rng.Float64()-1)*step))
+		eng = g.value
+	default:
+		eng = g.phys(v, idx)
+	}
+
+	if g.def.Type == "bitfield" {
+		mask := uint8(eng)
+		bits := make(map[string]bool, len(g.def.Bits))
+		for i, b := range g.def.Bits {
+			bits[b.Name] = mask&(1<<i) != 0
+		}
+		return bits
+	}
+	raw := eng / g.def.Scale()
+	lo, hi := typeRange(g.def.Type)
+	raw = max(lo, min(hi, raw))
+	if g.def.Type == "float" {
+		return raw
+	}
+	return math.Round(raw)
+}
+
+// simPacket is the generator state for one packet.
+type simPacket struct {
+	def      *skylab.PacketDef
+	interval time.Duration
+	due      time.Time
+	fields   [][]*simGen // by idx, then field.
+}
+
+// Simulator generates skylab packets from a SimProfile.
+type Simulator struct {
+	profile SimProfile
+	rng     *rand.Rand
+	vehicle *simVehicleState
+	packets []*simPacket
+	last    time.Time
+}
+
+// NewSimulator creates a simulator. Unknown packets or fields in the profile are
+// an error, since they are probably typos.
+func NewSimulator(profile SimProfile) (*Simulator, error) {
+	defs, err := skylab.Definitions()
+	if err != nil {
+		return nil, err
+	}
+	seed := profile.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	veh := profile.Vehicle
+	// fill in anything that wasn't set.
+	for _, f := range []struct {
+		p *float64
+		d float64
+	}{
+		{&veh.MaxSpeed, defaultSimVehicle.MaxSpeed},
+		{&veh.Mass, defaultSimVehicle.Mass},
+		{&veh.DragArea, defaultSimVehicle.DragArea},
+		{&veh.RollingResistance, defaultSimVehicle.RollingResistance},
+		{&veh.Efficiency, defaultSimVehicle.Efficiency},
+		{&veh.WheelRadius, defaultSimVehicle.WheelRadius},
+		{&veh.PackVoltage, defaultSimVehicle.PackVoltage},
+		{&veh.PackResistance, defaultSimVehicle.PackResistance},
+		{&veh.PackCapacity, defaultSimVehicle.PackCapacity},
+		{&veh.ArrayPower, defaultSimVehicle.ArrayPower},
+	} {
+		if *f.p == 0 {
+			*f.p = f.d
+		}
+	}
+	state := &simVehicleState{SimVehicle: veh, moduleOffset: make([]float64, simModules)}
+	state.packVoltage = veh.PackVoltage
+	for i := range state.moduleOffset {
+		state.moduleOffset[i] = 0.02 * (rng.Float64() - 0.5)
+	}
+
+	if profile.DefaultRate <= 0 {
+		profile.DefaultRate = 1
+	}
+
+	for name, pcfg := range profile.Packets {
+		pdef, ok := defs.Packet(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown packet %q in profile", name)
+		}
+		for fname := range pcfg.Fields {
+			if _, ok := pdef.Field(fname); !ok {
+				return nil, fmt.Errorf("unknown field %q of packet %q in profile", fname, name)
+			}
+		}
+	}
+
+	s := &Simulator{profile: profile, rng: rng, vehicle: state}
+	for i := range defs.Packets {
+		pdef := &defs.Packets[i]
+		pcfg := profile.Packets[pdef.Name]
+		if pcfg.Disabled {
+			continue
+		}
+		rate := pcfg.Rate
+		if rate <= 0 {
+			rate = profile.DefaultRate
+		}
+		sp := &simPacket{
+			def:      pdef,
+			interval: time.Duration(float64(time.Second) / rate),
+		}
+		for idx := 0; idx < max(1, pdef.Repeat); idx++ {
+			gens := make([]*simGen, len(pdef.Data))
+			for j := range pdef.Data {
+				fdef := &pdef.Data[j]
+				g := &simGen{def: fdef, cfg: pcfg.Fields[fdef.Name], phys: simPhysics[pdef.Name+"."+fdef.Name]}
+				if g.cfg.Kind == "" && g.phys == nil {
+					// nothing given, wander around in a range that fits the type.
+					g.cfg.Kind = "walk"
+					lo, hi := typeRange(fdef.Type)
+					g.cfg.Min = max(0, lo*fdef.Scale())
+					g.cfg.Max = min(100, hi*fdef.Scale())
+				}
+				if g.cfg.Kind == "sine" && g.cfg.Period <= 0 {
+					return nil, fmt.Errorf("field %s.%s: sine needs a period", pdef.Name, fdef.Name)
+				}
+				if fdef.Type == "bitfield" {
+					g.value = 0
+				} else {
+					g.value = (g.cfg.Min + g.cfg.Max) / 2
+				}
+				gens[j] = g
+			}
+			sp.fields = append(sp.fields, gens)
+		}
+		s.packets = append(s.packets, sp)
+	}
+	return s, nil
+}
+
+// build creates one packet instance from the current state.
+func (s *Simulator) build(sp *simPacket, idx int) (skylab.Packet, error) {
+	obj := make(map[string]any, len(sp.def.Data)+1)
+	for _, g := range sp.fields[idx] {
+		obj[g.def.Name] = g.next(s.vehicle, idx, s.rng)
+	}
+	if sp.def.Repeat > 0 {
+		obj["idx"] = idx
+	}
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	return skylab.FromJson(sp.def.Name, raw)
+}
+
+// Step advances the simulation to now, and returns the packets that are due.
+// The first call returns every packet.
+func (s *Simulator) Step(now time.Time) ([]skylab.BusEvent, error) {
+	if !s.last.IsZero() {
+		s.vehicle.step(now.Sub(s.last).Seconds(), s.rng)
+	} else {
+		s.vehicle.step(0, s.rng)
+	}
+	s.last = now
+
+	var events []skylab.BusEvent
+	for _, sp := range s.packets {
+		if now.Before(sp.due) {
+			continue
+		}
+		sp.due = sp.due.Add(sp.interval)
+		if sp.due.Before(now) {
+			// we fell behind, don't try to catch up.
+			sp.due = now.Add(sp.interval)
+		}
+		for idx := range sp.fields {
+			pkt, err := s.build(sp, idx)
+			if err != nil {
+				return events, fmt.Errorf("building %s: %w", sp.def.Name, err)
+			}
+			events = append(events, skylab.BusEvent{
+				Timestamp: now,
+				Name:      sp.def.Name,
+				Data:      pkt,
+			})
+		}
+	}
+	return events, nil
+}
+
+// Run publishes simulated packets to the broker until the context is cancelled.
+func (s *Simulator) Run(ctx context.Context, broker *Broker) error {
+	ticker := time.NewTicker(simTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			events, err := s.Step(now)
+			if err != nil {
+				return err
+			}
+			for _, ev := range events {
+				broker.Publish(simSender, ev)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package gotelem
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+func TestSimulator(t *testing.T) {
+	t.Run("every packet", func(t *testing.T) {
+		sim, err := NewSimulator(SimProfile{Seed: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err := sim.Step(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defs, _ := skylab.Definitions()
+		want := 0
+		for _, p := range defs.Packets {
+			want += max(1, p.Repeat)
+		}
+		if len(events) != want {
+			t.Fatalf("expected %d events, got %d", want, len(events))
+		}
+		for _, ev := range events {
+			if ev.Name != ev.Data.String() {
+				t.Fatalf("event name %s does not match packet %s", ev.Name, ev.Data.String())
+			}
+			if _, err := skylab.ToCanFrame(ev.Data); err != nil {
+				t.Fatalf("could not encode %s: %v", ev.Name, err)
+			}
+		}
+	})
+
+	t.Run("consistent physics", func(t *testing.T) {
+		profile := DefaultSimProfile()
+		profile.Seed = 1
+		sim, err := NewSimulator(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		checked := 0
+		for i := 0; i < 600; i++ {
+			now = now.Add(100 * time.Millisecond)
+			events, err := sim.Step(now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]skylab.Packet)
+			for _, ev := range events {
+				got[ev.Name] = ev.Data
+			}
+			bms, ok1 := got["bms_measurement"].(*skylab.BmsMeasurement)
+			left, ok2 := got["tritium_motor_power_l"].(*skylab.TritiumMotorPowerL)
+			right, ok3 := got["tritium_motor_power_r"].(*skylab.TritiumMotorPowerR)
+			array, ok4 := got["array_power"].(*skylab.ArrayPower)
+			if !ok1 || !ok2 || !ok3 || !ok4 {
+				continue
+			}
+			checked++
+			packV := float64(bms.BatteryVoltage) * 0.01
+			arrayW := float64(array.FrontArrayChannel0) + float64(array.FrontArrayChannel1) +
+				float64(array.RearArrayChannel0) + float64(array.RearArrayChannel1)
+			want := float64(left.BusCurrent) + float64(right.BusCurrent) - arrayW/packV
+			if math.Abs(want-float64(bms.Current)) > 0.1 {
+				t.Fatalf("pack current %f does not match motors and array %f", bms.Current, want)
+			}
+			if speed, ok := got["car_speed"].(*skylab.CarSpeed); ok {
+				wsl := got["wsl_velocity"].(*skylab.WslVelocity)
+				if speed.Speed != wsl.VehicleVelocity {
+					t.Fatalf("car speed %f does not match wsl %f", speed.Speed, wsl.VehicleVelocity)
+				}
+			}
+		}
+		if checked == 0 {
+			t.Fatal("never got all the packets in one step")
+		}
+	})
+
+	t.Run("yaml profile", func(t *testing.T) {
+		profile, err := ParseSimProfile([]byte(`
+seed: 3
+default_rate: 2
+packets:
+  bms_soc:
+    fields:
+      soc: {kind: const, value: 42}
+  bms_kill:
+    disabled: true
+  car_speed:
+    rate: 10
+    fields:
+      speed: {kind: sine, min: 0, max: 10, period: 30s}
+`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profile.Packets["car_speed"].Fields["speed"].Period != 30*time.Second {
+			t.Fatalf("bad period %v", profile.Packets["car_speed"].Fields["speed"].Period)
+		}
+		sim, err := NewSimulator(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events, err := sim.Step(time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range events {
+			switch pkt := ev.Data.(type) {
+			case *skylab.BmsSoc:
+				if pkt.Soc != 42 {
+					t.Fatalf("expected const soc, got %f", pkt.Soc)
+				}
+			case *skylab.BmsKill:
+				t.Fatal("got disabled packet")
+			}
+		}
+
+		_, err = NewSimulator(SimProfile{Packets: map[string]SimPacket{"not_a_packet": {}}})
+		if err == nil {
+			t.Fatal("expected error for unknown packet")
+		}
+	})
+}
@@ -0,0 +1,126 @@
+package skylab
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/kschamplin/gotelem/internal/can"
+)
+
+// This file implements a compact binary encoding of bus events, which is a
+// lot smaller than JSON. Each event is framed as:
+//
+//	ts   int64, unix milliseconds
+//	id   uint32, the CAN id. Bit 31 is set for extended ids, like socketcan.
+//	len  uint8, the length of data
+//	data the packet from MarshalPacket
+//
+// Everything is little endian. The name isn't sent since it comes from the
+// id. Frames are self-delimiting, so a stream of events is just frames one
+// after another.
+
+// BinaryMediaType is the media type of binary encoded events.
+const BinaryMediaType = "application/x-skylab"
+
+const binaryHeaderSize = 8 + 4 + 1
+
+// the length is one byte.
+const maxBinaryData = 255
+
+const extendedFlag = 1 << 31
+
+// AppendBinary appends the binary encoding of the event to b.
+func AppendBinary(b []byte, e BusEvent) ([]byte, error) {
+	id, err := e.Data.CanId()
+	if err != nil {
+		return b, err
+	}
+	data, err := e.Data.MarshalPacket()
+	if err != nil {
+		return b, err
+	}
+	if len(data) > maxBinaryData {
+		return b, fmt.Errorf("packet %s is too long: %d bytes", e.Name, len(data))
+	}
+	rawId := id.Id
+	if id.Extended {
+		rawId |= extendedFlag
+	}
+	b = binary.LittleEndian.AppendUint64(b, uint64(e.Timestamp.UnixMilli()))
+	b = binary.LittleEndian.AppendUint32(b, rawId)
+	b = append(b, byte(len(data)))
+	return append(b, data...), nil
+}
+
+// MarshalBinary encodes the event as a single binary frame.
+func (e BusEvent) MarshalBinary() ([]byte, error) {
+	return AppendBinary(make([]byte, 0, binaryHeaderSize+int(e.Data.Size())), e)
+}
+
+// UnmarshalBinary decodes a single binary frame. Extra bytes are an error.
+func (e *BusEvent) UnmarshalBinary(b []byte) error {
+	n, err := e.decodeBinary(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return fmt.Errorf("%d extra bytes after frame", len(b)-n)
+	}
+	return nil
+}
+
+// decodeBinary decodes the frame at the start of b, and returns its length.
+func (e *BusEvent) decodeBinary(b []byte) (int, error) {
+	if len(b) < binaryHeaderSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+	ts := int64(binary.LittleEndian.Uint64(b))
+	rawId := binary.LittleEndian.Uint32(b[8:])
+	n := binaryHeaderSize + int(b[12])
+	if len(b) < n {
+		return 0, io.ErrUnexpectedEOF
+	}
+	f := can.Frame{
+		Id:   can.CanID{Id: rawId &^ extendedFlag, Extended: rawId&extendedFlag != 0},
+		Data: b[binaryHeaderSize:n],
+		Kind: can.CanDataFrame,
+	}
+	p, err := FromCanFrame(f)
+	if err != nil {
+		return 0, err
+	}
+	e.Timestamp = time.UnixMilli(ts)
+	e.Name = p.String()
+	e.Data = p
+	return n, nil
+}
+
+// BinaryDecoder reads binary frames from a stream.
+type BinaryDecoder struct {
+	r   io.Reader
+	buf [binaryHeaderSize + maxBinaryData]byte
+}
+
+func NewBinaryDecoder(r io.Reader) *BinaryDecoder {
+	return &BinaryDecoder{r: r}
+}
+
+// Decode reads the next event. It returns io.EOF at the end of the stream,
+// and io.ErrUnexpectedEOF if the stream ends in the middle of a frame.
+func (d *BinaryDecoder) Decode(e *BusEvent) error {
+	if _, err := io.ReadFull(d.r, d.buf[:binaryHeaderSize]); err != nil {
+		return err
+	}
+	n := binaryHeaderSize + int(d.buf[12])
+	if _, err := io.ReadFull(d.r, d.buf[binaryHeaderSize:n]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	_, err := e.decodeBinary(d.buf[:n])
+	return err
+}
@@ -0,0 +1,99 @@
+package skylab
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/kschamplin/gotelem/internal/can"
+)
+
+func TestBinary(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	ts := time.UnixMilli(1700000000123)
+	var stream []byte
+	var events []BusEvent
+	for id := range idMap {
+		p, _ := FromCanFrame(can.Frame{Id: id})
+		data := make([]byte, p.Size())
+		rng.Read(data)
+		p, err := FromCanFrame(can.Frame{Id: id, Data: data})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ev := BusEvent{Timestamp: ts, Name: p.String(), Data: p}
+
+		b, err := ev.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(b) != binaryHeaderSize+len(data) {
+			t.Errorf("%s: expected %d bytes, got %d", ev.Name, binaryHeaderSize+len(data), len(b))
+		}
+		var got BusEvent
+		if err := got.UnmarshalBinary(b); err != nil {
+			t.Fatalf("%s: %v", ev.Name, err)
+		}
+		// compare the bytes, random floats can be NaN.
+		gotData, _ := got.Data.MarshalPacket()
+		wantData, _ := p.MarshalPacket()
+		if got.Name != ev.Name || !got.Timestamp.Equal(ev.Timestamp) || !bytes.Equal(gotData, wantData) {
+			t.Errorf("%s: round trip mismatch, got %+v", ev.Name, got)
+		}
+		stream = append(stream, b...)
+		events = append(events, ev)
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		dec := NewBinaryDecoder(bytes.NewReader(stream))
+		for i := range events {
+			var got BusEvent
+			if err := dec.Decode(&got); err != nil {
+				t.Fatalf("event %d: %v", i, err)
+			}
+			if got.Name != events[i].Name {
+				t.Fatalf("event %d: got %s want %s", i, got.Name, events[i].Name)
+			}
+		}
+		var ev BusEvent
+		if err := dec.Decode(&ev); err != io.EOF {
+			t.Fatalf("expected EOF, got %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		b, _ := events[0].MarshalBinary()
+		var ev BusEvent
+		if err := ev.UnmarshalBinary(b[:len(b)-1]); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+		}
+		dec := NewBinaryDecoder(bytes.NewReader(b[:len(b)-1]))
+		if err := dec.Decode(&ev); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected ErrUnexpectedEOF, got %v", err)
+		}
+		if err := ev.UnmarshalBinary(append(b, 0)); err == nil {
+			t.Fatal("expected an error for extra bytes")
+		}
+	})
+
+	t.Run("unknown id", func(t *testing.T) {
+		// the same id as a standard packet, but extended. events is in map
+		// order, so look for one.
+		var b []byte
+		for _, ev := range events {
+			if id, _ := ev.Data.CanId(); !id.Extended {
+				b, _ = ev.MarshalBinary()
+				break
+			}
+		}
+		b[11] |= 0x80
+		var ev BusEvent
+		var idErr *UnknownIdError
+		if err := ev.UnmarshalBinary(b); !errors.As(err, &idErr) {
+			t.Fatalf("expected UnknownIdError, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,295 @@
+package skylab
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/kschamplin/gotelem/internal/can"
+	"gopkg.in/yaml.v3"
+)
+
+// This file decodes packets using definitions loaded at runtime instead of the
+// generated structs. This is used to decode stored frames again after a packet
+// layout was fixed, without rebuilding. The encoding matches the generated
+// code, so the same definitions give the same JSON.
+
+// LoadDefinitions reads skylab definitions from a YAML file, or from every
+// YAML file in a directory like make_skylab.go does.
+func LoadDefinitions(path string) (*SkylabFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		files = nil
+		for _, ext := range []string{"*.yaml", "*.yml"} {
+			matches, err := filepath.Glob(filepath.Join(path, ext))
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, matches...)
+		}
+	}
+	res := &SkylabFile{}
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		sf := SkylabFile{}
+		if err := yaml.Unmarshal(data, &sf); err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Base(f), err)
+		}
+		res.Packets = append(res.Packets, sf.Packets...)
+		res.Boards = append(res.Boards, sf.Boards...)
+	}
+	return res, nil
+}
+
+// DynamicPacket is a packet decoded using runtime definitions. It implements
+// Packet, and marshals to the same JSON as the generated struct would.
+type DynamicPacket struct {
+	Def *PacketDef
+	// Values has one entry for each field in Def.Data. Numbers have the Go
+	// type of the field (i.e uint16), bitfields are []bool.
+	Values []any
+	Idx    uint32
+}
+
+// Value gets the value of a field by name.
+func (p *DynamicPacket) Value(name string) (any, bool) {
+	for i, f := range p.Def.Data {
+		if f.Name == name {
+			return p.Values[i], true
+		}
+	}
+	return nil, false
+}
+
+func (p *DynamicPacket) String() string {
+	return p.Def.Name
+}
+
+func (p *DynamicPacket) Size() uint {
+	size := 0
+	for i := range p.Def.Data {
+		size += p.Def.Data[i].Size()
+	}
+	return uint(size)
+}
+
+func (p *DynamicPacket) CanId() (can.CanID, error) {
+	c := can.CanID{Id: p.Def.Id, Extended: p.Def.IsExtended}
+	if p.Def.Repeat > 0 {
+		if p.Idx >= uint32(p.Def.Repeat) {
+			return c, &UnknownIdError{p.Def.Id}
+		}
+		c.Id += p.Idx
+	}
+	return c, nil
+}
+
+func (p *DynamicPacket) UnmarshalPacket(b []byte) error {
+	if len(b) != int(p.Size()) {
+		return &BadLengthError{expected: uint32(p.Size()), actual: uint32(len(b))}
+	}
+	p.Values = make([]any, len(p.Def.Data))
+	offset := 0
+	for i := range p.Def.Data {
+		f := &p.Def.Data[i]
+		v, err := decodeField(f, b[offset:])
+		if err != nil {
+			return err
+		}
+		p.Values[i] = v
+		offset += f.Size()
+	}
+	return nil
+}
+
+func (p *DynamicPacket) MarshalPacket() ([]byte, error) {
+	b := make([]byte, p.Size())
+	offset := 0
+	for i := range p.Def.Data {
+		f := &p.Def.Data[i]
+		if err := encodeField(f, p.Values[i], b[offset:]); err != nil {
+			return nil, err
+		}
+		offset += f.Size()
+	}
+	return b, nil
+}
+
+// MarshalJSON writes the fields in definition order, like the generated structs.
+func (p *DynamicPacket) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := range p.Def.Data {
+		f := &p.Def.Data[i]
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		writeJsonKey(&buf, f.Name)
+		if f.Type == "bitfield" {
+			bits := p.Values[i].([]bool)
+			buf.WriteByte('{')
+			for j, bit := range f.Bits {
+				if j > 0 {
+					buf.WriteByte(',')
+				}
+				writeJsonKey(&buf, bit.Name)
+				fmt.Fprintf(&buf, "%t", bits[j])
+			}
+			buf.WriteByte('}')
+			continue
+		}
+		v, err := json.Marshal(p.Values[i])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(v)
+	}
+	if p.Def.Repeat > 0 {
+		if len(p.Def.Data) > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `"idx":%d`, p.Idx)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func writeJsonKey(buf *bytes.Buffer, key string) {
+	k, _ := json.Marshal(key)
+	buf.Write(k)
+	buf.WriteByte(':')
+}
+
+// the generated code is always little endian, so this is too.
+func decodeField(f *FieldDef, b []byte) (any, error) {
+	le := binary.LittleEndian
+	switch f.Type {
+	case "uint8_t":
+		return b[0], nil
+	case "int8_t":
+		return int8(b[0]), nil
+	case "uint16_t":
+		return le.Uint16(b), nil
+	case "int16_t":
+		return int16(le.Uint16(b)), nil
+	case "uint32_t":
+		return le.Uint32(b), nil
+	case "int32_t":
+		return int32(le.Uint32(b)), nil
+	case "uint64_t":
+		return le.Uint64(b), nil
+	case "int64_t":
+		return int64(le.Uint64(b)), nil
+	case "float":
+		return math.Float32frombits(le.Uint32(b)), nil
+	case "bitfield":
+		bits := make([]bool, len(f.Bits))
+		for i := range bits {
+			bits[i] = b[0]&(1<<i) != 0
+		}
+		return bits, nil
+	}
+	return nil, fmt.Errorf("field %s has unknown type %s", f.Name, f.Type)
+}
+
+func encodeField(f *FieldDef, v any, b []byte) error {
+	le := binary.LittleEndian
+	switch n := v.(type) {
+	case uint8:
+		b[0] = n
+	case int8:
+		b[0] = byte(n)
+	case uint16:
+		le.PutUint16(b, n)
+	case int16:
+		le.PutUint16(b, uint16(n))
+	case uint32:
+		le.PutUint32(b, n)
+	case int32:
+		le.PutUint32(b, uint32(n))
+	case uint64:
+		le.PutUint64(b, n)
+	case int64:
+		le.PutUint64(b, uint64(n))
+	case float32:
+		le.PutUint32(b, math.Float32bits(n))
+	case []bool:
+		b[0] = 0
+		for i, bit := range n {
+			if bit {
+				b[0] |= 1 << i
+			}
+		}
+	default:
+		return fmt.Errorf("field %s has bad value type %T", f.Name, v)
+	}
+	return nil
+}
+
+type decoderEntry struct {
+	def *PacketDef
+	idx uint32
+}
+
+// Decoder decodes can frames with definitions loaded at runtime.
+type Decoder struct {
+	ids map[can.CanID]decoderEntry
+}
+
+// NewDecoder makes a decoder for the given definitions.
+func NewDecoder(defs *SkylabFile) (*Decoder, error) {
+	d := &Decoder{ids: make(map[can.CanID]decoderEntry)}
+	for i := range defs.Packets {
+		p := &defs.Packets[i]
+		for j := range p.Data {
+			if p.Data[j].Size() == 0 {
+				return nil, fmt.Errorf("packet %s: field %s has unknown type %s", p.Name, p.Data[j].Name, p.Data[j].Type)
+			}
+		}
+		if p.Repeat == 0 {
+			d.ids[can.CanID{Id: p.Id, Extended: p.IsExtended}] = decoderEntry{def: p}
+			continue
+		}
+		// same as the generated code, the index is the offset from the first id.
+		for _, id := range nx(int(p.Id), p.Repeat, p.Offset) {
+			d.ids[can.CanID{Id: uint32(id), Extended: p.IsExtended}] = decoderEntry{def: p, idx: uint32(id) - p.Id}
+		}
+	}
+	return d, nil
+}
+
+// FromCanFrame is like the package FromCanFrame, but uses the decoder's
+// definitions. Unlike the generated version it returns an error if the frame
+// has the wrong length.
+func (d *Decoder) FromCanFrame(f can.Frame) (Packet, error) {
+	e, ok := d.ids[f.Id]
+	if !ok {
+		return nil, &UnknownIdError{f.Id.Id}
+	}
+	p := &DynamicPacket{Def: e.def, Idx: e.idx}
+	if err := p.UnmarshalPacket(f.Data); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// nx takes a start, a quantity, and an offset and returns the ids of a
+// repeated packet. It's the same as Nx in make_skylab.go.
+func nx(start, times, offset int) (elems []int) {
+	elems = make([]int, times)
+	for i := 0; i < times; i++ {
+		elems[i] = start + offset*i
+	}
+	return
+}
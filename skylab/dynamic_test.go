@@ -0,0 +1,139 @@
+package skylab
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kschamplin/gotelem/internal/can"
+)
+
+func TestDecoder(t *testing.T) {
+	defs, err := Definitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := NewDecoder(defs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("matches generated", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(1))
+		for id := range idMap {
+			gen, err := FromCanFrame(can.Frame{Id: id})
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := make([]byte, gen.Size())
+			var genJson []byte
+			// random floats can be NaN, which can't be marshalled.
+			for {
+				rng.Read(data)
+				gen, _ = FromCanFrame(can.Frame{Id: id, Data: data})
+				if genJson, err = json.Marshal(gen); err == nil {
+					break
+				}
+			}
+			dyn, err := dec.FromCanFrame(can.Frame{Id: id, Data: data})
+			if err != nil {
+				t.Fatalf("%s: %v", gen.String(), err)
+			}
+			if dyn.String() != gen.String() {
+				t.Errorf("name mismatch, got %s want %s", dyn.String(), gen.String())
+			}
+			dynJson, err := json.Marshal(dyn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dynJson, genJson) {
+				t.Errorf("%s: json mismatch\ngot  %s\nwant %s", gen.String(), dynJson, genJson)
+			}
+			genBytes, _ := gen.MarshalPacket()
+			dynBytes, err := dyn.MarshalPacket()
+			if err != nil || !bytes.Equal(dynBytes, genBytes) {
+				t.Errorf("%s: bytes mismatch, got %x want %x (%v)", gen.String(), dynBytes, genBytes, err)
+			}
+			dynId, _ := dyn.CanId()
+			if dynId != id {
+				t.Errorf("%s: id mismatch, got %v want %v", gen.String(), dynId, id)
+			}
+		}
+	})
+
+	t.Run("unknown id", func(t *testing.T) {
+		_, err := dec.FromCanFrame(can.Frame{Id: can.CanID{Id: 0x7ff}})
+		var idErr *UnknownIdError
+		if !errors.As(err, &idErr) {
+			t.Fatalf("expected UnknownIdError, got %v", err)
+		}
+	})
+
+	t.Run("bad length", func(t *testing.T) {
+		_, err := dec.FromCanFrame(can.Frame{Id: can.CanID{Id: 0x10}, Data: []byte{1, 2}})
+		var lenErr *BadLengthError
+		if !errors.As(err, &lenErr) {
+			t.Fatalf("expected BadLengthError, got %v", err)
+		}
+	})
+}
+
+func TestLoadDefinitions(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.yaml": `
+packets:
+  - name: test_packet
+    id: 0x123
+    data:
+      - name: value
+        type: int16_t
+`,
+		"b.yml": `
+packets:
+  - name: other_packet
+    id: 0x124
+    data:
+      - name: flags
+        type: bitfield
+        bits:
+          - name: on
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defs, err := LoadDefinitions(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(defs.Packets) != 2 {
+		t.Fatalf("expected 2 packets, got %d", len(defs.Packets))
+	}
+	dec, err := NewDecoder(defs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := dec.FromCanFrame(can.Frame{Id: can.CanID{Id: 0x123}, Data: []byte{0xfe, 0xff}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(p)
+	if string(b) != `{"value":-2}` {
+		t.Errorf("unexpected json %s", b)
+	}
+	p, err = dec.FromCanFrame(can.Frame{Id: can.CanID{Id: 0x124}, Data: []byte{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ = json.Marshal(p)
+	if string(b) != `{"flags":{"on":true}}` {
+		t.Errorf("unexpected json %s", b)
+	}
+}
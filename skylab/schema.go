@@ -0,0 +1,122 @@
+package skylab
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// This file provides the packet definitions at runtime. The types mirror the
+// ones used by make_skylab.go, and are parsed from SkylabDefinitions, so
+// code that needs to work with every packet (simulators, viewers) doesn't
+// have to know about the generated structs.
+
+// SkylabFile is a parsed skylab definition file.
+type SkylabFile struct {
+	Packets []PacketDef `yaml:"packets,omitempty" json:"packets,omitempty"`
+	Boards  []BoardDef  `yaml:"boards,omitempty" json:"boards,omitempty"`
+}
+
+type BoardDef struct {
+	Name     string   `yaml:"name,omitempty" json:"name,omitempty"`
+	Transmit []string `yaml:"transmit,omitempty" json:"transmit,omitempty"`
+	Receive  []string `yaml:"receive,omitempty" json:"receive,omitempty"`
+}
+
+// FieldDef is a single data field of a packet.
+type FieldDef struct {
+	Name       string  `yaml:"name,omitempty" json:"name,omitempty"`
+	Type       string  `yaml:"type,omitempty" json:"type,omitempty"`
+	Units      string  `yaml:"units,omitempty" json:"units,omitempty"`
+	Conversion float32 `yaml:"conversion,omitempty" json:"conversion,omitempty"`
+	Bits       []struct {
+		Name string `yaml:"name,omitempty" json:"name,omitempty"`
+	} `yaml:"bits,omitempty" json:"bits,omitempty"`
+}
+
+// PacketDef is a full can packet.
+type PacketDef struct {
+	Name        string     `yaml:"name,omitempty" json:"name,omitempty"`
+	Description string     `yaml:"description,omitempty" json:"description,omitempty"`
+	Id          uint32     `yaml:"id,omitempty" json:"id,omitempty"`
+	Endian      string     `yaml:"endian,omitempty" json:"endian,omitempty"`
+	IsExtended  bool       `yaml:"is_extended,omitempty" json:"is_extended,omitempty"`
+	Repeat      int        `yaml:"repeat,omitempty" json:"repeat,omitempty"`
+	Offset      int        `yaml:"offset,omitempty" json:"offset,omitempty"`
+	Data        []FieldDef `yaml:"data,omitempty" json:"data,omitempty"`
+}
+
+// typeSizes is the size in bytes of each field type.
+var typeSizes = map[string]int{
+	"uint16_t": 2,
+	"uint32_t": 4,
+	"uint64_t": 8,
+	"uint8_t":  1,
+	"float":    4,
+
+	"int16_t":  2,
+	"int32_t":  4,
+	"int64_t":  8,
+	"int8_t":   1,
+	"bitfield": 1,
+}
+
+// Size returns the size of the field in bytes, or zero for unknown types.
+func (f *FieldDef) Size() int {
+	return typeSizes[f.Type]
+}
+
+// Scale returns the conversion factor of the field. A missing conversion
+// means the raw value is already in the right units.
+func (f *FieldDef) Scale() float64 {
+	if f.Conversion == 0 {
+		return 1
+	}
+	return float64(f.Conversion)
+}
+
+// Field finds a field of the packet by name.
+func (p *PacketDef) Field(name string) (*FieldDef, bool) {
+	for i := range p.Data {
+		if p.Data[i].Name == name {
+			return &p.Data[i], true
+		}
+	}
+	return nil, false
+}
+
+// Indexes returns the idx of each copy of a repeated packet, which is the
+// offset of its id from the first one. It's nil if the packet isn't repeated.
+func (p *PacketDef) Indexes() []uint32 {
+	if p.Repeat == 0 {
+		return nil
+	}
+	res := make([]uint32, 0, p.Repeat)
+	for _, id := range nx(int(p.Id), p.Repeat, p.Offset) {
+		res = append(res, uint32(id)-p.Id)
+	}
+	return res
+}
+
+// Packet finds a packet definition by name.
+func (s *SkylabFile) Packet(name string) (*PacketDef, bool) {
+	for i := range s.Packets {
+		if s.Packets[i].Name == name {
+			return &s.Packets[i], true
+		}
+	}
+	return nil, false
+}
+
+var definitionsOnce sync.Once
+var definitions *SkylabFile
+var definitionsErr error
+
+// Definitions returns the packet definitions that were used to generate
+// this package. The result is shared, so it must not be modified.
+func Definitions() (*SkylabFile, error) {
+	definitionsOnce.Do(func() {
+		definitions = &SkylabFile{}
+		definitionsErr = json.Unmarshal([]byte(SkylabDefinitions), definitions)
+	})
+	return definitions, definitionsErr
+}
@@ -0,0 +1,315 @@
+package gotelem
+
+// this file implements /api/v1/stats, the health of the server. It's the
+// first thing to check when the data looks stale. Things outside of this
+// package (i.e the xbee and socketCAN services) add their own status with
+// StatsTracker.RegisterStatus.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// StatusFunc reports the status of part of the server. The result is
+// encoded as JSON, and it's called for every stats request so it should be
+// quick.
+type StatusFunc func() any
+
+// StatsTracker keeps the stats of one server that don't belong to the
+// broker or the database: the requests, websocket clients, and the status of
+// the services. Make one with NewStatsTracker and pass it to TelemRouter.
+type StatsTracker struct {
+	started  time.Time // used for the uptime.
+	requests requestCounter
+
+	wsLock    sync.Mutex
+	wsClients map[string]int64
+
+	statusLock  sync.RWMutex
+	statusFuncs map[string]StatusFunc
+}
+
+// NewStatsTracker makes an empty tracker. The uptime starts now.
+func NewStatsTracker() *StatsTracker {
+	return &StatsTracker{
+		started:     time.Now(),
+		wsClients:   make(map[string]int64),
+		statusFuncs: make(map[string]StatusFunc),
+	}
+}
+
+// RegisterStatus adds a status to the services in the stats. Registering
+// the same name again replaces it, and a nil fn removes it.
+func (s *StatsTracker) RegisterStatus(name string, fn StatusFunc) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	if fn == nil {
+		delete(s.statusFuncs, name)
+		return
+	}
+	s.statusFuncs[name] = fn
+}
+
+func (s *StatsTracker) serviceStatus() map[string]any {
+	s.statusLock.RLock()
+	defer s.statusLock.RUnlock()
+	res := make(map[string]any, len(s.statusFuncs))
+	for name, fn := range s.statusFuncs {
+		res[name] = fn()
+	}
+	return res
+}
+
+// WriteStats are the timings of database inserts. Each batch is a single
+// transaction.
+type WriteStats struct {
+	Batches   uint64    `json:"batches"`
+	Rows      uint64    `json:"rows"`
+	Errors    uint64    `json:"errors"`
+	LastMs    float64   `json:"last_ms"`
+	AvgMs     float64   `json:"avg_ms"`
+	MaxMs     float64   `json:"max_ms"`
+	TotalMs   float64   `json:"total_ms"`
+	LastWrite time.Time `json:"last_write"`
+}
+
+type writeStats struct {
+	mu                    sync.Mutex
+	batches, rows, errors uint64
+	last, max, total      time.Duration
+	lastWrite             time.Time
+}
+
+// record adds a batch that started at start, call it once the batch is done.
+func (s *writeStats) record(start time.Time, n int64, err error) {
+	now := time.Now()
+	d := now.Sub(start)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches++
+	if err != nil {
+		s.errors++
+	} else {
+		s.rows += uint64(n)
+	}
+	s.last = d
+	s.max = max(s.max, d)
+	s.total += d
+	s.lastWrite = now
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (s *writeStats) get() WriteStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := WriteStats{
+		Batches:   s.batches,
+		Rows:      s.rows,
+		Errors:    s.errors,
+		LastMs:    ms(s.last),
+		MaxMs:     ms(s.max),
+		TotalMs:   ms(s.total),
+		LastWrite: s.lastWrite,
+	}
+	if s.batches > 0 {
+		st.AvgMs = ms(s.total / time.Duration(s.batches))
+	}
+	return st
+}
+
+// writeTimings gets the write stats of each table that's written to.
+func (tdb *TelemDb) writeTimings() map[string]WriteStats {
+	return map[string]WriteStats{
+		"bus_events": tdb.eventWrites.get(),
+		"raw_frames": tdb.frameWrites.get(),
+	}
+}
+
+// DbStats are the write timings and the size of the database.
+type DbStats struct {
+	Events WriteStats       `json:"events"`
+	Frames WriteStats       `json:"frames"`
+	Rows   map[string]int64 `json:"rows"`    // rows in each table.
+	RowsAt time.Time        `json:"rows_at"` // when the rows were counted.
+}
+
+// the tables that are counted in DbStats.
+var statsTables = []string{"bus_events", "raw_frames", "drive_records", "import_log", "openmct_objects"}
+
+// rowCountAge is how long the row counts are reused. COUNT(*) reads the
+// whole table, which is too slow to do on every request.
+const rowCountAge = 30 * time.Second
+
+// rowCounts are the cached row counts of the stats tables.
+type rowCounts struct {
+	mu   sync.Mutex
+	at   time.Time
+	rows map[string]int64
+}
+
+// get counts the rows again if the last count is too old. The lock is held
+// while counting, so requests at the same time only count once.
+func (c *rowCounts) get(ctx context.Context, tdb *TelemDb) (map[string]int64, time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rows != nil && time.Since(c.at) < rowCountAge {
+		return maps.Clone(c.rows), c.at, nil
+	}
+	rows := make(map[string]int64, len(statsTables))
+	for _, table := range statsTables {
+		var n int64
+		err := tdb.db.GetContext(ctx, &n, fmt.Sprintf(`SELECT COUNT(*) FROM "%s"`, table))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		rows[table] = n
+	}
+	c.rows, c.at = rows, time.Now()
+	return maps.Clone(rows), c.at, nil
+}
+
+// Stats gets the write timings since the database was opened, and the row
+// counts of the main tables, which can be up to rowCountAge old.
+func (tdb *TelemDb) Stats(ctx context.Context) (DbStats, error) {
+	st := DbStats{
+		Events: tdb.eventWrites.get(),
+		Frames: tdb.frameWrites.get(),
+	}
+	var err error
+	st.Rows, st.RowsAt, err = tdb.rowCounts.get(ctx, tdb)
+	return st, err
+}
+
+// HttpStats counts requests to the server. Active includes websockets.
+type HttpStats struct {
+	Requests   uint64            `json:"requests"`
+	Active     int64             `json:"active"`
+	ByStatus   map[string]uint64 `json:"by_status"`  // by class, i.e 2xx.
+	Websockets map[string]int64  `json:"websockets"` // connected clients by endpoint.
+}
+
+type requestCounter struct {
+	total  atomic.Uint64
+	active atomic.Int64
+	// 1xx to 5xx, anything else is counted as 5xx.
+	classes [5]atomic.Uint64
+}
+
+func (c *requestCounter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.total.Add(1)
+		c.active.Add(1)
+		defer c.active.Add(-1)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+		status := ww.Status()
+		if status == 0 {
+			// nothing was written, which is a 200.
+			status = http.StatusOK
+		}
+		class := min(max(status/100, 1), 5)
+		c.classes[class-1].Add(1)
+	})
+}
+
+func (c *requestCounter) get() HttpStats {
+	st := HttpStats{
+		Requests: c.total.Load(),
+		Active:   c.active.Load(),
+		ByStatus: make(map[string]uint64),
+	}
+	for i := range c.classes {
+		if n := c.classes[i].Load(); n > 0 {
+			st.ByStatus[fmt.Sprintf("%dxx", i+1)] = n
+		}
+	}
+	return st
+}
+
+// httpStats gets the request counts and the websocket clients.
+func (s *StatsTracker) httpStats() HttpStats {
+	st := s.requests.get()
+	st.Websockets = s.websocketClients()
+	return st
+}
+
+// trackWebsocket counts a connected websocket client of the endpoint. Call
+// the returned function when it disconnects.
+func (s *StatsTracker) trackWebsocket(endpoint string) func() {
+	s.wsLock.Lock()
+	s.wsClients[endpoint]++
+	s.wsLock.Unlock()
+	return func() {
+		s.wsLock.Lock()
+		s.wsClients[endpoint]--
+		s.wsLock.Unlock()
+	}
+}
+
+func (s *StatsTracker) websocketClients() map[string]int64 {
+	s.wsLock.Lock()
+	defer s.wsLock.Unlock()
+	return maps.Clone(s.wsClients)
+}
+
+// BrokerStats are the subscribers of the broker and the packets it sees.
+type BrokerStats struct {
+	Subscribers int               `json:"subscribers"`
+	Dropped     uint64            `json:"dropped"` // total for every subscriber, including ones that left.
+	Clients     []SubscriberStats `json:"clients"`
+	Packets     []PacketStats     `json:"packets"`
+}
+
+// ServerStats is the response of /api/v1/stats. If the database can't be
+// read, Db is nil and DbError says why.
+type ServerStats struct {
+	Started  time.Time      `json:"started"`
+	Uptime   float64        `json:"uptime"` // seconds.
+	Http     HttpStats      `json:"http"`
+	Broker   BrokerStats    `json:"broker"`
+	Db       *DbStats       `json:"db"`
+	DbError  string         `json:"db_error,omitempty"`
+	Services map[string]any `json:"services"`
+}
+
+func collectStats(ctx context.Context, broker *Broker, tdb *TelemDb, stats *StatsTracker) ServerStats {
+	st := ServerStats{
+		Started:  stats.started,
+		Uptime:   time.Since(stats.started).Seconds(),
+		Http:     stats.httpStats(),
+		Services: stats.serviceStatus(),
+	}
+	st.Broker.Clients = broker.Stats()
+	st.Broker.Subscribers = len(st.Broker.Clients)
+	_, st.Broker.Dropped = broker.Totals()
+	st.Broker.Packets = broker.PacketStats()
+
+	dbStats, err := tdb.Stats(ctx)
+	if err != nil {
+		st.DbError = err.Error()
+	} else {
+		st.Db = &dbStats
+	}
+	return st
+}
+
+func apiV1Stats(broker *Broker, tdb *TelemDb, stats *StatsTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := collectStats(r.Context(), broker, tdb, stats)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
@@ -0,0 +1,326 @@
+package gotelem
+
+// this file implements the control protocol of the packet websocket. Clients
+// send SubscribeControl messages on the socket to change what they get
+// without reconnecting.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+// SubscribeControl is a message from a packet websocket client. Op is one of:
+//
+//   - subscribe: add Names (whole packets) and Fields (packet.field). Idx
+//     limits the new subscriptions to some indexes of repeated packets, and
+//     Snapshot sends their latest values right away.
+//   - unsubscribe: remove Names and Fields, or everything if both are empty.
+//   - rate: limit Names (every stream if empty) to MaxRate packets per
+//     second for each index. Zero removes the limit.
+//   - pause and resume: stop sending. The latest packet of each stream is
+//     kept, and sent on resume.
+//   - ping: the server replies with pong.
+//
+// Every message gets a reply with the same Id.
+type SubscribeControl struct {
+	Op       string          `json:"op"`
+	Id       json.RawMessage `json:"id,omitempty"`
+	Names    []string        `json:"names,omitempty"`
+	Fields   []string        `json:"fields,omitempty"`
+	Indexes  []int           `json:"idx,omitempty"`
+	MaxRate  float64         `json:"max_rate,omitempty"`
+	Snapshot bool            `json:"snapshot,omitempty"`
+}
+
+// SubscribeReply is the reply to a SubscribeControl. Op is "ok", "pong" or
+// "error". Packets never have an op, so clients can tell them apart.
+type SubscribeReply struct {
+	Op    string          `json:"op"`
+	Id    json.RawMessage `json:"id,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// packetSub is a subscription to a single packet name.
+type packetSub struct {
+	indexes []int    // nil is every index.
+	fields  []string // nil is the whole packet.
+}
+
+// packetSubs is what a websocket client is subscribed to. The broker checks
+// it from Publish, so it has a lock.
+type packetSubs struct {
+	mu sync.RWMutex
+	// base is the filter from the query parameters, used until the client
+	// subscribes to something. It's nil if the query had names, those are
+	// turned into subs.
+	base  *BusEventFilter
+	names map[string]*packetSub
+	defs  *skylab.SkylabFile
+}
+
+func newPacketSubs(bef BusEventFilter) (*packetSubs, error) {
+	defs, err := skylab.Definitions()
+	if err != nil {
+		return nil, err
+	}
+	s := &packetSubs{names: make(map[string]*packetSub), defs: defs}
+	if len(bef.Names) == 0 {
+		s.base = &bef
+		return s, nil
+	}
+	for _, name := range bef.Names {
+		s.names[name] = &packetSub{indexes: bef.Indexes}
+	}
+	return s, nil
+}
+
+func (s *packetSubs) wants(ev skylab.BusEvent) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.base != nil {
+		return s.base.Match(ev)
+	}
+	sub, ok := s.names[ev.Name]
+	if !ok {
+		return false
+	}
+	if sub.indexes != nil {
+		idx, ok := packetIndex(ev.Data)
+		return ok && slices.Contains(sub.indexes, idx)
+	}
+	return true
+}
+
+// splitField splits a packet.field, and checks that it exists.
+func (s *packetSubs) splitField(f string) (string, string, error) {
+	name, field, ok := strings.Cut(f, ".")
+	if !ok {
+		return "", "", fmt.Errorf("field %q should be packet.field", f)
+	}
+	p, ok := s.defs.Packet(name)
+	if !ok {
+		return "", "", fmt.Errorf("unknown packet %q", name)
+	}
+	if _, ok := p.Field(field); !ok {
+		return "", "", fmt.Errorf("unknown field %q", f)
+	}
+	return name, field, nil
+}
+
+func (s *packetSubs) subscribe(msg SubscribeControl) error {
+	for _, name := range msg.Names {
+		if _, ok := s.defs.Packet(name); !ok {
+			return fmt.Errorf("unknown packet %q", name)
+		}
+	}
+	for _, f := range msg.Fields {
+		if _, _, err := s.splitField(f); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the first subscribe replaces the query filter.
+	s.base = nil
+	for _, name := range msg.Names {
+		s.names[name] = &packetSub{indexes: msg.Indexes}
+	}
+	for _, f := range msg.Fields {
+		name, field, _ := s.splitField(f)
+		sub, ok := s.names[name]
+		if !ok {
+			s.names[name] = &packetSub{indexes: msg.Indexes, fields: []string{field}}
+			continue
+		}
+		if msg.Indexes != nil {
+			sub.indexes = msg.Indexes
+		}
+		if sub.fields != nil && !slices.Contains(sub.fields, field) {
+			sub.fields = append(sub.fields, field)
+		}
+	}
+	return nil
+}
+
+func (s *packetSubs) unsubscribe(msg SubscribeControl) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(msg.Names) == 0 && len(msg.Fields) == 0 {
+		s.base = nil
+		clear(s.names)
+		return nil
+	}
+	if s.base != nil {
+		return errors.New("subscribed to every packet, subscribe to the ones you want instead")
+	}
+	for _, name := range msg.Names {
+		delete(s.names, name)
+	}
+	for _, f := range msg.Fields {
+		name, field, err := s.splitField(f)
+		if err != nil {
+			return err
+		}
+		sub, ok := s.names[name]
+		if !ok {
+			continue
+		}
+		if sub.fields == nil {
+			// the whole packet, so keep every other field.
+			p, _ := s.defs.Packet(name)
+			for _, fd := range p.Data {
+				sub.fields = append(sub.fields, fd.Name)
+			}
+		}
+		sub.fields = slices.DeleteFunc(sub.fields, func(s string) bool { return s == field })
+		if len(sub.fields) == 0 {
+			delete(s.names, name)
+		}
+	}
+	return nil
+}
+
+// render gets what to send for an event, which only has the subscribed
+// fields if the client asked for some.
+func (s *packetSubs) render(ev skylab.BusEvent) any {
+	s.mu.RLock()
+	var fields []string
+	if sub, ok := s.names[ev.Name]; ok && s.base == nil {
+		fields = slices.Clone(sub.fields)
+	}
+	s.mu.RUnlock()
+	if fields == nil {
+		return ev
+	}
+	b, err := json.Marshal(ev.Data)
+	if err != nil {
+		return ev
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(b, &data); err != nil {
+		return ev
+	}
+	// keep the index, otherwise repeated packets can't be told apart.
+	fields = append(fields, "idx")
+	for k := range data {
+		if !slices.Contains(fields, k) {
+			delete(data, k)
+		}
+	}
+	b, _ = json.Marshal(data)
+	return skylab.RawJsonEvent{Timestamp: ev.Timestamp.UnixMilli(), Name: ev.Name, Data: b}
+}
+
+// packetStream is a single stream of packets, rates are limited for each one.
+type packetStream struct {
+	name string
+	idx  int // -1 if the packet isn't repeated.
+}
+
+func streamOf(ev skylab.BusEvent) packetStream {
+	idx, ok := packetIndex(ev.Data)
+	if !ok {
+		idx = -1
+	}
+	return packetStream{ev.Name, idx}
+}
+
+// outbox limits the rate of packets for each stream, and holds them while
+// paused. Like the Coalesce policy, only the latest held packet of a stream
+// is kept.
+type outbox struct {
+	rates   map[string]time.Duration // minimum time between packets by name, "" is the default.
+	last    map[packetStream]time.Time
+	pending map[packetStream]skylab.BusEvent
+	order   []packetStream // pending streams, oldest first.
+	paused  bool
+}
+
+func newOutbox() *outbox {
+	return &outbox{
+		rates:   make(map[string]time.Duration),
+		last:    make(map[packetStream]time.Time),
+		pending: make(map[packetStream]skylab.BusEvent),
+	}
+}
+
+func (o *outbox) interval(s packetStream) time.Duration {
+	if d, ok := o.rates[s.name]; ok {
+		return d
+	}
+	return o.rates[""]
+}
+
+// setRate sets the max rate of the names, or the default if there are none.
+func (o *outbox) setRate(names []string, rate float64) error {
+	if rate < 0 {
+		return errors.New("max_rate can't be negative")
+	}
+	var d time.Duration
+	if rate > 0 {
+		d = time.Duration(float64(time.Second) / rate)
+	}
+	if len(names) == 0 {
+		names = []string{""}
+	}
+	for _, name := range names {
+		o.rates[name] = d
+	}
+	return nil
+}
+
+// offer returns true if the event can be sent now, otherwise it's held
+// until flush.
+func (o *outbox) offer(ev skylab.BusEvent, now time.Time) bool {
+	s := streamOf(ev)
+	_, held := o.pending[s]
+	if !o.paused {
+		if iv := o.interval(s); iv == 0 || now.Sub(o.last[s]) >= iv {
+			o.last[s] = now
+			if held {
+				// this is newer than the held one.
+				delete(o.pending, s)
+				o.order = slices.DeleteFunc(o.order, func(p packetStream) bool { return p == s })
+			}
+			return true
+		}
+	}
+	if !held {
+		o.order = append(o.order, s)
+	}
+	o.pending[s] = ev
+	return false
+}
+
+// flush returns the held events that can be sent now, and when the next one
+// can be sent. That's zero if nothing is held, or if paused.
+func (o *outbox) flush(now time.Time) ([]skylab.BusEvent, time.Time) {
+	if o.paused {
+		return nil, time.Time{}
+	}
+	var res []skylab.BusEvent
+	var next time.Time
+	keep := o.order[:0]
+	for _, s := range o.order {
+		due := o.last[s].Add(o.interval(s))
+		if due.After(now) {
+			keep = append(keep, s)
+			if next.IsZero() || due.Before(next) {
+				next = due
+			}
+			continue
+		}
+		res = append(res, o.pending[s])
+		o.last[s] = now
+		delete(o.pending, s)
+	}
+	o.order = keep
+	return res, next
+}
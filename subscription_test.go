@@ -0,0 +1,201 @@
+package gotelem
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/kschamplin/gotelem/skylab"
+)
+
+func TestPacketSubs(t *testing.T) {
+	measurement := skylab.BusEvent{Name: "bms_measurement", Data: &skylab.BmsMeasurement{BatteryVoltage: 1, AuxVoltage: 2, Current: 3}}
+	module := func(idx uint32) skylab.BusEvent {
+		return skylab.BusEvent{Name: "bms_module", Data: &skylab.BmsModule{Idx: idx}}
+	}
+	soc := skylab.BusEvent{Name: "bms_soc", Data: &skylab.BmsSoc{}}
+
+	tests := []struct {
+		name    string
+		query   BusEventFilter
+		msgs    []SubscribeControl
+		wantErr bool
+		wants   []skylab.BusEvent
+		rejects []skylab.BusEvent
+		fields  string // the rendered data of measurement, if it's wanted.
+	}{
+		{
+			name:  "query filter until subscribe",
+			wants: []skylab.BusEvent{measurement, module(1), soc},
+		},
+		{
+			name:    "subscribe replaces query",
+			msgs:    []SubscribeControl{{Op: "subscribe", Names: []string{"bms_module"}, Indexes: []int{1}}},
+			wants:   []skylab.BusEvent{module(1)},
+			rejects: []skylab.BusEvent{measurement, module(2), soc},
+		},
+		{
+			name:  "query names",
+			query: BusEventFilter{Names: []string{"bms_measurement"}},
+			msgs: []SubscribeControl{
+				{Op: "subscribe", Names: []string{"bms_soc"}},
+				{Op: "unsubscribe", Names: []string{"bms_soc"}},
+			},
+			wants:   []skylab.BusEvent{measurement},
+			rejects: []skylab.BusEvent{soc, module(1)},
+			fields:  `{"battery_voltage":1,"aux_voltage":2,"current":3}`,
+		},
+		{
+			name:   "fields",
+			msgs:   []SubscribeControl{{Op: "subscribe", Fields: []string{"bms_measurement.current", "bms_measurement.aux_voltage"}}},
+			wants:  []skylab.BusEvent{measurement},
+			fields: `{"aux_voltage":2,"current":3}`,
+		},
+		{
+			name: "unsubscribe field of whole packet",
+			msgs: []SubscribeControl{
+				{Op: "subscribe", Names: []string{"bms_measurement"}},
+				{Op: "unsubscribe", Fields: []string{"bms_measurement.current"}},
+			},
+			wants:  []skylab.BusEvent{measurement},
+			fields: `{"aux_voltage":2,"battery_voltage":1}`,
+		},
+		{
+			name: "unsubscribe every field",
+			msgs: []SubscribeControl{
+				{Op: "subscribe", Fields: []string{"bms_measurement.current"}},
+				{Op: "unsubscribe", Fields: []string{"bms_measurement.current"}},
+			},
+			rejects: []skylab.BusEvent{measurement},
+		},
+		{
+			name:    "unsubscribe everything",
+			msgs:    []SubscribeControl{{Op: "unsubscribe"}},
+			rejects: []skylab.BusEvent{measurement, soc},
+		},
+		{
+			name:    "unknown packet",
+			msgs:    []SubscribeControl{{Op: "subscribe", Names: []string{"nope"}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			msgs:    []SubscribeControl{{Op: "subscribe", Fields: []string{"bms_measurement.nope"}}},
+			wantErr: true,
+		},
+		{
+			name:    "partial unsubscribe from everything",
+			msgs:    []SubscribeControl{{Op: "unsubscribe", Names: []string{"bms_soc"}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subs, err := newPacketSubs(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, msg := range tt.msgs {
+				if msg.Op == "subscribe" {
+					err = subs.subscribe(msg)
+				} else {
+					err = subs.unsubscribe(msg)
+				}
+				if err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, ev := range tt.wants {
+				if !subs.wants(ev) {
+					t.Errorf("expected %s to be wanted", ev.Name)
+				}
+			}
+			for _, ev := range tt.rejects {
+				if subs.wants(ev) {
+					t.Errorf("expected %s to not be wanted", ev.Name)
+				}
+			}
+			if tt.fields != "" {
+				b, err := json.Marshal(subs.render(measurement))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got skylab.RawJsonEvent
+				if err := json.Unmarshal(b, &got); err != nil {
+					t.Fatal(err)
+				}
+				if !jsonEqual(t, got.Data, []byte(tt.fields)) {
+					t.Errorf("got data %s, want %s", got.Data, tt.fields)
+				}
+			}
+		})
+	}
+}
+
+func jsonEqual(t *testing.T, a, b []byte) bool {
+	var x, y map[string]any
+	if err := json.Unmarshal(a, &x); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func TestOutbox(t *testing.T) {
+	now := time.UnixMilli(1700000000000)
+	ev := func(name string, v uint16) skylab.BusEvent {
+		return skylab.BusEvent{Name: name, Data: &skylab.BmsMeasurement{BatteryVoltage: v}}
+	}
+
+	t.Run("rate limit", func(t *testing.T) {
+		o := newOutbox()
+		if err := o.setRate([]string{"a"}, 2); err != nil {
+			t.Fatal(err)
+		}
+		if !o.offer(ev("a", 1), now) {
+			t.Fatal("first event should be sent")
+		}
+		if o.offer(ev("a", 2), now.Add(100*time.Millisecond)) || o.offer(ev("a", 3), now.Add(200*time.Millisecond)) {
+			t.Fatal("events within the interval should be held")
+		}
+		if !o.offer(ev("b", 1), now.Add(200*time.Millisecond)) {
+			t.Fatal("other streams aren't limited")
+		}
+		evs, next := o.flush(now.Add(300 * time.Millisecond))
+		if len(evs) != 0 || !next.Equal(now.Add(500*time.Millisecond)) {
+			t.Fatalf("nothing should be due yet, got %d events, next %v", len(evs), next)
+		}
+		evs, next = o.flush(now.Add(500 * time.Millisecond))
+		if len(evs) != 1 || evs[0].Data.(*skylab.BmsMeasurement).BatteryVoltage != 3 || !next.IsZero() {
+			t.Fatalf("expected the latest held event, got %v, next %v", evs, next)
+		}
+	})
+
+	t.Run("pause", func(t *testing.T) {
+		o := newOutbox()
+		o.paused = true
+		if o.offer(ev("a", 1), now) || o.offer(ev("a", 2), now) || o.offer(ev("b", 1), now) {
+			t.Fatal("nothing should be sent while paused")
+		}
+		if evs, _ := o.flush(now); len(evs) != 0 {
+			t.Fatal("nothing should be flushed while paused")
+		}
+		o.paused = false
+		evs, _ := o.flush(now)
+		if len(evs) != 2 || evs[0].Name != "a" || evs[0].Data.(*skylab.BmsMeasurement).BatteryVoltage != 2 || evs[1].Name != "b" {
+			t.Fatalf("expected the latest of each stream in order, got %v", evs)
+		}
+	})
+
+	t.Run("bad rate", func(t *testing.T) {
+		if err := newOutbox().setRate(nil, -1); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
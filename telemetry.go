@@ -0,0 +1,434 @@
+package gotelem
+
+// this file implements the OpenMCT telemetry endpoints. They work on the
+// telemetry objects from the dictionary, so a client asks for
+// bms_measurement.current instead of filtering whole packets itself.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	"github.com/kschamplin/gotelem/skylab"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// TelemetryPoint is a single value of a telemetry object, in the shape the
+// dictionary's value metadata describes. Values are already scaled by the
+// field's conversion.
+type TelemetryPoint struct {
+	Key       string `json:"key,omitempty"` // only set for realtime points.
+	Timestamp int64  `json:"ts"`            // unix milliseconds.
+	Value     any    `json:"val"`
+}
+
+var compiledDictOnce sync.Once
+var compiledDict *Dictionary
+var compiledDictErr error
+
+// compiledDictionary is the dictionary for the compiled in definitions. It's
+// shared, so it must not be modified.
+func compiledDictionary() (*Dictionary, error) {
+	compiledDictOnce.Do(func() {
+		defs, err := skylab.Definitions()
+		if err != nil {
+			compiledDictErr = err
+			return
+		}
+		compiledDict = NewDictionary(defs)
+	})
+	return compiledDict, compiledDictErr
+}
+
+// datumObject gets the telemetry object for a key.
+func datumObject(dict *Dictionary, key string) (*DomainObject, bool) {
+	obj, ok := dict.Object(key)
+	if !ok || obj.Datum == nil {
+		return nil, false
+	}
+	return obj, true
+}
+
+// path is the json path of the datum in the packet data, i.e
+// pack_choice.large_pack for a bit.
+func (d DictionaryDatum) path() string {
+	if d.Bit != "" {
+		return d.Field + "." + d.Bit
+	}
+	return d.Field
+}
+
+// filter gets the events the datum comes from.
+func (d DictionaryDatum) filter() BusEventFilter {
+	f := BusEventFilter{Names: []string{d.Packet}}
+	if d.Idx != nil {
+		f.Indexes = []int{int(*d.Idx)}
+	}
+	return f
+}
+
+// conversionFactor turns the conversion into a float64 without picking up
+// float32 rounding, so 0.01 stays 0.01.
+func conversionFactor(c float32) float64 {
+	f, _ := strconv.ParseFloat(strconv.FormatFloat(float64(c), 'g', -1, 32), 64)
+	return f
+}
+
+// scaleValue applies the conversion of the object to a raw value. Bits become
+// 0 or 1, to match the enumerations in the dictionary.
+func scaleValue(obj *DomainObject, v any) any {
+	switch b := v.(type) {
+	case bool:
+		if b {
+			return 1
+		}
+		return 0
+	}
+	if obj.Conversion == 0 || obj.Conversion == 1 {
+		return v
+	}
+	f, ok := datumFloat(v)
+	if !ok {
+		return v
+	}
+	return f * conversionFactor(obj.Conversion)
+}
+
+func toPoints(obj *DomainObject, data []Datum) []TelemetryPoint {
+	res := make([]TelemetryPoint, len(data))
+	for i, d := range data {
+		res[i] = TelemetryPoint{Timestamp: d.Timestamp.UnixMilli(), Value: scaleValue(obj, d.Value)}
+	}
+	return res
+}
+
+// eventPoint gets the value of a telemetry object from a bus event. It's false
+// if the event doesn't have it, i.e a different idx.
+func eventPoint(obj *DomainObject, ev skylab.BusEvent, data map[string]any) (TelemetryPoint, bool) {
+	d := obj.Datum
+	if ev.Name != d.Packet {
+		return TelemetryPoint{}, false
+	}
+	if d.Idx != nil {
+		idx, ok := data["idx"].(float64)
+		if !ok || uint32(idx) != *d.Idx {
+			return TelemetryPoint{}, false
+		}
+	}
+	v, ok := data[d.Field]
+	if !ok {
+		return TelemetryPoint{}, false
+	}
+	if d.Bit != "" {
+		bits, _ := v.(map[string]any)
+		if v, ok = bits[d.Bit]; !ok {
+			return TelemetryPoint{}, false
+		}
+	}
+	return TelemetryPoint{
+		Key:       obj.Identifier.Key,
+		Timestamp: ev.Timestamp.UnixMilli(),
+		Value:     scaleValue(obj, v),
+	}, true
+}
+
+// parseTelemetryTime parses a time from OpenMCT, which uses unix
+// milliseconds. RFC3339 works too, like the other endpoints.
+func parseTelemetryTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// defaultMinMaxSize is the number of buckets when the client doesn't say.
+// maxTelemetryPoints is the most raw values the history sends, and the
+// largest size it takes.
+const (
+	defaultMinMaxSize  = 1000
+	maxTelemetryPoints = 10000
+)
+
+func apiV1Telemetry(broker *Broker, tdb *TelemDb, stats *StatsTracker) func(chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/subscribe", apiV1TelemetrySubscribe(broker, stats))
+		r.Get("/{key}", apiV1TelemetryHistory(tdb))
+	}
+}
+
+// apiV1TelemetryHistory gets the history of one telemetry object, oldest
+// first. It takes start and end, and optionally an OpenMCT strategy: latest
+// gets the last size values (default 1), minmax keeps the smallest and largest
+// value of size buckets between start and end. Without a strategy it sends the
+// raw values, unless there are too many, then it does minmax.
+func apiV1TelemetryHistory(tdb *TelemDb) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dict, err := compiledDictionary()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		obj, ok := datumObject(dict, chi.URLParam(r, "key"))
+		if !ok {
+			http.Error(w, "unknown telemetry key", http.StatusNotFound)
+			return
+		}
+		bef := obj.Datum.filter()
+		v := r.URL.Query()
+		if el := v.Get("start"); el != "" {
+			if bef.StartTime, err = parseTelemetryTime(el); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if el := v.Get("end"); el != "" {
+			if bef.EndTime, err = parseTelemetryTime(el); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		size := 0
+		if el := v.Get("size"); el != "" {
+			if size, err = strconv.Atoi(el); err != nil || size < 0 {
+				http.Error(w, "size must be a positive number", http.StatusBadRequest)
+				return
+			}
+		}
+		size = min(size, maxTelemetryPoints)
+
+		strategy := v.Get("strategy")
+		switch strategy {
+		case "latest":
+		case "", "minmax":
+			// these go through everything in the range, so it has to have one.
+			if bef.StartTime.IsZero() || bef.EndTime.IsZero() {
+				http.Error(w, "start and end are required", http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, "strategy must be latest or minmax", http.StatusBadRequest)
+			return
+		}
+
+		var data []Datum
+		field := obj.Datum.path()
+		if strategy == "" {
+			var next *Cursor
+			data, next, err = tdb.GetValuesPage(r.Context(), bef, field,
+				KeysetModifier{Ascending: true, Limit: maxTelemetryPoints})
+			if err == nil && next != nil {
+				// there's more than we want to send, reduce it instead.
+				strategy = "minmax"
+			}
+		}
+		switch strategy {
+		case "latest":
+			data, err = tdb.GetValues(r.Context(), bef, field, &LimitOffsetModifier{Limit: max(size, 1)})
+			// these are newest first.
+			slices.Reverse(data)
+		case "minmax":
+			if size == 0 {
+				size = defaultMinMaxSize
+			}
+			// if there's less time than buckets, use 1ms buckets. That's still
+			// no more than two points for each bucket that was asked for.
+			bucket := max(bef.EndTime.Sub(bef.StartTime)/time.Duration(size), time.Millisecond)
+			data, err = tdb.GetMinMax(r.Context(), bef, field, bucket)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(toPoints(obj, data))
+	}
+}
+
+// TelemetryRequest is sent by realtime clients to change what they get.
+type TelemetryRequest struct {
+	Subscribe   []string `json:"subscribe,omitempty"`
+	Unsubscribe []string `json:"unsubscribe,omitempty"`
+}
+
+// telemetryError is sent to realtime clients when a request is bad. The
+// connection stays open.
+type telemetryError struct {
+	Error string `json:"error"`
+}
+
+// telemetrySubs is the telemetry objects a realtime client wants. The
+// broker checks it from Publish, so it has a lock.
+type telemetrySubs struct {
+	mu   sync.RWMutex
+	objs map[string]*DomainObject // by key
+	pkts map[string]int           // packet name -> number of objects
+}
+
+func (s *telemetrySubs) add(obj *DomainObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.objs[obj.Identifier.Key]; ok {
+		return
+	}
+	s.objs[obj.Identifier.Key] = obj
+	s.pkts[obj.Datum.Packet]++
+}
+
+func (s *telemetrySubs) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objs[key]
+	if !ok {
+		return
+	}
+	delete(s.objs, key)
+	if s.pkts[obj.Datum.Packet]--; s.pkts[obj.Datum.Packet] == 0 {
+		delete(s.pkts, obj.Datum.Packet)
+	}
+}
+
+func (s *telemetrySubs) wants(ev skylab.BusEvent) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pkts[ev.Name] > 0
+}
+
+// points gets the values of every subscribed object in the event.
+func (s *telemetrySubs) points(ev skylab.BusEvent) []TelemetryPoint {
+	s.mu.RLock()
+	objs := make([]*DomainObject, 0)
+	for _, obj := range s.objs {
+		if obj.Datum.Packet == ev.Name {
+			objs = append(objs, obj)
+		}
+	}
+	s.mu.RUnlock()
+	return eventPoints(objs, ev)
+}
+
+func eventPoints(objs []*DomainObject, ev skylab.BusEvent) []TelemetryPoint {
+	if len(objs) == 0 {
+		return nil
+	}
+	// go through json so generated and dynamic packets work the same.
+	b, err := json.Marshal(ev.Data)
+	if err != nil {
+		return nil
+	}
+	var data map[string]any
+	if err := json.Unmarshal(b, &data); err != nil {
+		return nil
+	}
+	res := make([]TelemetryPoint, 0, len(objs))
+	for _, obj := range objs {
+		if p, ok := eventPoint(obj, ev, data); ok {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// apiV1TelemetrySubscribe is a websocket of realtime telemetry points. The
+// client sends TelemetryRequests to subscribe and unsubscribe keys, and gets a
+// TelemetryPoint for each new value. New subscriptions get the latest value
+// right away if there is one.
+func apiV1TelemetrySubscribe(broker *Broker, stats *StatsTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dict, err := compiledDictionary()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		subs := &telemetrySubs{
+			objs: make(map[string]*DomainObject),
+			pkts: make(map[string]int),
+		}
+		// every value is sent while the client keeps up. If it falls
+		// behind, only the latest of each packet and index is kept.
+		conn_id := r.RemoteAddr + uuid.NewString()
+		sub, err := broker.Subscribe(conn_id, WithPredicate(subs.wants), WithOverflowPolicy(Coalesce))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "error subscribing: %s", err)
+			return
+		}
+		defer broker.Unsubscribe(conn_id)
+
+		c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer c.CloseNow()
+		defer stats.trackWebsocket("telemetry")()
+		ctx := r.Context()
+
+		// read requests on their own goroutine, so all the writes happen here.
+		reqs := make(chan TelemetryRequest)
+		readErr := make(chan error, 1)
+		go func() {
+			for {
+				var req TelemetryRequest
+				if err := wsjson.Read(ctx, c, &req); err != nil {
+					readErr <- err
+					return
+				}
+				select {
+				case reqs <- req:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err := <-readErr:
+				var ce websocket.CloseError
+				if !errors.As(err, &ce) {
+					c.Close(websocket.StatusUnsupportedData, "bad request")
+				}
+				return
+			case req := <-reqs:
+				added := make([]*DomainObject, 0, len(req.Subscribe))
+				for _, key := range req.Subscribe {
+					obj, ok := datumObject(dict, key)
+					if !ok {
+						wsjson.Write(ctx, c, telemetryError{Error: fmt.Sprintf("unknown telemetry key %q", key)})
+						continue
+					}
+					subs.add(obj)
+					added = append(added, obj)
+				}
+				for _, key := range req.Unsubscribe {
+					subs.remove(key)
+				}
+				// send the current values of the keys, even if they were
+				// already subscribed since that's usually a new view.
+				for _, ev := range broker.latestMatching(func(ev skylab.BusEvent) bool {
+					return slices.ContainsFunc(added, func(o *DomainObject) bool { return o.Datum.Packet == ev.Name })
+				}) {
+					for _, p := range eventPoints(added, ev) {
+						wsjson.Write(ctx, c, p)
+					}
+				}
+			case ev := <-sub:
+				for _, p := range subs.points(ev) {
+					wsjson.Write(ctx, c, p)
+				}
+			}
+		}
+	}
+}
@@ -237,9 +237,11 @@ function TelemRealtimeProvider() {
         const simpleIndicator = openmct.indicators.simpleIndicator();
         openmct.indicators.add(simpleIndicator);
         simpleIndicator.text("0 Listeners")
-        const url = `${process.env.BASE_URL.replace(/^http/, 'ws')}/api/v1/packets/subscribe?`
-        // we put our websocket connection here.
-        let connection = new WebSocket(url)
+        // we keep one websocket connection, and change what it sends us
+        // with control messages. It starts empty, otherwise we'd get every
+        // packet until the first subscribe.
+        const url = `${process.env.BASE_URL.replace(/^http/, 'ws')}/api/v1/packets/subscribe?empty=true`
+        const connection = new WebSocket(url)
         // connections contains name: callback mapping
         const callbacks = {}
 
@@ -249,6 +251,10 @@ function TelemRealtimeProvider() {
 
         function handleMessage(event) {
             const data: PacketData = JSON.parse(event.data)
+            if (!data.name) {
+                // it's a reply to a control message.
+                return
+            }
             for (const [key, value] of Object.entries(data.data)) { // for each of the fields in the data
                 const id = `${data.name}.${key}` // if we have a matching callback for that field.
                 if (id in callbacks) {
@@ -261,15 +267,15 @@ function TelemRealtimeProvider() {
                 }
             }
         }
-
-        function updateWebsocket() {
-            const params = new URLSearchParams()
-            for (const name in names) {
-                params.append("name", name)
+        connection.onmessage = handleMessage
+
+        function control(msg: object) {
+            const send = () => connection.send(JSON.stringify(msg))
+            if (connection.readyState === WebSocket.CONNECTING) {
+                connection.addEventListener("open", send, { once: true })
+            } else {
+                send()
             }
-            connection = new WebSocket(url + params)
-
-            connection.onmessage = handleMessage
             simpleIndicator.text(`${names.size} Listeners`)
         }
 
@@ -286,19 +292,18 @@ function TelemRealtimeProvider() {
                 callbacks[key] = callback
                 conversions.set(key, dObj.conversion || 1)
                 names.add(pktName)
-                // update the websocket URL with the new name.
-                updateWebsocket()
+                // get the latest values right away instead of waiting for them.
+                control({ op: "subscribe", names: [pktName], snapshot: true })
                 return function unsubscribe() {
                     // if there's no more listeners on this packet,
                     // we can remove it.
                     console.log("subscribe called %s", JSON.stringify(dObj))
-                    if (!Object.keys(callbacks).some((k) => k.startsWith(pktName))) {
-                        names.delete(pktName)
-                        updateWebsocket()
-                    }
-
                     delete callbacks[key]
                     conversions.delete(key)
+                    if (!Object.keys(callbacks).some((k) => k.startsWith(`${pktName}.`))) {
+                        names.delete(pktName)
+                        control({ op: "unsubscribe", names: [pktName] })
+                    }
                 }
             }
         }
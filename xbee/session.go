@@ -18,6 +18,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"log/slog"
@@ -59,6 +60,29 @@ type Session struct {
 
 	// local address
 	lAddr XBeeAddr
+
+	stats sessionCounters
+}
+
+// SessionStats are counters for the link between the session and the
+// network. Packets are data from or to remote XBees, frames are every API
+// frame.
+type SessionStats struct {
+	RxFrames  uint64    `json:"rx_frames"`
+	BadFrames uint64    `json:"bad_frames"` // frames that couldn't be parsed.
+	RxPackets uint64    `json:"rx_packets"`
+	RxBytes   uint64    `json:"rx_bytes"`
+	TxPackets uint64    `json:"tx_packets"`
+	TxBytes   uint64    `json:"tx_bytes"`
+	TxFailed  uint64    `json:"tx_failed"` // packets that weren't acked, or timed out.
+	LastRx    time.Time `json:"last_rx,omitempty"`
+}
+
+type sessionCounters struct {
+	rxFrames, badFrames          atomic.Uint64
+	rxPackets, rxBytes           atomic.Uint64
+	txPackets, txBytes, txFailed atomic.Uint64
+	lastRx                       atomic.Int64 // unix nanoseconds, 0 if nothing was received.
 }
 
 // NewSession takes an IO device and a logger and returns a new XBee session.
@@ -117,8 +141,10 @@ func (sess *Session) rxHandler() {
 		sess.log.Debug("got an api frame", "data", data)
 		if err != nil {
 			sess.log.Warn("error parsing frame", "error", err, "data", data)
+			sess.stats.badFrames.Add(1)
 			continue
 		}
+		sess.stats.rxFrames.Add(1)
 
 		switch XBeeCmd(data[0]) {
 		case RxPktType:
@@ -127,8 +153,12 @@ func (sess *Session) rxHandler() {
 			frame, err := ParseRxFrame(data)
 			if err != nil {
 				sess.log.Warn("error parsing rx packet", "error", err, "data", data)
+				sess.stats.badFrames.Add(1)
 				break //continue?
 			}
+			sess.stats.rxPackets.Add(1)
+			sess.stats.rxBytes.Add(uint64(len(frame.Payload)))
+			sess.stats.lastRx.Store(time.Now().UnixNano())
 
 			// write it to either the connection or the default buffer.
 			if c, ok := sess.conns[frame.Source]; ok {
@@ -196,9 +226,18 @@ func (sess *Session) writeAddr(p []byte, dest uint64) (n int, err error) {
 	n, err = writeXBeeFrame(sess.ioDev, wf.Bytes())
 	sess.writeLock.Unlock()
 	if err != nil {
+		sess.stats.txFailed.Add(1)
 		return
 	}
 	n = len(p)
+	defer func() {
+		if err != nil {
+			sess.stats.txFailed.Add(1)
+			return
+		}
+		sess.stats.txPackets.Add(1)
+		sess.stats.txBytes.Add(uint64(n))
+	}()
 
 	// finally, wait for the channel we got to return. this means that
 	// the matching response frame was received, so we can parse it.
@@ -269,9 +308,35 @@ func (sess *Session) ATCommand(cmd [2]byte, data []byte, queued bool) (payload [
 
 }
 
-// Does this need to exist?
-func (sess *Session) GetStatus() {
-	panic("TODO: implement")
+// Stats returns the link counters of the session.
+func (sess *Session) Stats() SessionStats {
+	st := SessionStats{
+		RxFrames:  sess.stats.rxFrames.Load(),
+		BadFrames: sess.stats.badFrames.Load(),
+		RxPackets: sess.stats.rxPackets.Load(),
+		RxBytes:   sess.stats.rxBytes.Load(),
+		TxPackets: sess.stats.txPackets.Load(),
+		TxBytes:   sess.stats.txBytes.Load(),
+		TxFailed:  sess.stats.txFailed.Load(),
+	}
+	if ns := sess.stats.lastRx.Load(); ns != 0 {
+		st.LastRx = time.Unix(0, ns)
+	}
+	return st
+}
+
+// RSSI gets the signal strength of the last packet that was received, in
+// dBm. It asks the XBee, so it can take up to a second.
+func (sess *Session) RSSI() (int, error) {
+	b, err := sess.ATCommand([2]byte{'D', 'B'}, nil, false)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 1 {
+		return 0, fmt.Errorf("bad DB response length %d", len(b))
+	}
+	// the response is the magnitude.
+	return -int(b[0]), nil
 }
 
 // Implement the io.Closer.